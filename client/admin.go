@@ -0,0 +1,186 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+
+	"github.com/Baazaouihamza/crypto-exchange/server"
+)
+
+// AdminClient calls the admin API, its requests are signed with an admin
+// key. Point Endpoint at the admin listener when it has its own.
+type AdminClient struct {
+	*Client
+}
+
+func NewAdminClient(apiKey, secret string) *AdminClient {
+	return &AdminClient{Client: NewClient(apiKey, secret)}
+}
+
+// do sends a signed request with params as the JSON body, if any, and
+// decodes the response into v.
+func (c *AdminClient) do(method, path string, params, v any) error {
+	var body []byte
+	if params != nil {
+		b, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		body = b
+	}
+
+	req, err := http.NewRequest(method, c.Endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if err := c.sign(req, body); err != nil {
+		return err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+
+	return decodeResponse(resp, v)
+}
+
+func (c *AdminClient) GetStatus() (*server.SystemStatus, error) {
+	status := &server.SystemStatus{}
+	if err := c.do(http.MethodGet, "/admin/status", nil, status); err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
+
+// GetAudit returns the last limit entries of the audit trail, the
+// default number when limit is zero.
+func (c *AdminClient) GetAudit(limit int) ([]server.AuditEntry, error) {
+	path := "/admin/audit"
+	if limit > 0 {
+		path = fmt.Sprintf("%s?limit=%d", path, limit)
+	}
+
+	var entries []server.AuditEntry
+	if err := c.do(http.MethodGet, path, nil, &entries); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+func (c *AdminClient) ListMarket(cfg server.MarketConfig) (*server.MarketConfig, error) {
+	listed := &server.MarketConfig{}
+	if err := c.do(http.MethodPost, "/admin/markets", cfg, listed); err != nil {
+		return nil, err
+	}
+
+	return listed, nil
+}
+
+func (c *AdminClient) DelistMarket(market server.Market, reason string) (*server.MarketConfig, error) {
+	path := fmt.Sprintf("/admin/markets/%s?reason=%s", market, url.QueryEscape(reason))
+
+	delisted := &server.MarketConfig{}
+	if err := c.do(http.MethodDelete, path, nil, delisted); err != nil {
+		return nil, err
+	}
+
+	return delisted, nil
+}
+
+// SetMarketStatus halts, resumes or puts a market in close only.
+func (c *AdminClient) SetMarketStatus(market server.Market, status server.MarketStatus, reason string) (*server.MarketConfig, error) {
+	params := &server.MarketStatusRequest{Status: status, Reason: reason}
+
+	cfg := &server.MarketConfig{}
+	if err := c.do(http.MethodPost, fmt.Sprintf("/admin/markets/%s/status", market), params, cfg); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func (c *AdminClient) GetUsers() ([]server.UserInfo, error) {
+	var users []server.UserInfo
+	if err := c.do(http.MethodGet, "/admin/users", nil, &users); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// CreateUser creates a user, the response holds the only copy of the API
+// secrets.
+func (c *AdminClient) CreateUser(params *server.CreateUserRequest) (*server.CreateUserResponse, error) {
+	created := &server.CreateUserResponse{}
+	if err := c.do(http.MethodPost, "/admin/users", params, created); err != nil {
+		return nil, err
+	}
+
+	return created, nil
+}
+
+// DisableUser locks a user out and cancels their resting orders.
+func (c *AdminClient) DisableUser(userID int64, reason string) (*server.DisableUserResponse, error) {
+	params := &server.AdminRequest{Reason: reason}
+
+	disabled := &server.DisableUserResponse{}
+	if err := c.do(http.MethodPost, fmt.Sprintf("/admin/users/%d/disable", userID), params, disabled); err != nil {
+		return nil, err
+	}
+
+	return disabled, nil
+}
+
+func (c *AdminClient) EnableUser(userID int64, reason string) error {
+	params := &server.AdminRequest{Reason: reason}
+
+	return c.do(http.MethodPost, fmt.Sprintf("/admin/users/%d/enable", userID), params, nil)
+}
+
+// AdjustBalance credits a user from the exchange account when amount is
+// positive, debits them when it is negative. amount is in wei.
+func (c *AdminClient) AdjustBalance(userID int64, amount *big.Int, reason string) (*server.AuditEntry, error) {
+	params := &server.AdjustBalanceRequest{Amount: amount.String(), Reason: reason}
+
+	entry := &server.AuditEntry{}
+	if err := c.do(http.MethodPost, fmt.Sprintf("/admin/users/%d/balance", userID), params, entry); err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// CancelOrder force cancels a resting order of any user.
+func (c *AdminClient) CancelOrder(orderID int64, reason string) error {
+	path := fmt.Sprintf("/admin/orders/%d?reason=%s", orderID, url.QueryEscape(reason))
+
+	return c.do(http.MethodDelete, path, nil, nil)
+}
+
+// CancelUserOrders force cancels the resting orders of a user. market and
+// side narrow them down when not empty.
+func (c *AdminClient) CancelUserOrders(userID int64, market server.Market, side, reason string) (*server.CancelOrdersResponse, error) {
+	query := url.Values{}
+	query.Set("reason", reason)
+	if market != "" {
+		query.Set("market", string(market))
+	}
+	if side != "" {
+		query.Set("side", side)
+	}
+	path := fmt.Sprintf("/admin/users/%d/orders?%s", userID, query.Encode())
+
+	cancelled := &server.CancelOrdersResponse{}
+	if err := c.do(http.MethodDelete, path, nil, cancelled); err != nil {
+		return nil, err
+	}
+
+	return cancelled, nil
+}
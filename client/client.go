@@ -2,15 +2,23 @@ package client
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/Baazaouihamza/crypto-exchange/orderbook"
 	"github.com/Baazaouihamza/crypto-exchange/server"
+	"github.com/ethereum/go-ethereum/crypto"
 )
 
-const Endpoint = "http://localhost:3000"
+// DefaultEndpoint is where a local exchange listens.
+const DefaultEndpoint = "http://localhost:3000"
 
 type PlaceOrderParams struct {
 	UserID int64
@@ -18,20 +26,157 @@ type PlaceOrderParams struct {
 	// Price only needed for placing LIMIT orders
 	Price float64
 	Size  float64
+	// Notional places a MARKET order for a quote amount instead of Size
+	Notional float64
+	// ClientOrderID makes retries safe. When empty a new one is generated
+	// per call and returned in the response.
+	ClientOrderID string
+}
+
+// clientOrderID returns the client order ID of the params, or a new one.
+func (p *PlaceOrderParams) clientOrderID() (string, error) {
+	if p.ClientOrderID != "" {
+		return p.ClientOrderID, nil
+	}
+
+	return newNonce()
 }
 
 type Client struct {
 	*http.Client
+	// Endpoint is the base URL of the exchange API.
+	Endpoint string
+	// ChainID is the chain orders are signed for, it must match the one
+	// of the exchange.
+	ChainID int64
+	apiKey  string
+	secret  string
+	// signer signs orders with the account key of the user, the exchange
+	// may refuse unsigned orders.
+	signer *ecdsa.PrivateKey
 }
 
-func NewClient() *Client {
+// NewClient returns a client acting as the user bound to apiKey.
+func NewClient(apiKey, secret string) *Client {
 	return &Client{
-		Client: http.DefaultClient,
+		Client:   http.DefaultClient,
+		Endpoint: DefaultEndpoint,
+		ChainID:  server.DefaultChainID,
+		apiKey:   apiKey,
+		secret:   secret,
+	}
+}
+
+// sign adds the API key headers to a request of the private API.
+func (c *Client) sign(req *http.Request, body []byte) error {
+	nonce, err := newNonce()
+	if err != nil {
+		return err
+	}
+	timestamp := time.Now().UnixMilli()
+
+	req.Header.Set(server.HeaderAPIKey, c.apiKey)
+	req.Header.Set(server.HeaderAPITimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(server.HeaderAPINonce, nonce)
+	req.Header.Set(server.HeaderAPISignature, server.Sign(c.secret, timestamp, nonce, req.Method, req.URL.RequestURI(), body))
+
+	return nil
+}
+
+// SignOrdersWith makes the client sign every order it places with the
+// account key of its user.
+func (c *Client) SignOrdersWith(pk *ecdsa.PrivateKey) {
+	c.signer = pk
+}
+
+// signOrder adds the EIP-712 signature to an order when the client has a
+// signer.
+func (c *Client) signOrder(params *server.PlaceOrderRequest) error {
+	if c.signer == nil {
+		return nil
+	}
+
+	params.Nonce = uint64(time.Now().UnixNano())
+	msg := &server.OrderMessage{
+		ChainID:  c.ChainID,
+		Trader:   crypto.PubkeyToAddress(c.signer.PublicKey),
+		Market:   params.Market,
+		Type:     params.Type,
+		Bid:      params.Bid,
+		Price:    params.Price,
+		Size:     params.Size,
+		Notional: params.Notional,
+		Nonce:    params.Nonce,
+		Expiry:   params.Expiry,
+	}
+	signature, err := server.SignOrder(c.signer, msg)
+	if err != nil {
+		return err
+	}
+	params.Signature = signature
+
+	return nil
+}
+
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+func (c *Client) GetMarkets() ([]server.MarketConfig, error) {
+	e := c.Endpoint + "/markets"
+	req, err := http.NewRequest(http.MethodGet, e, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	markets := []server.MarketConfig{}
+
+	if err := decodeResponse(resp, &markets); err != nil {
+		return nil, err
 	}
+
+	return markets, nil
+}
+
+// TradesParams filters the trade history of a market, zero values do not
+// filter.
+type TradesParams struct {
+	Since time.Time
+	Until time.Time
+	// FromID returns the trades starting with that ID, pass the ID of the
+	// last trade of a page plus one to get the next one.
+	FromID int64
+	Limit  int
 }
 
-func (c *Client) GetTrades(market string) ([]*orderbook.Trade, error) {
-	e := fmt.Sprintf("%s/trades/%s", Endpoint, market)
+// GetTrades returns trades of a market in ID order, the latest ones
+// unless Since or FromID are set.
+func (c *Client) GetTrades(market string, p TradesParams) ([]orderbook.Trade, error) {
+	q := url.Values{}
+	if !p.Since.IsZero() {
+		q.Set("since", strconv.FormatInt(p.Since.UnixMilli(), 10))
+	}
+	if !p.Until.IsZero() {
+		q.Set("until", strconv.FormatInt(p.Until.UnixMilli(), 10))
+	}
+	if p.FromID != 0 {
+		q.Set("fromId", strconv.FormatInt(p.FromID, 10))
+	}
+	if p.Limit != 0 {
+		q.Set("limit", strconv.Itoa(p.Limit))
+	}
+
+	e := fmt.Sprintf("%s/trades/%s?%s", c.Endpoint, market, q.Encode())
 	req, err := http.NewRequest(http.MethodGet, e, nil)
 	if err != nil {
 		return nil, err
@@ -42,23 +187,70 @@ func (c *Client) GetTrades(market string) ([]*orderbook.Trade, error) {
 		return nil, err
 	}
 
-	trades := []*orderbook.Trade{}
+	trades := []orderbook.Trade{}
 
-	if err := json.NewDecoder(resp.Body).Decode(&trades); err != nil {
+	if err := decodeResponse(resp, &trades); err != nil {
 		return nil, err
 	}
 
 	return trades, nil
 }
 
+// CandlesParams selects the candles of a market, Interval is required.
+type CandlesParams struct {
+	Interval server.CandleInterval
+	Since    time.Time
+	Until    time.Time
+	Limit    int
+}
+
+// GetCandles returns candles of a market oldest first, the latest ones
+// unless Since is set.
+func (c *Client) GetCandles(market string, p CandlesParams) ([]server.Candle, error) {
+	q := url.Values{}
+	q.Set("interval", string(p.Interval))
+	if !p.Since.IsZero() {
+		q.Set("since", strconv.FormatInt(p.Since.UnixMilli(), 10))
+	}
+	if !p.Until.IsZero() {
+		q.Set("until", strconv.FormatInt(p.Until.UnixMilli(), 10))
+	}
+	if p.Limit != 0 {
+		q.Set("limit", strconv.Itoa(p.Limit))
+	}
+
+	e := fmt.Sprintf("%s/candles/%s?%s", c.Endpoint, market, q.Encode())
+	req, err := http.NewRequest(http.MethodGet, e, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	candles := []server.Candle{}
+
+	if err := decodeResponse(resp, &candles); err != nil {
+		return nil, err
+	}
+
+	return candles, nil
+}
+
 func (c *Client) GetOrders(userID int64) (*server.GetOrderResponse, error) {
-	e := fmt.Sprintf("%s/order/%d", Endpoint, userID)
+	e := fmt.Sprintf("%s/order/%d", c.Endpoint, userID)
 
 	req, err := http.NewRequest(http.MethodGet, e, nil)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := c.sign(req, nil); err != nil {
+		return nil, err
+	}
+
 	resp, err := c.Do(req)
 	if err != nil {
 		return nil, err
@@ -66,21 +258,109 @@ func (c *Client) GetOrders(userID int64) (*server.GetOrderResponse, error) {
 
 	orders := server.GetOrderResponse{}
 
-	if err := json.NewDecoder(resp.Body).Decode(&orders); err != nil {
+	if err := decodeResponse(resp, &orders); err != nil {
 		return nil, err
 	}
 
 	return &orders, nil
 }
 
+// FillsParams filters the fills history, zero values do not filter.
+type FillsParams struct {
+	Market server.Market
+	Since  time.Time
+	Until  time.Time
+	// Cursor is the NextCursor of the previous page.
+	Cursor int64
+	Limit  int
+}
+
+// GetFills returns a page of the fills of the client's user, newest
+// first.
+func (c *Client) GetFills(p FillsParams) (*server.FillsResponse, error) {
+	q := url.Values{}
+	if p.Market != "" {
+		q.Set("market", string(p.Market))
+	}
+	if !p.Since.IsZero() {
+		q.Set("since", strconv.FormatInt(p.Since.UnixMilli(), 10))
+	}
+	if !p.Until.IsZero() {
+		q.Set("until", strconv.FormatInt(p.Until.UnixMilli(), 10))
+	}
+	if p.Cursor != 0 {
+		q.Set("cursor", strconv.FormatInt(p.Cursor, 10))
+	}
+	if p.Limit != 0 {
+		q.Set("limit", strconv.Itoa(p.Limit))
+	}
+
+	e := c.Endpoint + "/fills?" + q.Encode()
+	req, err := http.NewRequest(http.MethodGet, e, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.sign(req, nil); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	fills := &server.FillsResponse{}
+	if err := decodeResponse(resp, fills); err != nil {
+		return nil, err
+	}
+
+	return fills, nil
+}
+
+// GetOrder returns the full status of an order, open or not.
+func (c *Client) GetOrder(orderID int64) (*server.OrderStatusResponse, error) {
+	e := fmt.Sprintf("%s/orders/%d", c.Endpoint, orderID)
+
+	req, err := http.NewRequest(http.MethodGet, e, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.sign(req, nil); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &server.OrderStatusResponse{}
+	if err := decodeResponse(resp, status); err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
+
 func (c *Client) PlaceMArketOrder(p *PlaceOrderParams) (*server.PlaceOrderResponse, error) {
+	clientOrderID, err := p.clientOrderID()
+	if err != nil {
+		return nil, err
+	}
 	params := &server.PlaceOrderRequest{
-		UserID: p.UserID,
-		Type:   server.MarketOrder,
-		Bid:    p.Bid,
-		Size:   p.Size,
-		Price:  p.Price,
-		Market: server.MarketEth,
+		UserID:        p.UserID,
+		ClientOrderID: clientOrderID,
+		Type:          server.MarketOrder,
+		Bid:           p.Bid,
+		Size:          p.Size,
+		Notional:      p.Notional,
+		Price:         p.Price,
+		Market:        server.MarketEth,
+	}
+	if err := c.signOrder(params); err != nil {
+		return nil, err
 	}
 
 	body, err := json.Marshal(params)
@@ -88,12 +368,16 @@ func (c *Client) PlaceMArketOrder(p *PlaceOrderParams) (*server.PlaceOrderRespon
 		return nil, err
 	}
 
-	e := Endpoint + "/order"
+	e := c.Endpoint + "/order"
 	req, err := http.NewRequest(http.MethodPost, e, bytes.NewReader(body))
 	if err != nil {
 		return nil, err
 	}
 
+	if err := c.sign(req, body); err != nil {
+		return nil, err
+	}
+
 	resp, err := c.Do(req)
 	if err != nil {
 		return nil, err
@@ -101,82 +385,202 @@ func (c *Client) PlaceMArketOrder(p *PlaceOrderParams) (*server.PlaceOrderRespon
 
 	placeOrderResponse := &server.PlaceOrderResponse{}
 
-	if err := json.NewDecoder(resp.Body).Decode(placeOrderResponse); err != nil {
+	if err := decodeResponse(resp, placeOrderResponse); err != nil {
 		return nil, err
 	}
 
 	return placeOrderResponse, nil
 }
 
-func (c *Client) GetBestAsk() (float64, error) {
-	e := fmt.Sprintf("%s/book/ETH/ask", Endpoint)
+func (c *Client) GetTicker(market string) (*server.Ticker, error) {
+	e := fmt.Sprintf("%s/ticker/%s", c.Endpoint, market)
 	req, err := http.NewRequest(http.MethodGet, e, nil)
 	if err != nil {
-		return 0, nil
+		return nil, err
 	}
 
 	resp, err := c.Do(req)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	priceResp := &server.PriceResponse{}
+	ticker := &server.Ticker{}
 
-	if err := json.NewDecoder(resp.Body).Decode(priceResp); err != nil {
+	if err := decodeResponse(resp, ticker); err != nil {
+		return nil, err
+	}
+
+	return ticker, nil
+}
+
+func (c *Client) GetBestAsk() (float64, error) {
+	ticker, err := c.GetTicker(string(server.MarketEth))
+	if err != nil {
 		return 0, err
 	}
+	if ticker.BestAsk == nil {
+		return 0, fmt.Errorf("the asks are empty")
+	}
 
-	return priceResp.Price, err
+	return ticker.BestAsk.Price, nil
 }
 
 func (c *Client) GetBestBid() (float64, error) {
-	e := fmt.Sprintf("%s/book/ETH/bid", Endpoint)
+	ticker, err := c.GetTicker(string(server.MarketEth))
+	if err != nil {
+		return 0, err
+	}
+	if ticker.BestBid == nil {
+		return 0, fmt.Errorf("the bids are empty")
+	}
+
+	return ticker.BestBid.Price, nil
+}
+
+// GetOrderByClientID returns the full status of an order by the client
+// order ID it was placed with.
+func (c *Client) GetOrderByClientID(clientOrderID string) (*server.OrderStatusResponse, error) {
+	e := fmt.Sprintf("%s/orders/client/%s", c.Endpoint, url.PathEscape(clientOrderID))
+
 	req, err := http.NewRequest(http.MethodGet, e, nil)
 	if err != nil {
-		return 0, nil
+		return nil, err
+	}
+
+	if err := c.sign(req, nil); err != nil {
+		return nil, err
 	}
 
 	resp, err := c.Do(req)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	priceResp := &server.PriceResponse{}
+	status := &server.OrderStatusResponse{}
+	if err := decodeResponse(resp, status); err != nil {
+		return nil, err
+	}
 
-	if err := json.NewDecoder(resp.Body).Decode(priceResp); err != nil {
-		return 0, err
+	return status, nil
+}
+
+// CancelOrderByClientID cancels an order by the client order ID it was
+// placed with.
+func (c *Client) CancelOrderByClientID(clientOrderID string) error {
+	e := fmt.Sprintf("%s/order/client/%s", c.Endpoint, url.PathEscape(clientOrderID))
+
+	req, err := http.NewRequest(http.MethodDelete, e, nil)
+	if err != nil {
+		return err
+	}
+	if err := c.sign(req, nil); err != nil {
+		return err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
 	}
 
-	return priceResp.Price, err
+	return decodeResponse(resp, nil)
 }
 
 func (c *Client) CancelOrder(orderID int64) error {
-	e := fmt.Sprintf("%s/order/%d", Endpoint, orderID)
+	e := fmt.Sprintf("%s/order/%d", c.Endpoint, orderID)
 
 	req, err := http.NewRequest(http.MethodDelete, e, nil)
 	if err != nil {
 		return err
 	}
+	if err := c.sign(req, nil); err != nil {
+		return err
+	}
+
 	resp, err := c.Do(req)
 	if err != nil {
 		return err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to delete order :%d", orderID)
+	return decodeResponse(resp, nil)
+}
+
+// CancelOrders pulls every resting order of the client's user on the ETH
+// market. side is "bid", "ask" or empty for both sides.
+func (c *Client) CancelOrders(side string) (*server.CancelOrdersResponse, error) {
+	e := fmt.Sprintf("%s/orders?market=%s&side=%s", c.Endpoint, server.MarketEth, side)
+
+	req, err := http.NewRequest(http.MethodDelete, e, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.sign(req, nil); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	cancelResp := &server.CancelOrdersResponse{}
+	if err := decodeResponse(resp, cancelResp); err != nil {
+		return nil, err
+	}
+
+	return cancelResp, nil
+}
+
+// Heartbeat arms the dead man's switch for timeout, a zero timeout
+// disarms it.
+func (c *Client) Heartbeat(timeout time.Duration) (*server.HeartbeatResponse, error) {
+	params := &server.HeartbeatRequest{
+		TimeoutMillis: timeout.Milliseconds(),
+	}
+
+	body, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+
+	e := c.Endpoint + "/heartbeat"
+	req, err := http.NewRequest(http.MethodPost, e, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.sign(req, body); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	heartbeatResp := &server.HeartbeatResponse{}
+	if err := decodeResponse(resp, heartbeatResp); err != nil {
+		return nil, err
+	}
+
+	return heartbeatResp, nil
 }
 
 func (c *Client) PlaceLimitOrder(p *PlaceOrderParams) (*server.PlaceOrderResponse, error) {
+	clientOrderID, err := p.clientOrderID()
+	if err != nil {
+		return nil, err
+	}
 	params := &server.PlaceOrderRequest{
-		UserID: p.UserID,
-		Type:   server.LimitOrder,
-		Bid:    p.Bid,
-		Size:   p.Size,
-		Price:  p.Price,
-		Market: server.MarketEth,
+		UserID:        p.UserID,
+		ClientOrderID: clientOrderID,
+		Type:          server.LimitOrder,
+		Bid:           p.Bid,
+		Size:          p.Size,
+		Price:         p.Price,
+		Market:        server.MarketEth,
+	}
+	if err := c.signOrder(params); err != nil {
+		return nil, err
 	}
 
 	body, err := json.Marshal(params)
@@ -184,12 +588,16 @@ func (c *Client) PlaceLimitOrder(p *PlaceOrderParams) (*server.PlaceOrderRespons
 		return nil, err
 	}
 
-	e := Endpoint + "/order"
+	e := c.Endpoint + "/order"
 	req, err := http.NewRequest(http.MethodPost, e, bytes.NewReader(body))
 	if err != nil {
 		return nil, err
 	}
 
+	if err := c.sign(req, body); err != nil {
+		return nil, err
+	}
+
 	resp, err := c.Do(req)
 	if err != nil {
 		return nil, err
@@ -197,7 +605,7 @@ func (c *Client) PlaceLimitOrder(p *PlaceOrderParams) (*server.PlaceOrderRespons
 
 	placeOrderResponse := &server.PlaceOrderResponse{}
 
-	if err := json.NewDecoder(resp.Body).Decode(placeOrderResponse); err != nil {
+	if err := decodeResponse(resp, placeOrderResponse); err != nil {
 		return nil, err
 	}
 
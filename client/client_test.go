@@ -0,0 +1,51 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/Baazaouihamza/crypto-exchange/server"
+)
+
+func assert(t *testing.T, a, b any) {
+	t.Helper()
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+func TestPlaceOrderReusedParams(t *testing.T) {
+	var placed []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req server.PlaceOrderRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		placed = append(placed, req.ClientOrderID)
+		json.NewEncoder(w).Encode(server.PlaceOrderResponse{OrderID: int64(len(placed)), ClientOrderID: req.ClientOrderID})
+	}))
+	defer srv.Close()
+
+	c := NewClient("key-1", "secret-1")
+	c.Endpoint = srv.URL
+
+	// params reused in a loop place an order each
+	params := &PlaceOrderParams{Size: 1, Price: 10_000}
+	for i := 0; i < 2; i++ {
+		resp, err := c.PlaceLimitOrder(params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert(t, resp.ClientOrderID, placed[i])
+	}
+	assert(t, len(placed[0]) > 0, true)
+	assert(t, placed[0] != placed[1], true)
+	assert(t, params.ClientOrderID, "")
+
+	// an ID set by the caller is kept for retries
+	params.ClientOrderID = "retry-1"
+	c.PlaceMArketOrder(params)
+	c.PlaceMArketOrder(params)
+	assert(t, placed[2:], []string{"retry-1", "retry-1"})
+}
@@ -0,0 +1,40 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/Baazaouihamza/crypto-exchange/server"
+)
+
+// decodeResponse decodes a 2xx response into v, v may be nil. Any other
+// status is returned as a *server.APIError.
+func decodeResponse(resp *http.Response, v any) error {
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		apiErr := &server.APIError{}
+		if err := json.NewDecoder(resp.Body).Decode(apiErr); err != nil || apiErr.Code == "" {
+			// not the exchange answering, a proxy maybe
+			apiErr.Code = server.ErrCodeInternal
+			apiErr.Message = resp.Status
+		}
+		apiErr.Status = resp.StatusCode
+
+		return apiErr
+	}
+
+	if v == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// IsErrorCode reports whether err is an error of the exchange with the
+// given code.
+func IsErrorCode(err error, code server.ErrorCode) bool {
+	var apiErr *server.APIError
+	return errors.As(err, &apiErr) && apiErr.Code == code
+}
@@ -0,0 +1,36 @@
+package client
+
+import (
+	"github.com/Baazaouihamza/crypto-exchange/rpc"
+	"github.com/Baazaouihamza/crypto-exchange/server"
+	"google.golang.org/grpc"
+)
+
+// DefaultRPCEndpoint is where the gRPC API of a local exchange listens.
+const DefaultRPCEndpoint = "localhost:3001"
+
+// RPCClient calls the gRPC API of the exchange as the user bound to an
+// API key.
+type RPCClient struct {
+	rpc.ExchangeClient
+	conn *grpc.ClientConn
+}
+
+// NewRPCClient connects to target and signs every call with apiKey. opts
+// must carry the transport credentials.
+func NewRPCClient(target, apiKey, secret string, opts ...grpc.DialOption) (*RPCClient, error) {
+	opts = append(opts, grpc.WithChainUnaryInterceptor(server.SignRPC(apiKey, secret)))
+	conn, err := grpc.NewClient(target, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RPCClient{
+		ExchangeClient: rpc.NewExchangeClient(conn),
+		conn:           conn,
+	}, nil
+}
+
+func (c *RPCClient) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,113 @@
+package client
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/Baazaouihamza/crypto-exchange/server"
+	"github.com/gorilla/websocket"
+)
+
+// StreamMessage mirrors server.StreamMessage but leaves Data undecoded so
+// callers can unmarshal it into the type matching Channel.
+type StreamMessage struct {
+	Type    string
+	Channel string
+	Market  server.Market
+	Seq     uint64
+	Error   string
+	Data    json.RawMessage
+}
+
+type Stream struct {
+	conn   *websocket.Conn
+	apiKey string
+	secret string
+}
+
+// Stream opens a websocket to the exchange. Pings from the server are
+// answered automatically as long as Read is being called.
+func (c *Client) Stream() (*Stream, error) {
+	e := "ws" + strings.TrimPrefix(c.Endpoint, "http") + "/ws"
+
+	conn, _, err := websocket.DefaultDialer.Dial(e, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Stream{
+		conn:   conn,
+		apiKey: c.apiKey,
+		secret: c.secret,
+	}, nil
+}
+
+// Auth binds the stream to the user of the client's API key so private
+// channels can be subscribed.
+func (s *Stream) Auth() error {
+	nonce, err := newNonce()
+	if err != nil {
+		return err
+	}
+	timestamp := time.Now().UnixMilli()
+
+	return s.conn.WriteJSON(server.StreamRequest{
+		Op:        server.OpAuth,
+		APIKey:    s.apiKey,
+		Timestamp: timestamp,
+		Nonce:     nonce,
+		Signature: server.Sign(s.secret, timestamp, nonce, server.StreamAuthMethod, server.StreamAuthPath, nil),
+	})
+}
+
+// Subscribe to a channel, market is ignored for the private channels.
+func (s *Stream) Subscribe(channel string, market server.Market) error {
+	return s.conn.WriteJSON(server.StreamRequest{
+		Op:      server.OpSubscribe,
+		Channel: channel,
+		Market:  market,
+	})
+}
+
+func (s *Stream) Unsubscribe(channel string, market server.Market) error {
+	return s.conn.WriteJSON(server.StreamRequest{
+		Op:      server.OpUnsubscribe,
+		Channel: channel,
+		Market:  market,
+	})
+}
+
+// SubscribeCandles streams the candles of an interval of the market as
+// they change.
+func (s *Stream) SubscribeCandles(market server.Market, interval server.CandleInterval) error {
+	return s.conn.WriteJSON(server.StreamRequest{
+		Op:       server.OpSubscribe,
+		Channel:  server.ChannelCandles,
+		Market:   market,
+		Interval: interval,
+	})
+}
+
+func (s *Stream) UnsubscribeCandles(market server.Market, interval server.CandleInterval) error {
+	return s.conn.WriteJSON(server.StreamRequest{
+		Op:       server.OpUnsubscribe,
+		Channel:  server.ChannelCandles,
+		Market:   market,
+		Interval: interval,
+	})
+}
+
+// Read blocks until the next message arrives.
+func (s *Stream) Read() (*StreamMessage, error) {
+	msg := &StreamMessage{}
+	if err := s.conn.ReadJSON(msg); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+func (s *Stream) Close() error {
+	return s.conn.Close()
+}
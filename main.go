@@ -1,13 +1,15 @@
 package main
 
 import (
-	"fmt"
-	"log"
+	"log/slog"
 	"math"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/Baazaouihamza/crypto-exchange/client"
 	"github.com/Baazaouihamza/crypto-exchange/server"
+	"github.com/ethereum/go-ethereum/crypto"
 )
 
 const (
@@ -18,18 +20,18 @@ var (
 	tick = 2 * time.Second
 )
 
-func marketOrderPlacer(c *client.Client) {
+func marketOrderPlacer(c, john *client.Client) {
 	ticker := time.NewTicker(5 * time.Second)
 
 	for {
 
-		trades, err := c.GetTrades("ETH")
+		trades, err := c.GetTrades("ETH", client.TradesParams{Limit: 1})
 		if err != nil {
-			panic(err)
+			slog.Error("getting trades", "error", err)
 		}
 
 		if len(trades) > 0 {
-			fmt.Printf("exchange price => %.2f\n", trades[len(trades)-1].Price)
+			slog.Info("exchange price", "price", trades[len(trades)-1].Price)
 		}
 
 		otherMarketSellOrder := &client.PlaceOrderParams{
@@ -37,9 +39,9 @@ func marketOrderPlacer(c *client.Client) {
 			Bid:    false,
 			Size:   1000,
 		}
-		askOrderResp, err := c.PlaceMArketOrder(otherMarketSellOrder)
+		_, err = c.PlaceMArketOrder(otherMarketSellOrder)
 		if err != nil {
-			log.Println(askOrderResp.OrderID)
+			slog.Error("placing market order", "user_id", otherMarketSellOrder.UserID, "error", err)
 		}
 
 		marketSellOrder := &client.PlaceOrderParams{
@@ -47,9 +49,9 @@ func marketOrderPlacer(c *client.Client) {
 			Bid:    false,
 			Size:   100,
 		}
-		askOrderResp, err = c.PlaceMArketOrder(marketSellOrder)
+		_, err = john.PlaceMArketOrder(marketSellOrder)
 		if err != nil {
-			log.Println(askOrderResp.OrderID)
+			slog.Error("placing market order", "user_id", marketSellOrder.UserID, "error", err)
 		}
 
 		marketBuyOrder := &client.PlaceOrderParams{
@@ -57,9 +59,9 @@ func marketOrderPlacer(c *client.Client) {
 			Bid:    true,
 			Size:   100,
 		}
-		bidOrderResp, err := c.PlaceMArketOrder(marketBuyOrder)
+		_, err = john.PlaceMArketOrder(marketBuyOrder)
 		if err != nil {
-			log.Println(bidOrderResp.OrderID)
+			slog.Error("placing market order", "user_id", marketBuyOrder.UserID, "error", err)
 		}
 		<-ticker.C
 	}
@@ -73,21 +75,24 @@ func makeMarketSimple(c *client.Client) {
 	for {
 		orders, err := c.GetOrders(userID)
 		if err != nil {
-			log.Println(err)
+			// the exchange may be shutting down
+			slog.Error("getting orders", "user_id", userID, "error", err)
+			<-ticker.C
+			continue
 		}
 
 		bestAsk, err := c.GetBestAsk()
 		if err != nil {
-			log.Println(err)
+			slog.Error("getting best ask", "error", err)
 		}
 
 		bestbid, err := c.GetBestBid()
 		if err != nil {
-			log.Println(err)
+			slog.Error("getting best bid", "error", err)
 		}
 
 		spread := math.Abs(bestbid - bestAsk)
-		fmt.Println("exchange spread", spread)
+		slog.Info("exchange spread", "spread", spread, "best_ask", bestAsk, "best_bid", bestbid)
 		// place the bid
 		if len(orders.Bids) < 3 {
 			bidLimit := &client.PlaceOrderParams{
@@ -96,9 +101,9 @@ func makeMarketSimple(c *client.Client) {
 				Price:  bestbid + 100,
 				Size:   1000,
 			}
-			bidOrderResp, err := c.PlaceLimitOrder(bidLimit)
+			_, err := c.PlaceLimitOrder(bidLimit)
 			if err != nil {
-				log.Println(bidOrderResp.OrderID)
+				slog.Error("placing limit order", "user_id", bidLimit.UserID, "error", err)
 			}
 
 		}
@@ -110,16 +115,13 @@ func makeMarketSimple(c *client.Client) {
 				Price:  bestAsk - 100,
 				Size:   1000,
 			}
-			askOrderResp, err := c.PlaceLimitOrder(askLimit)
+			_, err := c.PlaceLimitOrder(askLimit)
 			if err != nil {
-				log.Println(askOrderResp.OrderID)
+				slog.Error("placing limit order", "user_id", askLimit.UserID, "error", err)
 			}
 
 		}
 
-		fmt.Println("best ask price", bestAsk)
-		fmt.Println("best bid price", bestbid)
-
 		<-ticker.C
 	}
 }
@@ -153,20 +155,65 @@ func seedMarket(c *client.Client) error {
 
 }
 
+// newClient returns a client of a user of the config, signing orders
+// with the account key of that user.
+func newClient(cfg *server.Config, userID int64) *client.Client {
+	for _, user := range cfg.Users {
+		if user.ID != userID || len(user.APIKeys) == 0 {
+			continue
+		}
+		pk, err := crypto.HexToECDSA(user.PrivateKey)
+		if err != nil {
+			panic(err)
+		}
+
+		c := client.NewClient(user.APIKeys[0].Key, user.APIKeys[0].Secret)
+		c.ChainID = cfg.ChainID
+		if strings.HasPrefix(cfg.ListenAddr, ":") {
+			c.Endpoint = "http://localhost" + cfg.ListenAddr
+		} else {
+			c.Endpoint = "http://" + cfg.ListenAddr
+		}
+		c.SignOrdersWith(pk)
+
+		return c
+	}
+
+	slog.Error("user has no API key in the config", "user_id", userID)
+	os.Exit(1)
+	return nil
+}
+
 func main() {
-	go server.StartServer()
+	cfg, err := server.LoadConfig(os.Args[1:])
+	if err != nil {
+		slog.Error("loading config", "error", err)
+		os.Exit(1)
+	}
+	slog.SetDefault(cfg.NewLogger(os.Stderr))
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- server.StartServer(cfg)
+	}()
 
 	time.Sleep(1 * time.Second)
 
-	c := client.NewClient()
+	seeder := newClient(cfg, 8)
+	maker := newClient(cfg, 7)
+	john := newClient(cfg, 666)
 
-	if err := seedMarket(c); err != nil {
+	if err := seedMarket(seeder); err != nil {
 		panic(err)
 	}
 
-	go makeMarketSimple(c)
+	go makeMarketSimple(maker)
 	time.Sleep(1 * time.Second)
-	marketOrderPlacer(c)
+	go marketOrderPlacer(seeder, john)
 
-	select {}
+	// the server returns once it shut down on SIGINT or SIGTERM
+	if err := <-errc; err != nil {
+		slog.Error("exchange stopped", "error", err)
+		os.Exit(1)
+	}
 }
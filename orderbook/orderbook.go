@@ -2,13 +2,14 @@ package orderbook
 
 import (
 	"fmt"
-	"math/rand"
 	"sort"
 	"sync"
 	"time"
 )
 
 type Trade struct {
+	// ID numbers the trades of a book, it grows with every trade.
+	ID        int64
 	Price     float64
 	Size      float64
 	Bid       bool
@@ -22,13 +23,35 @@ type Match struct {
 	Price      float64
 }
 
+// MatchTotals returns the base size filled and the quote notional
+// exchanged across matches.
+func MatchTotals(matches []Match) (base, quote float64) {
+	for _, match := range matches {
+		base += match.SizeFilled
+		quote += match.SizeFilled * match.Price
+	}
+
+	return base, quote
+}
+
 type Order struct {
-	ID        int64
-	UserID    int64
-	Size      float64
+	ID     int64
+	UserID int64
+	// Size is the remaining size, OriginalSize what the order was placed with.
+	Size         float64
+	OriginalSize float64
+	FilledSize   float64
+	AvgFillPrice float64
+	// Notional is the remaining quote amount of a market order placed
+	// in quote currency, zero for orders placed in base size.
+	Notional float64
+	// Price is the limit price, zero for market orders.
+	Price     float64
 	Bid       bool
 	Limit     *Limit
 	Timestamp int64
+	Status    OrderStatus
+	Reason    Reason
 }
 
 type Orders []*Order
@@ -39,14 +62,25 @@ func (o Orders) Less(i, j int) bool { return o[i].Timestamp < o[j].Timestamp }
 
 func NewOrder(bid bool, size float64, userID int64) *Order {
 	return &Order{
-		ID:        int64(rand.Intn(10000000)),
-		UserID:    userID,
-		Size:      size,
-		Bid:       bid,
-		Timestamp: time.Now().UnixNano(),
+		ID:           nextOrderID(),
+		UserID:       userID,
+		Size:         size,
+		OriginalSize: size,
+		Bid:          bid,
+		Timestamp:    time.Now().UnixNano(),
+		Status:       StatusNew,
 	}
 }
 
+// NewNotionalOrder creates a market order for a quote amount, e.g. buy
+// 5,000 USD worth of ETH.
+func NewNotionalOrder(bid bool, notional float64, userID int64) *Order {
+	o := NewOrder(bid, 0, userID)
+	o.Notional = notional
+
+	return o
+}
+
 func (o *Order) String() string {
 	return fmt.Sprintf("[size: %.2f]", o.Size)
 }
@@ -160,6 +194,9 @@ func (l *Limit) FillOrder(a, b *Order) Match {
 		a.Size = 0.0
 	}
 
+	a.recordFill(sizeFilled, l.Price)
+	b.recordFill(sizeFilled, l.Price)
+
 	return Match{
 		Bid:        bid,
 		Ask:        ask,
@@ -174,7 +211,10 @@ type Orderbook struct {
 	asks []*Limit
 	bids []*Limit
 
+	// Trades holds the trades made since the last TakeTrades.
 	Trades []*Trade
+	// tradeSeq is the ID of the last trade.
+	tradeSeq int64
 
 	mu        sync.RWMutex
 	AskLimits map[float64]*Limit
@@ -193,30 +233,28 @@ func NewOrderbook() *Orderbook {
 	}
 }
 
-func (ob *Orderbook) PlaceMarketOrder(o *Order) []Match {
+// PlaceMarketOrder matches o against the opposite side of the book, by
+// quote amount when o.Notional is set. An order the book cannot fill is
+// rejected.
+func (ob *Orderbook) PlaceMarketOrder(o *Order) ([]Match, error) {
 	matches := []Match{}
 
+	if err := ob.checkLiquidity(o); err != nil {
+		o.Reject(ReasonInsufficientLiquidity)
+		return nil, err
+	}
+
 	if o.Bid {
-		if o.Size > ob.AskTotalVolume() {
-			panic(fmt.Errorf("not enough volume [size: %.2f] for market order [size: %2.f]",
-				ob.AskTotalVolume(),
-				o.Size))
-		}
 		for _, limit := range ob.Asks() {
-			limitMatches := limit.Fill(o)
+			limitMatches := ob.fill(limit, o)
 			matches = append(matches, limitMatches...)
 			if len(limit.Orders) == 0 {
 				ob.clearLimit(false, limit)
 			}
 		}
 	} else {
-		if o.Size > ob.BidTotalVolume() {
-			panic(fmt.Errorf("not enough volume [size: %.2f] for market order [size: %2.f]",
-				ob.BidTotalVolume(),
-				o.Size))
-		}
 		for _, limit := range ob.Bids() {
-			limitMatches := limit.Fill(o)
+			limitMatches := ob.fill(limit, o)
 			matches = append(matches, limitMatches...)
 
 			if len(limit.Orders) == 0 {
@@ -226,7 +264,19 @@ func (ob *Orderbook) PlaceMarketOrder(o *Order) []Match {
 	}
 
 	for _, match := range matches {
+		// the resting order got removed from its limit once filled,
+		// drop it from the index as well
+		resting := match.Bid
+		if o.Bid {
+			resting = match.Ask
+		}
+		if resting.IsFilled() {
+			delete(ob.Orders, resting.ID)
+		}
+
+		ob.tradeSeq++
 		trade := &Trade{
+			ID:        ob.tradeSeq,
 			Price:     match.Price,
 			Size:      match.SizeFilled,
 			TimeStamp: time.Now().UnixNano(),
@@ -236,6 +286,40 @@ func (ob *Orderbook) PlaceMarketOrder(o *Order) []Match {
 		ob.Trades = append(ob.Trades, trade)
 	}
 
+	return matches, nil
+}
+
+// checkLiquidity fails when the opposite side cannot fill o.
+func (ob *Orderbook) checkLiquidity(o *Order) error {
+	volume, notional := ob.BidTotalVolume(), ob.BidTotalNotional()
+	if o.Bid {
+		volume, notional = ob.AskTotalVolume(), ob.AskTotalNotional()
+	}
+
+	if o.Notional > 0 && o.Notional > notional {
+		return fmt.Errorf("not enough notional [%.2f] for market order [notional: %.2f]", notional, o.Notional)
+	}
+	if o.Size > volume {
+		return fmt.Errorf("not enough volume [size: %.2f] for market order [size: %.2f]", volume, o.Size)
+	}
+
+	return nil
+}
+
+// fill matches o against a single limit.
+func (ob *Orderbook) fill(limit *Limit, o *Order) []Match {
+	if o.Notional == 0 {
+		return limit.Fill(o)
+	}
+
+	o.Size = o.Notional / limit.Price
+	if volumeEqual(o.Size, limit.TotalVolume) {
+		// do not leave dust behind because of rounding
+		o.Size = limit.TotalVolume
+	}
+	matches := limit.Fill(o)
+	o.Notional = o.Size * limit.Price
+
 	return matches
 }
 
@@ -261,6 +345,7 @@ func (ob *Orderbook) PlaceLimitOrder(price float64, o *Order) {
 			ob.AskLimits[price] = limit
 		}
 	}
+	o.Price = price
 	ob.Orders[o.ID] = o
 	limit.AddOrder(o)
 }
@@ -287,6 +372,23 @@ func (ob *Orderbook) clearLimit(bid bool, l *Limit) {
 }
 
 func (ob *Orderbook) CancelOrder(o *Order) {
+	ob.CancelOrderWithReason(o, ReasonCancelledByUser)
+}
+
+// CancelOrderWithReason pulls a resting order from the book as cancelled
+// for reason.
+func (ob *Orderbook) CancelOrderWithReason(o *Order, reason Reason) {
+	ob.removeOrder(o, StatusCancelled, reason)
+}
+
+// ExpireOrder pulls a resting order from the book as expired.
+func (ob *Orderbook) ExpireOrder(o *Order) {
+	ob.removeOrder(o, StatusExpired, ReasonNone)
+}
+
+func (ob *Orderbook) removeOrder(o *Order, status OrderStatus, reason Reason) {
+	o.mustTransition(status, reason)
+
 	limit := o.Limit
 	limit.DeleteOrder(o)
 	delete(ob.Orders, o.ID)
@@ -296,6 +398,56 @@ func (ob *Orderbook) CancelOrder(o *Order) {
 	}
 }
 
+// CancelledOrder describes what was left of an order when it got cancelled.
+type CancelledOrder struct {
+	ID     int64
+	UserID int64
+	Bid    bool
+	Price  float64
+	// Size is the remaining quantity that was pulled from the book.
+	Size float64
+}
+
+// CancelOrders cancels every resting order for which filter returns true
+// and returns them ordered by ID.
+func (ob *Orderbook) CancelOrders(filter func(o *Order) bool, reason Reason) []CancelledOrder {
+	toCancel := Orders{}
+	for _, o := range ob.Orders {
+		if filter(o) {
+			toCancel = append(toCancel, o)
+		}
+	}
+	sort.Slice(toCancel, func(i, j int) bool { return toCancel[i].ID < toCancel[j].ID })
+
+	cancelled := make([]CancelledOrder, 0, len(toCancel))
+	for _, o := range toCancel {
+		cancelled = append(cancelled, CancelledOrder{
+			ID:     o.ID,
+			UserID: o.UserID,
+			Bid:    o.Bid,
+			Price:  o.Limit.Price,
+			Size:   o.Size,
+		})
+		ob.removeOrder(o, StatusCancelled, reason)
+	}
+
+	return cancelled
+}
+
+// CancelUserOrders cancels every resting order of a user.
+func (ob *Orderbook) CancelUserOrders(userID int64, reason Reason) []CancelledOrder {
+	return ob.CancelOrders(func(o *Order) bool {
+		return o.UserID == userID
+	}, reason)
+}
+
+// CancelUserSideOrders cancels the resting orders of a user on one side.
+func (ob *Orderbook) CancelUserSideOrders(userID int64, bid bool, reason Reason) []CancelledOrder {
+	return ob.CancelOrders(func(o *Order) bool {
+		return o.UserID == userID && o.Bid == bid
+	}, reason)
+}
+
 func (ob *Orderbook) BidTotalVolume() float64 {
 	totalVolume := 0.0
 
@@ -316,6 +468,28 @@ func (ob *Orderbook) AskTotalVolume() float64 {
 	return totalVolume
 }
 
+// BidTotalNotional is the quote amount needed to take out every bid.
+func (ob *Orderbook) BidTotalNotional() float64 {
+	totalNotional := 0.0
+
+	for i := 0; i < len(ob.bids); i++ {
+		totalNotional += ob.bids[i].TotalVolume * ob.bids[i].Price
+	}
+
+	return totalNotional
+}
+
+// AskTotalNotional is the quote amount needed to take out every ask.
+func (ob *Orderbook) AskTotalNotional() float64 {
+	totalNotional := 0.0
+
+	for i := 0; i < len(ob.asks); i++ {
+		totalNotional += ob.asks[i].TotalVolume * ob.asks[i].Price
+	}
+
+	return totalNotional
+}
+
 func (ob *Orderbook) Asks() []*Limit {
 	sort.Sort(ByBestAsk{ob.asks})
 	return ob.asks
@@ -325,3 +499,18 @@ func (ob *Orderbook) Bids() []*Limit {
 	sort.Sort(ByBestBid{ob.bids})
 	return ob.bids
 }
+
+// TakeTrades hands the trades made since the last call over to the
+// caller and empties the tape.
+func (ob *Orderbook) TakeTrades() []*Trade {
+	trades := ob.Trades
+	ob.Trades = []*Trade{}
+
+	return trades
+}
+
+// BumpTradeSeq makes sure the next trade ID is greater than id, used
+// when trades of the book were kept elsewhere.
+func (ob *Orderbook) BumpTradeSeq(id int64) {
+	ob.tradeSeq = max(ob.tradeSeq, id)
+}
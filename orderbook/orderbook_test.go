@@ -20,7 +20,8 @@ func TestLastMarketTrades(t *testing.T) {
 	ob.PlaceLimitOrder(price, sellOrder)
 
 	marketOrder := NewOrder(true, 10, 0)
-	matches := ob.PlaceMarketOrder(marketOrder)
+	matches, err := ob.PlaceMarketOrder(marketOrder)
+	assert(t, err, nil)
 	assert(t, len(matches), 1)
 	match := matches[0]
 
@@ -67,7 +68,8 @@ func TestPlaceMarketOrder(t *testing.T) {
 	ob.PlaceLimitOrder(10_000, sellOrder)
 
 	buyOrder := NewOrder(true, 10, 0)
-	matches := ob.PlaceMarketOrder(buyOrder)
+	matches, err := ob.PlaceMarketOrder(buyOrder)
+	assert(t, err, nil)
 
 	assert(t, len(matches), 1)
 	assert(t, len(ob.asks), 1)
@@ -97,7 +99,8 @@ func TestPlaceMarketOrderMultiFill(t *testing.T) {
 
 	sellOrder := NewOrder(false, 20, 0)
 
-	matches := ob.PlaceMarketOrder(sellOrder)
+	matches, err := ob.PlaceMarketOrder(sellOrder)
+	assert(t, err, nil)
 	assert(t, ob.BidTotalVolume(), 4.0)
 	assert(t, len(matches), 3)
 	assert(t, len(ob.bids), 1)
@@ -143,3 +146,228 @@ func TestCancelOrderBid(t *testing.T) {
 	assert(t, ok, false)
 
 }
+
+func TestSnapshotRestore(t *testing.T) {
+	ob := NewOrderbook()
+
+	sellOrderA := NewOrder(false, 10, 1)
+	sellOrderB := NewOrder(false, 5, 2)
+	buyOrder := NewOrder(true, 8, 3)
+	ob.PlaceLimitOrder(10_000, sellOrderA)
+	ob.PlaceLimitOrder(10_000, sellOrderB)
+	ob.PlaceLimitOrder(9_000, buyOrder)
+	ob.PlaceMarketOrder(NewOrder(true, 2, 4))
+
+	restored := RestoreOrderbook(ob.Snapshot())
+
+	assert(t, restored.AskTotalVolume(), 13.0)
+	assert(t, restored.BidTotalVolume(), 8.0)
+	assert(t, len(restored.Orders), 3)
+	assert(t, len(restored.Trades), 1)
+
+	// time priority must survive the restore
+	limit := restored.AskLimits[10_000]
+	assert(t, limit.Orders[0].ID, sellOrderA.ID)
+	assert(t, limit.Orders[0].Size, 8.0)
+	assert(t, limit.Orders[1].ID, sellOrderB.ID)
+	assert(t, limit.Orders[0].Limit, limit)
+
+	next := NewOrder(true, 1, 0)
+	if next.ID <= buyOrder.ID {
+		t.Errorf("order id %d not past restored id %d", next.ID, buyOrder.ID)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	ob := NewOrderbook()
+	ob.PlaceLimitOrder(10_000, NewOrder(false, 10, 0))
+	ob.PlaceLimitOrder(10_500, NewOrder(false, 10, 0))
+	ob.PlaceLimitOrder(9_000, NewOrder(true, 10, 0))
+	ob.PlaceMarketOrder(NewOrder(true, 10, 0))
+	assert(t, ob.Validate(), nil)
+
+	ob.PlaceLimitOrder(11_000, NewOrder(true, 1, 0))
+	if ob.Validate() == nil {
+		t.Error("expected crossed book to be reported")
+	}
+}
+
+// FuzzOrderbook drives random sequences of limit, market and cancel
+// operations and checks the book invariants after every step. Limit
+// orders are passive in this book, so bids are kept below the best ask
+// and asks above the best bid.
+func FuzzOrderbook(f *testing.F) {
+	f.Add([]byte{0, 10, 5, 1, 20, 7, 2, 3, 0, 3, 1})
+	f.Add([]byte{1, 1, 1, 1, 2, 1, 0, 9, 9, 2, 4, 2, 3, 0})
+
+	f.Fuzz(func(t *testing.T, ops []byte) {
+		ob := NewOrderbook()
+		placed := []*Order{}
+
+		for i := 0; i+2 < len(ops); i += 3 {
+			op, a, b := ops[i]%4, ops[i+1], ops[i+2]
+			size := float64(a%50) + 1
+			bid := b%2 == 0
+
+			switch op {
+			case 0, 1:
+				price := 1_000.0 + float64(b)
+				if bid {
+					if asks := ob.Asks(); len(asks) > 0 && price >= asks[0].Price {
+						price = asks[0].Price - 1
+					}
+				} else {
+					if bids := ob.Bids(); len(bids) > 0 && price <= bids[0].Price {
+						price = bids[0].Price + 1
+					}
+				}
+				o := NewOrder(bid, size, int64(a))
+				ob.PlaceLimitOrder(price, o)
+				placed = append(placed, o)
+			case 2:
+				available := ob.BidTotalVolume()
+				if bid {
+					available = ob.AskTotalVolume()
+				}
+				if size > available {
+					continue
+				}
+				o := NewOrder(bid, size, int64(a))
+				ob.PlaceMarketOrder(o)
+				if !o.IsFilled() {
+					t.Fatalf("market order %d left with size %.2f", o.ID, o.Size)
+				}
+			case 3:
+				if len(placed) == 0 {
+					continue
+				}
+				o := placed[int(a)%len(placed)]
+				if _, ok := ob.Orders[o.ID]; !ok {
+					continue
+				}
+				ob.CancelOrder(o)
+			}
+
+			if err := ob.Validate(); err != nil {
+				t.Fatalf("op %d: %v", i/3, err)
+			}
+		}
+	})
+}
+
+func TestPlaceMarketOrderNotional(t *testing.T) {
+	ob := NewOrderbook()
+
+	sellOrderA := NewOrder(false, 2, 0)
+	sellOrderB := NewOrder(false, 10, 0)
+	ob.PlaceLimitOrder(1_000, sellOrderA)
+	ob.PlaceLimitOrder(2_000, sellOrderB)
+
+	buyOrder := NewNotionalOrder(true, 5_000, 0)
+	matches, err := ob.PlaceMarketOrder(buyOrder)
+	assert(t, err, nil)
+
+	assert(t, len(matches), 2)
+	assert(t, matches[0].SizeFilled, 2.0)
+	assert(t, matches[1].SizeFilled, 1.5)
+	assert(t, buyOrder.IsFilled(), true)
+	assert(t, buyOrder.Notional, 0.0)
+
+	base, quote := MatchTotals(matches)
+	assert(t, base, 3.5)
+	assert(t, quote, 5_000.0)
+	assert(t, ob.AskTotalVolume(), 8.5)
+	assert(t, ob.Validate(), nil)
+}
+
+func TestPlaceMarketOrderNotionalWholeBook(t *testing.T) {
+	ob := NewOrderbook()
+	ob.PlaceLimitOrder(3_000, NewOrder(true, 0.3, 0))
+	ob.PlaceLimitOrder(2_900, NewOrder(true, 0.7, 0))
+
+	sellOrder := NewNotionalOrder(false, ob.BidTotalNotional(), 0)
+	ob.PlaceMarketOrder(sellOrder)
+
+	assert(t, sellOrder.IsFilled(), true)
+	assert(t, ob.BidTotalVolume(), 0.0)
+	assert(t, ob.Validate(), nil)
+}
+
+func TestPlaceMarketOrderInsufficientLiquidity(t *testing.T) {
+	ob := NewOrderbook()
+	ob.PlaceLimitOrder(3_000, NewOrder(false, 1, 0))
+
+	for _, o := range []*Order{NewOrder(true, 2, 1), NewNotionalOrder(true, 3_001, 1)} {
+		matches, err := ob.PlaceMarketOrder(o)
+		if err == nil {
+			t.Fatal("expected the order to be rejected")
+		}
+		assert(t, len(matches), 0)
+		assert(t, o.Status, StatusRejected)
+		assert(t, o.Reason, ReasonInsufficientLiquidity)
+	}
+	assert(t, ob.AskTotalVolume(), 1.0)
+	assert(t, ob.Validate(), nil)
+}
+
+func TestCancelUserOrders(t *testing.T) {
+	ob := NewOrderbook()
+
+	askA := NewOrder(false, 4, 1)
+	askB := NewOrder(false, 6, 1)
+	bid := NewOrder(true, 5, 1)
+	other := NewOrder(false, 3, 2)
+	ob.PlaceLimitOrder(10_000, askA)
+	ob.PlaceLimitOrder(10_100, askB)
+	ob.PlaceLimitOrder(9_000, bid)
+	ob.PlaceLimitOrder(10_000, other)
+	ob.PlaceMarketOrder(NewOrder(true, 1, 3))
+
+	cancelled := ob.CancelUserSideOrders(1, false, ReasonMassCancel)
+	assert(t, cancelled, []CancelledOrder{
+		{ID: askA.ID, UserID: 1, Bid: false, Price: 10_000, Size: 3},
+		{ID: askB.ID, UserID: 1, Bid: false, Price: 10_100, Size: 6},
+	})
+	assert(t, ob.AskTotalVolume(), 3.0)
+	assert(t, ob.BidTotalVolume(), 5.0)
+
+	cancelled = ob.CancelUserOrders(1, ReasonMassCancel)
+	assert(t, len(cancelled), 1)
+	assert(t, cancelled[0].ID, bid.ID)
+	assert(t, len(ob.Orders), 1)
+	assert(t, ob.Validate(), nil)
+}
+
+func TestOrderStatus(t *testing.T) {
+	ob := NewOrderbook()
+
+	sellOrder := NewOrder(false, 10, 0)
+	ob.PlaceLimitOrder(10_000, sellOrder)
+	assert(t, sellOrder.Status, StatusNew)
+	assert(t, sellOrder.Price, 10_000.0)
+
+	ob.PlaceMarketOrder(NewOrder(true, 4, 0))
+	assert(t, sellOrder.Status, StatusPartiallyFilled)
+	assert(t, sellOrder.OriginalSize, 10.0)
+	assert(t, sellOrder.FilledSize, 4.0)
+	assert(t, sellOrder.Size, 6.0)
+
+	ob.PlaceLimitOrder(12_000, NewOrder(false, 6, 0))
+	buyOrder := NewOrder(true, 8, 0)
+	ob.PlaceMarketOrder(buyOrder)
+	assert(t, sellOrder.Status, StatusFilled)
+	assert(t, buyOrder.Status, StatusFilled)
+	assert(t, buyOrder.AvgFillPrice, 10_500.0)
+
+	cancelled := NewOrder(true, 1, 0)
+	ob.PlaceLimitOrder(9_000, cancelled)
+	ob.CancelOrder(cancelled)
+	assert(t, cancelled.Status, StatusCancelled)
+	assert(t, cancelled.Reason, ReasonCancelledByUser)
+
+	if err := cancelled.Reject(ReasonInvalidOrder); err == nil {
+		t.Error("expected cancelled order not to be rejectable")
+	}
+	assert(t, CanTransition(StatusFilled, StatusCancelled), false)
+	assert(t, CanTransition(StatusNew, StatusRejected), true)
+}
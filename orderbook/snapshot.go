@@ -0,0 +1,151 @@
+package orderbook
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// orderSeq hands out order IDs. It is bumped past the highest restored
+// ID when an Orderbook is loaded from a Snapshot so IDs never collide.
+var orderSeq atomic.Int64
+
+func nextOrderID() int64 {
+	return orderSeq.Add(1)
+}
+
+// bumpOrderSeq makes sure the next order ID is greater than id.
+func bumpOrderSeq(id int64) {
+	for {
+		cur := orderSeq.Load()
+		if cur >= id || orderSeq.CompareAndSwap(cur, id) {
+			return
+		}
+	}
+}
+
+type OrderSnapshot struct {
+	ID           int64
+	UserID       int64
+	Size         float64
+	OriginalSize float64
+	FilledSize   float64
+	AvgFillPrice float64
+	Bid          bool
+	Timestamp    int64
+	Status       OrderStatus
+}
+
+type LimitSnapshot struct {
+	Price  float64
+	Orders []OrderSnapshot
+}
+
+// Snapshot is the serialisable state of an Orderbook. Orders inside a
+// LimitSnapshot are kept in queue order so time priority survives a restore.
+type Snapshot struct {
+	Asks []LimitSnapshot
+	Bids []LimitSnapshot
+	// Trades is the trade tape, TradeSeq the ID of the last trade.
+	Trades   []*Trade
+	TradeSeq int64
+	OrderSeq int64
+}
+
+func snapshotLimits(limits []*Limit) []LimitSnapshot {
+	sorted := make([]*Limit, len(limits))
+	copy(sorted, limits)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Price < sorted[j].Price })
+
+	snaps := make([]LimitSnapshot, 0, len(sorted))
+	for _, limit := range sorted {
+		ls := LimitSnapshot{
+			Price:  limit.Price,
+			Orders: make([]OrderSnapshot, 0, len(limit.Orders)),
+		}
+		for _, o := range limit.Orders {
+			ls.Orders = append(ls.Orders, OrderSnapshot{
+				ID:           o.ID,
+				UserID:       o.UserID,
+				Size:         o.Size,
+				OriginalSize: o.OriginalSize,
+				FilledSize:   o.FilledSize,
+				AvgFillPrice: o.AvgFillPrice,
+				Bid:          o.Bid,
+				Timestamp:    o.Timestamp,
+				Status:       o.Status,
+			})
+		}
+		snaps = append(snaps, ls)
+	}
+
+	return snaps
+}
+
+// Snapshot captures the full state of the book.
+func (ob *Orderbook) Snapshot() *Snapshot {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	trades := make([]*Trade, len(ob.Trades))
+	for i, t := range ob.Trades {
+		trade := *t
+		trades[i] = &trade
+	}
+
+	return &Snapshot{
+		Asks:     snapshotLimits(ob.asks),
+		Bids:     snapshotLimits(ob.bids),
+		Trades:   trades,
+		TradeSeq: ob.tradeSeq,
+		OrderSeq: orderSeq.Load(),
+	}
+}
+
+// RestoreOrderbook rebuilds an Orderbook from a Snapshot.
+func RestoreOrderbook(s *Snapshot) *Orderbook {
+	ob := NewOrderbook()
+
+	restore := func(limits []LimitSnapshot, bid bool) {
+		for _, ls := range limits {
+			if len(ls.Orders) == 0 {
+				continue
+			}
+			limit := NewLimit(ls.Price)
+			for _, os := range ls.Orders {
+				o := &Order{
+					ID:           os.ID,
+					UserID:       os.UserID,
+					Size:         os.Size,
+					OriginalSize: os.OriginalSize,
+					FilledSize:   os.FilledSize,
+					AvgFillPrice: os.AvgFillPrice,
+					Price:        ls.Price,
+					Bid:          bid,
+					Timestamp:    os.Timestamp,
+					Status:       os.Status,
+				}
+				limit.AddOrder(o)
+				ob.Orders[o.ID] = o
+				bumpOrderSeq(o.ID)
+			}
+			if bid {
+				ob.bids = append(ob.bids, limit)
+				ob.BidLimits[limit.Price] = limit
+			} else {
+				ob.asks = append(ob.asks, limit)
+				ob.AskLimits[limit.Price] = limit
+			}
+		}
+	}
+	restore(s.Asks, false)
+	restore(s.Bids, true)
+
+	ob.tradeSeq = s.TradeSeq
+	for _, t := range s.Trades {
+		trade := *t
+		ob.Trades = append(ob.Trades, &trade)
+	}
+	bumpOrderSeq(s.OrderSeq)
+
+	return ob
+}
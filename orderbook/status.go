@@ -0,0 +1,97 @@
+package orderbook
+
+import "fmt"
+
+type OrderStatus string
+
+const (
+	StatusNew             OrderStatus = "NEW"
+	StatusPartiallyFilled OrderStatus = "PARTIALLY_FILLED"
+	StatusFilled          OrderStatus = "FILLED"
+	StatusCancelled       OrderStatus = "CANCELLED"
+	StatusExpired         OrderStatus = "EXPIRED"
+	StatusRejected        OrderStatus = "REJECTED"
+)
+
+// Reason explains why an order got cancelled, expired or rejected.
+type Reason string
+
+const (
+	ReasonNone                  Reason = ""
+	ReasonCancelledByUser       Reason = "CANCELLED_BY_USER"
+	ReasonMassCancel            Reason = "MASS_CANCEL"
+	ReasonCancelOnDisconnect    Reason = "CANCEL_ON_DISCONNECT"
+	ReasonMarketDelisted        Reason = "MARKET_DELISTED"
+	ReasonCancelledByAdmin      Reason = "CANCELLED_BY_ADMIN"
+	ReasonUserDisabled          Reason = "USER_DISABLED"
+	ReasonInsufficientLiquidity Reason = "INSUFFICIENT_LIQUIDITY"
+	ReasonInvalidOrder          Reason = "INVALID_ORDER"
+)
+
+var transitions = map[OrderStatus][]OrderStatus{
+	StatusNew: {
+		StatusPartiallyFilled,
+		StatusFilled,
+		StatusCancelled,
+		StatusExpired,
+		StatusRejected,
+	},
+	StatusPartiallyFilled: {
+		StatusPartiallyFilled,
+		StatusFilled,
+		StatusCancelled,
+		StatusExpired,
+	},
+}
+
+// CanTransition reports whether an order may move from one status to another.
+func CanTransition(from, to OrderStatus) bool {
+	for _, status := range transitions[from] {
+		if status == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsOpen reports whether the order can still trade.
+func (s OrderStatus) IsOpen() bool {
+	return s == StatusNew || s == StatusPartiallyFilled
+}
+
+func (o *Order) transition(to OrderStatus, reason Reason) error {
+	if !CanTransition(o.Status, to) {
+		return fmt.Errorf("order %d: illegal transition %s -> %s", o.ID, o.Status, to)
+	}
+	o.Status = to
+	o.Reason = reason
+
+	return nil
+}
+
+// mustTransition is used by the matching code where an illegal transition
+// means the book itself is broken.
+func (o *Order) mustTransition(to OrderStatus, reason Reason) {
+	if err := o.transition(to, reason); err != nil {
+		panic(err)
+	}
+}
+
+// recordFill books a fill of size at price on the order.
+func (o *Order) recordFill(size, price float64) {
+	notional := o.AvgFillPrice*o.FilledSize + size*price
+	o.FilledSize += size
+	o.AvgFillPrice = notional / o.FilledSize
+
+	if o.IsFilled() {
+		o.mustTransition(StatusFilled, ReasonNone)
+	} else {
+		o.mustTransition(StatusPartiallyFilled, ReasonNone)
+	}
+}
+
+// Reject marks an order that never made it into the book.
+func (o *Order) Reject(reason Reason) error {
+	return o.transition(StatusRejected, reason)
+}
@@ -0,0 +1,96 @@
+package orderbook
+
+import (
+	"fmt"
+	"math"
+)
+
+// volumeEpsilon absorbs float rounding when comparing volumes.
+const volumeEpsilon = 1e-9
+
+func volumeEqual(a, b float64) bool {
+	return math.Abs(a-b) <= volumeEpsilon*math.Max(1, math.Max(math.Abs(a), math.Abs(b)))
+}
+
+// Validate returns the first broken invariant of the book.
+func (ob *Orderbook) Validate() error {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	seen := make(map[int64]bool)
+
+	validateSide := func(bid bool, limits []*Limit, index map[float64]*Limit) error {
+		side := "ask"
+		if bid {
+			side = "bid"
+		}
+
+		if len(limits) != len(index) {
+			return fmt.Errorf("%s side has %d limits but %d indexed", side, len(limits), len(index))
+		}
+
+		for _, limit := range limits {
+			if index[limit.Price] != limit {
+				return fmt.Errorf("%s limit %.2f is not indexed", side, limit.Price)
+			}
+			if len(limit.Orders) == 0 {
+				return fmt.Errorf("%s limit %.2f is empty", side, limit.Price)
+			}
+
+			volume := 0.0
+			for _, o := range limit.Orders {
+				if o.Limit != limit {
+					return fmt.Errorf("order %d does not point to its %s limit %.2f", o.ID, side, limit.Price)
+				}
+				if o.Bid != bid {
+					return fmt.Errorf("order %d rests on the wrong side (%s)", o.ID, side)
+				}
+				if !o.Status.IsOpen() {
+					return fmt.Errorf("order %d rests with status %s", o.ID, o.Status)
+				}
+				if o.Size <= 0 {
+					return fmt.Errorf("order %d rests with size %.2f", o.ID, o.Size)
+				}
+				if ob.Orders[o.ID] != o {
+					return fmt.Errorf("order %d on %s limit %.2f is not indexed", o.ID, side, limit.Price)
+				}
+				if seen[o.ID] {
+					return fmt.Errorf("order %d rests more than once", o.ID)
+				}
+				seen[o.ID] = true
+				volume += o.Size
+			}
+
+			if !volumeEqual(volume, limit.TotalVolume) {
+				return fmt.Errorf("%s limit %.2f total volume %f != sum of orders %f",
+					side, limit.Price, limit.TotalVolume, volume)
+			}
+		}
+
+		return nil
+	}
+
+	if err := validateSide(false, ob.asks, ob.AskLimits); err != nil {
+		return err
+	}
+	if err := validateSide(true, ob.bids, ob.BidLimits); err != nil {
+		return err
+	}
+
+	if len(seen) != len(ob.Orders) {
+		return fmt.Errorf("%d orders indexed but only %d reachable from a limit", len(ob.Orders), len(seen))
+	}
+
+	bestAsk, bestBid := math.Inf(1), math.Inf(-1)
+	for _, limit := range ob.asks {
+		bestAsk = math.Min(bestAsk, limit.Price)
+	}
+	for _, limit := range ob.bids {
+		bestBid = math.Max(bestBid, limit.Price)
+	}
+	if bestBid >= bestAsk {
+		return fmt.Errorf("book is crossed: best bid %.2f >= best ask %.2f", bestBid, bestAsk)
+	}
+
+	return nil
+}
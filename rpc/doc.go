@@ -0,0 +1,5 @@
+// Package rpc holds the gRPC API of the exchange, generated from
+// exchange.proto. The server side lives in the server package.
+package rpc
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative exchange.proto
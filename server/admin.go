@@ -0,0 +1,605 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Baazaouihamza/crypto-exchange/orderbook"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// AdminAction is what an admin did, as recorded in the audit trail.
+type AdminAction string
+
+const (
+	ActionListMarket      AdminAction = "LIST_MARKET"
+	ActionDelistMarket    AdminAction = "DELIST_MARKET"
+	ActionSetMarketStatus AdminAction = "SET_MARKET_STATUS"
+	ActionCreateUser      AdminAction = "CREATE_USER"
+	ActionDisableUser     AdminAction = "DISABLE_USER"
+	ActionEnableUser      AdminAction = "ENABLE_USER"
+	ActionCancelOrders    AdminAction = "CANCEL_ORDERS"
+	ActionAdjustBalance   AdminAction = "ADJUST_BALANCE"
+)
+
+// AuditEntry records an admin action.
+type AuditEntry struct {
+	ID int64
+	// Time is when the action was taken in unix nanoseconds.
+	Time int64
+	// Admin is the admin key the action was taken with.
+	Admin  string
+	Action AdminAction
+	// Target is the market, user or order acted on.
+	Target  string
+	Reason  string         `json:",omitempty"`
+	Details map[string]any `json:",omitempty"`
+}
+
+// auditLog keeps every admin action, oldest first.
+type auditLog struct {
+	mu      sync.RWMutex
+	entries []AuditEntry
+}
+
+func (l *auditLog) record(entry AuditEntry) AuditEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry.ID = int64(len(l.entries)) + 1
+	entry.Time = time.Now().UnixNano()
+	l.entries = append(l.entries, entry)
+
+	return entry
+}
+
+// latest returns the last limit entries, oldest first.
+func (l *auditLog) latest(limit int) []AuditEntry {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	start := max(0, len(l.entries)-limit)
+	return append([]AuditEntry{}, l.entries[start:]...)
+}
+
+func (l *auditLog) all() []AuditEntry {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return append([]AuditEntry{}, l.entries...)
+}
+
+func (l *auditLog) restore(entries []AuditEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.entries = append([]AuditEntry{}, entries...)
+}
+
+// audit records an action of the acting admin and logs it.
+func (ex *Exchange) audit(c echo.Context, action AdminAction, target, reason string, details map[string]any) AuditEntry {
+	entry := ex.auditTrail.record(AuditEntry{
+		Admin:   actingAdmin(c),
+		Action:  action,
+		Target:  target,
+		Reason:  reason,
+		Details: details,
+	})
+	requestLogger(c).Info("audit", "audit_id", entry.ID, "action", action, "target", target, "reason", reason)
+
+	return entry
+}
+
+func (ex *Exchange) registerAdminRoutes(e *echo.Echo) {
+	admin := ex.authenticateAdmin
+
+	e.GET("/admin/status", ex.handleGetStatus, admin)
+	e.GET("/admin/audit", ex.handleGetAudit, admin)
+
+	e.POST("/admin/markets", ex.handleListMarket, admin)
+	e.DELETE("/admin/markets/:market", ex.handleDelistMarket, admin)
+	e.POST("/admin/markets/:market/status", ex.handleSetMarketStatus, admin)
+
+	e.GET("/admin/users", ex.handleGetUsers, admin)
+	e.POST("/admin/users", ex.handleCreateUser, admin)
+	e.POST("/admin/users/:id/disable", ex.handleDisableUser, admin)
+	e.POST("/admin/users/:id/enable", ex.handleEnableUser, admin)
+	e.POST("/admin/users/:id/balance", ex.handleAdjustBalance, admin)
+	e.DELETE("/admin/users/:id/orders", ex.handleAdminCancelUserOrders, admin)
+	e.DELETE("/admin/orders/:id", ex.handleAdminCancelOrder, admin)
+}
+
+// AdminRequest carries the reason of an admin action, it ends up in the
+// audit trail. DELETE routes take it as the reason query parameter.
+type AdminRequest struct {
+	Reason string
+}
+
+type MarketStatusRequest struct {
+	Status MarketStatus
+	Reason string
+}
+
+// handleSetMarketStatus halts, resumes or puts a market in close only.
+// Delisting has its own route, delisted markets stay delisted.
+func (ex *Exchange) handleSetMarketStatus(c echo.Context) error {
+	market := Market(c.Param("market"))
+
+	var req MarketStatusRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return newAPIError(http.StatusBadRequest, ErrCodeBadRequest, "invalid status: %v", err)
+	}
+	switch req.Status {
+	case MarketActive, MarketHalted, MarketCloseOnly:
+	default:
+		return newAPIError(http.StatusBadRequest, ErrCodeValidation, "status must be %s, %s or %s", MarketActive, MarketHalted, MarketCloseOnly)
+	}
+
+	cfg, ok := ex.markets.config(market)
+	if !ok {
+		return newAPIError(http.StatusNotFound, ErrCodeUnknownMarket, "market %s not found", market)
+	}
+	if cfg.Status == MarketDelisted {
+		return newAPIError(http.StatusBadRequest, ErrCodeMarketNotTrading, "market %s is delisted", market)
+	}
+	if err := ex.markets.setStatus(market, req.Status); err != nil {
+		return newAPIError(http.StatusBadRequest, ErrCodeValidation, "%v", err)
+	}
+
+	ex.audit(c, ActionSetMarketStatus, string(market), req.Reason, map[string]any{
+		"From": cfg.Status,
+		"To":   req.Status,
+	})
+
+	cfg, _ = ex.markets.config(market)
+
+	return c.JSON(http.StatusOK, cfg)
+}
+
+// UserInfo describes a user to admins, keys left out.
+type UserInfo struct {
+	ID       int64
+	Address  string
+	Disabled bool
+}
+
+func (ex *Exchange) handleGetUsers(c echo.Context) error {
+	ex.usersMu.RLock()
+	users := make([]UserInfo, 0, len(ex.Users))
+	for _, user := range ex.Users {
+		users = append(users, UserInfo{
+			ID:       user.ID,
+			Address:  user.Address().Hex(),
+			Disabled: user.Disabled,
+		})
+	}
+	ex.usersMu.RUnlock()
+
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+
+	return c.JSON(http.StatusOK, users)
+}
+
+type CreateUserRequest struct {
+	// ID is assigned when zero.
+	ID int64
+	// PrivateKey is the key of the user's account, hex encoded. A new
+	// account is created when empty.
+	PrivateKey string
+	// APIKeys are bound to the user, one is generated when empty.
+	APIKeys []APIKeyConfig
+	Reason  string
+}
+
+// CreateUserResponse is the only time the API secrets are handed out.
+type CreateUserResponse struct {
+	ID      int64
+	Address string
+	APIKeys []APIKeyConfig
+}
+
+func (ex *Exchange) handleCreateUser(c echo.Context) error {
+	var req CreateUserRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return newAPIError(http.StatusBadRequest, ErrCodeBadRequest, "invalid user: %v", err)
+	}
+	if req.ID < 0 {
+		return newAPIError(http.StatusBadRequest, ErrCodeValidation, "user ID must not be negative")
+	}
+
+	var (
+		pk  *ecdsa.PrivateKey
+		err error
+	)
+	if req.PrivateKey == "" {
+		pk, err = crypto.GenerateKey()
+	} else {
+		pk, err = crypto.HexToECDSA(req.PrivateKey)
+	}
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, ErrCodeValidation, "invalid private key: %v", err)
+	}
+
+	if len(req.APIKeys) == 0 {
+		key, err := newAPIKeyConfig()
+		if err != nil {
+			return err
+		}
+		req.APIKeys = []APIKeyConfig{key}
+	}
+	for _, key := range req.APIKeys {
+		if key.Key == "" || key.Secret == "" {
+			return newAPIError(http.StatusBadRequest, ErrCodeValidation, "API key and secret are required")
+		}
+	}
+
+	ex.usersMu.Lock()
+	defer ex.usersMu.Unlock()
+
+	if req.ID == 0 {
+		for id := range ex.Users {
+			req.ID = max(req.ID, id)
+		}
+		req.ID++
+	}
+	if _, ok := ex.Users[req.ID]; ok {
+		return newAPIError(http.StatusConflict, ErrCodeValidation, "user %d already exists", req.ID)
+	}
+	keys := make([]*APIKey, len(req.APIKeys))
+	for i, key := range req.APIKeys {
+		keys[i] = &APIKey{Key: key.Key, Secret: key.Secret, UserID: req.ID}
+	}
+	// the keys go first, the user is not added if one is taken
+	if err := ex.auth.addKeys(keys...); err != nil {
+		return newAPIError(http.StatusConflict, ErrCodeValidation, "%v", err)
+	}
+
+	user := &User{ID: req.ID, PrivateKey: pk}
+	ex.Users[user.ID] = user
+	ex.createdUsers = append(ex.createdUsers, UserConfig{
+		ID:         user.ID,
+		PrivateKey: hex.EncodeToString(crypto.FromECDSA(pk)),
+		APIKeys:    req.APIKeys,
+	})
+
+	ex.audit(c, ActionCreateUser, strconv.FormatInt(user.ID, 10), req.Reason, map[string]any{
+		"Address": user.Address().Hex(),
+	})
+
+	return c.JSON(http.StatusOK, CreateUserResponse{
+		ID:      user.ID,
+		Address: user.Address().Hex(),
+		APIKeys: req.APIKeys,
+	})
+}
+
+// newAPIKeyConfig generates a random API key and secret.
+func newAPIKeyConfig() (APIKeyConfig, error) {
+	b := make([]byte, 48)
+	if _, err := rand.Read(b); err != nil {
+		return APIKeyConfig{}, err
+	}
+
+	return APIKeyConfig{
+		Key:    hex.EncodeToString(b[:16]),
+		Secret: hex.EncodeToString(b[16:]),
+	}, nil
+}
+
+// paramUser returns the user of the :id path parameter.
+func (ex *Exchange) paramUser(c echo.Context) (*User, error) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, ErrCodeBadRequest, "invalid user id")
+	}
+	user, ok := ex.user(id)
+	if !ok {
+		return nil, newAPIError(http.StatusNotFound, ErrCodeNotFound, "user %d not found", id)
+	}
+
+	return user, nil
+}
+
+// DisableUserResponse lists the orders pulled from the books.
+type DisableUserResponse struct {
+	Cancelled []orderbook.CancelledOrder
+}
+
+// handleDisableUser locks a user out: their API keys stop working, their
+// stream sessions are hung up and their resting orders cancelled.
+func (ex *Exchange) handleDisableUser(c echo.Context) error {
+	user, err := ex.paramUser(c)
+	if err != nil {
+		return err
+	}
+	var req AdminRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return newAPIError(http.StatusBadRequest, ErrCodeBadRequest, "invalid request: %v", err)
+	}
+
+	ex.setUserDisabled(user, true)
+	ex.deadMan.disarm(user.ID)
+	ex.stream.closeUser(user.ID, websocket.ClosePolicyViolation, "user disabled")
+
+	cancelled := []orderbook.CancelledOrder{}
+	for market := range ex.markets.engines() {
+		cancelled = append(cancelled, ex.massCancel(market, user.ID, nil, orderbook.ReasonUserDisabled)...)
+	}
+
+	ex.audit(c, ActionDisableUser, strconv.FormatInt(user.ID, 10), req.Reason, map[string]any{
+		"Cancelled": len(cancelled),
+	})
+
+	return c.JSON(http.StatusOK, DisableUserResponse{Cancelled: cancelled})
+}
+
+func (ex *Exchange) handleEnableUser(c echo.Context) error {
+	user, err := ex.paramUser(c)
+	if err != nil {
+		return err
+	}
+	var req AdminRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return newAPIError(http.StatusBadRequest, ErrCodeBadRequest, "invalid request: %v", err)
+	}
+
+	ex.setUserDisabled(user, false)
+	ex.audit(c, ActionEnableUser, strconv.FormatInt(user.ID, 10), req.Reason, nil)
+
+	return c.JSON(http.StatusOK, map[string]any{"msg": "user enabled"})
+}
+
+func (ex *Exchange) setUserDisabled(user *User, disabled bool) {
+	ex.usersMu.Lock()
+	defer ex.usersMu.Unlock()
+
+	user.Disabled = disabled
+}
+
+// disabledUsers returns the IDs of the disabled users.
+func (ex *Exchange) disabledUsers() []int64 {
+	ex.usersMu.RLock()
+	defer ex.usersMu.RUnlock()
+
+	ids := []int64{}
+	for id, user := range ex.Users {
+		if user.Disabled {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	return ids
+}
+
+// handleAdminCancelOrder force cancels any resting order, halted markets
+// included.
+func (ex *Exchange) handleAdminCancelOrder(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, ErrCodeBadRequest, "invalid order id")
+	}
+
+	var userID int64
+	market, err := ex.cancelResting(id, orderbook.ReasonCancelledByAdmin, func(_ Market, order *orderbook.Order) error {
+		userID = order.UserID
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	ex.audit(c, ActionCancelOrders, strconv.FormatInt(id, 10), c.QueryParam("reason"), map[string]any{
+		"Market": market,
+		"UserID": userID,
+	})
+
+	return c.JSON(http.StatusOK, map[string]any{"msg": "order deleted"})
+}
+
+// handleAdminCancelUserOrders force cancels the resting orders of a user,
+// filtered by ?market= and ?side=.
+func (ex *Exchange) handleAdminCancelUserOrders(c echo.Context) error {
+	user, err := ex.paramUser(c)
+	if err != nil {
+		return err
+	}
+
+	markets := []Market{}
+	if market := Market(c.QueryParam("market")); market != "" {
+		if _, ok := ex.engine(market); !ok {
+			return newAPIError(http.StatusBadRequest, ErrCodeUnknownMarket, "market %s not found", market)
+		}
+		markets = append(markets, market)
+	} else {
+		for market := range ex.markets.engines() {
+			markets = append(markets, market)
+		}
+	}
+
+	var bid *bool
+	switch c.QueryParam("side") {
+	case "":
+	case "bid":
+		bid = new(bool)
+		*bid = true
+	case "ask":
+		bid = new(bool)
+	default:
+		return newAPIError(http.StatusBadRequest, ErrCodeValidation, "side must be bid or ask")
+	}
+
+	cancelled := []orderbook.CancelledOrder{}
+	for _, market := range markets {
+		cancelled = append(cancelled, ex.massCancel(market, user.ID, bid, orderbook.ReasonCancelledByAdmin)...)
+	}
+
+	ex.audit(c, ActionCancelOrders, strconv.FormatInt(user.ID, 10), c.QueryParam("reason"), map[string]any{
+		"Market":    c.QueryParam("market"),
+		"Side":      c.QueryParam("side"),
+		"Cancelled": len(cancelled),
+	})
+
+	return c.JSON(http.StatusOK, CancelOrdersResponse{Cancelled: cancelled})
+}
+
+// AdjustBalanceRequest moves funds between the exchange account and the
+// account of a user.
+type AdjustBalanceRequest struct {
+	// Amount is in wei, a positive amount credits the user from the
+	// exchange account, a negative one debits them to it.
+	Amount string
+	// Reason is required, it explains the adjustment in the audit trail.
+	Reason string
+}
+
+// handleAdjustBalance settles a balance adjustment on chain. The attempt
+// is audited whether the transfer goes through or not.
+func (ex *Exchange) handleAdjustBalance(c echo.Context) error {
+	user, err := ex.paramUser(c)
+	if err != nil {
+		return err
+	}
+
+	var req AdjustBalanceRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return newAPIError(http.StatusBadRequest, ErrCodeBadRequest, "invalid adjustment: %v", err)
+	}
+	amount, ok := new(big.Int).SetString(req.Amount, 10)
+	if !ok || amount.Sign() == 0 {
+		return newAPIError(http.StatusBadRequest, ErrCodeValidation, "amount must be a non-zero integer in wei")
+	}
+	if req.Reason == "" {
+		return newAPIError(http.StatusBadRequest, ErrCodeValidation, "reason is required")
+	}
+
+	from, to := ex.PrivateKey, user.Address()
+	if amount.Sign() < 0 {
+		from, to = user.PrivateKey, crypto.PubkeyToAddress(ex.PrivateKey.PublicKey)
+	}
+
+	ctx := withAttrs(c.Request().Context(), "target_user_id", user.ID)
+	err = ex.Settler.Transfer(ctx, from, to, new(big.Int).Abs(amount))
+
+	details := map[string]any{"Amount": amount.String()}
+	if err != nil {
+		details["Error"] = err.Error()
+	}
+	entry := ex.audit(c, ActionAdjustBalance, strconv.FormatInt(user.ID, 10), req.Reason, details)
+
+	if err != nil && isInsufficientFunds(err) {
+		return newAPIError(http.StatusUnprocessableEntity, ErrCodeInsufficientFunds, "adjustment of user %d failed: %v", user.ID, err)
+	}
+	if err != nil {
+		return newAPIError(http.StatusBadGateway, ErrCodeSettlementFailed, "adjustment of user %d failed: %v", user.ID, err)
+	}
+
+	return c.JSON(http.StatusOK, entry)
+}
+
+func (ex *Exchange) handleGetAudit(c echo.Context) error {
+	limit, err := queryLimit(c, defaultAuditLimit, maxAuditLimit)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, ex.auditTrail.latest(limit))
+}
+
+// SystemStatus is an overview of the exchange for operators.
+type SystemStatus struct {
+	StartedAt int64
+	Uptime    Duration
+	// ShuttingDown is set once the exchange stopped taking orders.
+	ShuttingDown   bool
+	Users          int
+	DisabledUsers  []int64
+	StreamSessions int
+	Markets        []MarketState
+}
+
+type MarketState struct {
+	Market        Market
+	Status        MarketStatus
+	RestingOrders int
+	BestBid       *Level
+	BestAsk       *Level
+	LastTradeID   int64
+}
+
+func (ex *Exchange) handleGetStatus(c echo.Context) error {
+	ex.usersMu.RLock()
+	users := len(ex.Users)
+	ex.usersMu.RUnlock()
+
+	status := SystemStatus{
+		StartedAt:      ex.startedAt.UnixNano(),
+		Uptime:         Duration(time.Since(ex.startedAt).Round(time.Second)),
+		ShuttingDown:   ex.closing.Load(),
+		Users:          users,
+		DisabledUsers:  ex.disabledUsers(),
+		StreamSessions: ex.stream.count(),
+		Markets:        []MarketState{},
+	}
+
+	engines := ex.markets.engines()
+	for _, cfg := range ex.markets.list() {
+		eng, ok := engines[cfg.Symbol]
+		if !ok {
+			continue
+		}
+		view := eng.currentView()
+		status.Markets = append(status.Markets, MarketState{
+			Market:        cfg.Symbol,
+			Status:        cfg.Status,
+			RestingOrders: len(view.Book.Bids) + len(view.Book.Asks),
+			BestBid:       view.BestBid,
+			BestAsk:       view.BestAsk,
+			LastTradeID:   eng.trades.last(),
+		})
+	}
+
+	return c.JSON(http.StatusOK, status)
+}
+
+// restoreUsers provisions the users created through the admin API and
+// disables those that were. Users of the config win on the same ID.
+func (ex *Exchange) restoreUsers(created []UserConfig, disabled []int64) error {
+	restored := []UserConfig{}
+	for _, cfg := range created {
+		if _, ok := ex.user(cfg.ID); !ok {
+			restored = append(restored, cfg)
+		}
+	}
+	if err := ex.ProvisionUsers(restored); err != nil {
+		return fmt.Errorf("restoring users: %w", err)
+	}
+
+	ex.usersMu.Lock()
+	defer ex.usersMu.Unlock()
+
+	ex.createdUsers = restored
+	for _, id := range disabled {
+		if user, ok := ex.Users[id]; ok {
+			user.Disabled = true
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	HeaderAPIKey       = "X-API-KEY"
+	HeaderAPITimestamp = "X-API-TIMESTAMP"
+	HeaderAPINonce     = "X-API-NONCE"
+	HeaderAPISignature = "X-API-SIGNATURE"
+
+	// signatureWindow is how far the request timestamp may be off from the
+	// server clock. Nonces are remembered for twice as long at least.
+	signatureWindow = 30 * time.Second
+
+	// maxSignedBody caps the body read to check a signature.
+	maxSignedBody = 1 << 20
+
+	// contextUserID is where the auth middleware stores the acting user,
+	// contextAdmin the API key of the acting admin.
+	contextUserID = "userID"
+	contextAdmin  = "admin"
+)
+
+// APIKey lets its holder act as the bound user. The secret never travels
+// over the wire, it only keys the request signatures.
+type APIKey struct {
+	Key    string
+	Secret string
+	UserID int64
+}
+
+// Sign computes the X-API-SIGNATURE of a request over the timestamp (unix
+// milliseconds), nonce, method, path with query and body.
+func Sign(secret string, timestamp int64, nonce, method, path string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d\n%s\n%s\n%s\n", timestamp, nonce, method, path)
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// authenticator holds the API keys and the nonces seen recently.
+type authenticator struct {
+	mu   sync.Mutex
+	keys map[string]*APIKey
+	// nonces are seen since rotated, previous in the period before. A
+	// whole period is dropped at once, a nonce is kept for one or two.
+	nonces   map[string]struct{}
+	previous map[string]struct{}
+	rotated  time.Time
+	now      func() time.Time
+}
+
+func newAuthenticator() *authenticator {
+	return &authenticator{
+		keys:     make(map[string]*APIKey),
+		nonces:   make(map[string]struct{}),
+		previous: make(map[string]struct{}),
+		now:      time.Now,
+	}
+}
+
+func (a *authenticator) addKey(key *APIKey) error {
+	return a.addKeys(key)
+}
+
+// addKeys adds all keys or none of them.
+func (a *authenticator) addKeys(keys ...*APIKey) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, key := range keys {
+		// provisioning the same key twice, from the config and a
+		// snapshot, is harmless
+		if existing, ok := a.keys[key.Key]; ok && *existing != *key {
+			return fmt.Errorf("api key %s already exists", key.Key)
+		}
+	}
+	for _, key := range keys {
+		a.keys[key.Key] = key
+	}
+
+	return nil
+}
+
+// verify checks a signed request and returns the user it acts for.
+func (a *authenticator) verify(key string, timestamp int64, nonce, signature, method, path string, body []byte) (int64, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	apiKey, ok := a.keys[key]
+	if !ok {
+		return 0, fmt.Errorf("unknown api key")
+	}
+
+	now := a.now()
+	sent := time.UnixMilli(timestamp)
+	if sent.Before(now.Add(-signatureWindow)) || sent.After(now.Add(signatureWindow)) {
+		return 0, fmt.Errorf("request timestamp outside of the %s window", signatureWindow)
+	}
+	if nonce == "" {
+		return 0, fmt.Errorf("nonce is required")
+	}
+
+	expected := Sign(apiKey.Secret, timestamp, nonce, method, path, body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return 0, fmt.Errorf("invalid signature")
+	}
+
+	// only remember nonces of valid requests, so nobody can burn them. A
+	// request can be replayed for 2*signatureWindow after it was sent.
+	if period := now.Sub(a.rotated); period >= 2*signatureWindow {
+		a.previous = a.nonces
+		if period >= 4*signatureWindow {
+			a.previous = make(map[string]struct{})
+		}
+		a.nonces = make(map[string]struct{})
+		a.rotated = now
+	}
+	nonceKey := key + ":" + nonce
+	_, seen := a.nonces[nonceKey]
+	_, seenBefore := a.previous[nonceKey]
+	if seen || seenBefore {
+		return 0, fmt.Errorf("nonce already used")
+	}
+	a.nonces[nonceKey] = struct{}{}
+
+	return apiKey.UserID, nil
+}
+
+// verifyRequest checks the signature of a request against the keys of a
+// and returns the user bound to the key.
+func verifyRequest(c echo.Context, a *authenticator) (int64, error) {
+	req := c.Request()
+
+	timestamp, err := strconv.ParseInt(req.Header.Get(HeaderAPITimestamp), 10, 64)
+	if err != nil {
+		return 0, newAPIError(http.StatusUnauthorized, ErrCodeUnauthorized, "invalid timestamp")
+	}
+
+	var body []byte
+	if req.Body != nil {
+		body, err = io.ReadAll(http.MaxBytesReader(c.Response(), req.Body, maxSignedBody))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return 0, newAPIError(http.StatusRequestEntityTooLarge, ErrCodeBadRequest, "request body is larger than %d bytes", tooLarge.Limit)
+		}
+		if err != nil {
+			return 0, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	userID, err := a.verify(
+		req.Header.Get(HeaderAPIKey),
+		timestamp,
+		req.Header.Get(HeaderAPINonce),
+		req.Header.Get(HeaderAPISignature),
+		req.Method,
+		req.URL.RequestURI(),
+		body,
+	)
+	if err != nil {
+		return 0, newAPIError(http.StatusUnauthorized, ErrCodeUnauthorized, "%v", err)
+	}
+
+	return userID, nil
+}
+
+// authenticate verifies the request signature and stores the user bound
+// to the API key in the context.
+func (ex *Exchange) authenticate(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, err := verifyRequest(c, ex.auth)
+		if err != nil {
+			return err
+		}
+		if ex.userDisabled(userID) {
+			return newAPIError(http.StatusForbidden, ErrCodeForbidden, "user %d is disabled", userID)
+		}
+
+		c.Set(contextUserID, userID)
+		setRequestAttrs(c, "user_id", userID)
+
+		return next(c)
+	}
+}
+
+// authenticateAdmin is the middleware of the admin routes. Admin keys are
+// signed like API keys but kept apart, no user key opens an admin route.
+func (ex *Exchange) authenticateAdmin(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if _, err := verifyRequest(c, ex.adminAuth); err != nil {
+			return err
+		}
+
+		admin := c.Request().Header.Get(HeaderAPIKey)
+		c.Set(contextAdmin, admin)
+		setRequestAttrs(c, "admin", admin)
+
+		return next(c)
+	}
+}
+
+// actingUser is the user authenticated for the request.
+func actingUser(c echo.Context) int64 {
+	userID, _ := c.Get(contextUserID).(int64)
+	return userID
+}
+
+// actingAdmin is the admin key of the request.
+func actingAdmin(c echo.Context) string {
+	admin, _ := c.Get(contextAdmin).(string)
+	return admin
+}
+
+// AddAPIKey binds an API key to an existing user.
+func (ex *Exchange) AddAPIKey(userID int64, key, secret string) error {
+	if _, ok := ex.user(userID); !ok {
+		return fmt.Errorf("user %d not found", userID)
+	}
+
+	return ex.auth.addKey(&APIKey{
+		Key:    key,
+		Secret: secret,
+		UserID: userID,
+	})
+}
+
+// AddAdminKey lets the holder of the key use the admin API.
+func (ex *Exchange) AddAdminKey(key, secret string) error {
+	return ex.adminAuth.addKey(&APIKey{
+		Key:    key,
+		Secret: secret,
+	})
+}
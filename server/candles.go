@@ -0,0 +1,284 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Baazaouihamza/crypto-exchange/orderbook"
+	"github.com/labstack/echo/v4"
+)
+
+// CandleInterval is the period a candle covers.
+type CandleInterval string
+
+const (
+	Candle1m  CandleInterval = "1m"
+	Candle5m  CandleInterval = "5m"
+	Candle15m CandleInterval = "15m"
+	Candle1h  CandleInterval = "1h"
+	Candle1d  CandleInterval = "1d"
+)
+
+const (
+	// maxCandles is how many candles of every interval are kept, older
+	// ones can be rebuilt from the trade history.
+	maxCandles = 1000
+
+	defaultCandlesLimit = 500
+	maxCandlesLimit     = 1000
+)
+
+// candleIntervals are the intervals maintained for every market, shortest
+// first.
+var candleIntervals = []CandleInterval{Candle1m, Candle5m, Candle15m, Candle1h, Candle1d}
+
+// Duration is the period of the interval, zero for an unknown interval.
+func (i CandleInterval) Duration() time.Duration {
+	switch i {
+	case Candle1m:
+		return time.Minute
+	case Candle5m:
+		return 5 * time.Minute
+	case Candle15m:
+		return 15 * time.Minute
+	case Candle1h:
+		return time.Hour
+	case Candle1d:
+		return 24 * time.Hour
+	default:
+		return 0
+	}
+}
+
+// Candle holds the OHLCV statistics of the trades of one interval. Only
+// intervals with trades have a candle.
+type Candle struct {
+	Market   Market
+	Interval CandleInterval
+	// OpenTime is the start of the interval in unix nanoseconds, aligned
+	// on the interval in UTC.
+	OpenTime    int64
+	Open        float64
+	High        float64
+	Low         float64
+	Close       float64
+	Volume      float64
+	QuoteVolume float64
+	Trades      int
+}
+
+// candleStore aggregates the trades of a market into candles. It is fed
+// by the engine goroutine and read by handlers.
+type candleStore struct {
+	mu     sync.RWMutex
+	market Market
+	// series holds the candles of every interval ordered by OpenTime.
+	series map[CandleInterval][]Candle
+}
+
+func newCandleStore(market Market) *candleStore {
+	return &candleStore{
+		market: market,
+		series: make(map[CandleInterval][]Candle),
+	}
+}
+
+// add folds the trades into the candles of every interval and returns
+// the candles they changed, in their final state.
+func (s *candleStore) add(trades []*orderbook.Trade) []Candle {
+	if len(trades) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	type candleKey struct {
+		interval CandleInterval
+		openTime int64
+	}
+	changed := []candleKey{}
+	seen := make(map[candleKey]bool)
+
+	for _, trade := range trades {
+		for _, interval := range candleIntervals {
+			key := candleKey{interval, s.fold(interval, trade)}
+			if !seen[key] {
+				seen[key] = true
+				changed = append(changed, key)
+			}
+		}
+	}
+
+	candles := make([]Candle, 0, len(changed))
+	for _, key := range changed {
+		if candle, ok := s.find(key.interval, key.openTime); ok {
+			candles = append(candles, *candle)
+		}
+	}
+
+	return candles
+}
+
+// fold adds the trade to the candle of the interval it falls in and
+// returns the open time of that candle.
+func (s *candleStore) fold(interval CandleInterval, trade *orderbook.Trade) int64 {
+	d := int64(interval.Duration())
+	openTime := trade.TimeStamp - trade.TimeStamp%d
+
+	series := s.series[interval]
+	i := sort.Search(len(series), func(i int) bool { return series[i].OpenTime >= openTime })
+	if i == len(series) || series[i].OpenTime != openTime {
+		series = append(series, Candle{})
+		copy(series[i+1:], series[i:])
+		series[i] = Candle{
+			Market:   s.market,
+			Interval: interval,
+			OpenTime: openTime,
+			Open:     trade.Price,
+			High:     trade.Price,
+			Low:      trade.Price,
+		}
+	}
+
+	c := &series[i]
+	c.High = max(c.High, trade.Price)
+	c.Low = min(c.Low, trade.Price)
+	c.Close = trade.Price
+	c.Volume += trade.Size
+	c.QuoteVolume += trade.Size * trade.Price
+	c.Trades++
+
+	if len(series) > maxCandles {
+		series = series[len(series)-maxCandles:]
+	}
+	s.series[interval] = series
+
+	return openTime
+}
+
+func (s *candleStore) find(interval CandleInterval, openTime int64) (*Candle, bool) {
+	series := s.series[interval]
+	i := sort.Search(len(series), func(i int) bool { return series[i].OpenTime >= openTime })
+	if i == len(series) || series[i].OpenTime != openTime {
+		return nil, false
+	}
+
+	return &series[i], true
+}
+
+// latest returns the most recent candle of the interval.
+func (s *candleStore) latest(interval CandleInterval) (Candle, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	series := s.series[interval]
+	if len(series) == 0 {
+		return Candle{}, false
+	}
+
+	return series[len(series)-1], true
+}
+
+// CandlesQuery selects the candles of an interval by open time in unix
+// nanoseconds, Until is exclusive.
+type CandlesQuery struct {
+	Interval CandleInterval
+	Since    int64
+	Until    int64
+	Limit    int
+}
+
+// query returns the candles matching q, oldest first.
+func (s *candleStore) query(q CandlesQuery) []Candle {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	series := s.series[q.Interval]
+	start, end := 0, len(series)
+	if q.Until != 0 {
+		end = sort.Search(len(series), func(i int) bool { return series[i].OpenTime >= q.Until })
+	}
+	if q.Since != 0 {
+		start = sort.Search(len(series), func(i int) bool { return series[i].OpenTime >= q.Since })
+	} else {
+		start = max(0, end-q.Limit)
+	}
+	end = min(end, start+q.Limit)
+
+	candles := []Candle{}
+	if start < end {
+		candles = append(candles, series[start:end]...)
+	}
+
+	return candles
+}
+
+// backfillCandles rebuilds the candles from the stored trades. It must be
+// called from the engine goroutine.
+func (e *engine) backfillCandles() error {
+	longest := candleIntervals[len(candleIntervals)-1].Duration()
+	since := time.Now().Add(-maxCandles * longest).UnixNano()
+
+	candles := newCandleStore(e.market)
+	trades := make([]*orderbook.Trade, 0, 1024)
+	err := e.trades.scan(since, func(trade *orderbook.Trade) {
+		trades = append(trades, trade)
+		if len(trades) == cap(trades) {
+			candles.add(trades)
+			trades = trades[:0]
+		}
+	})
+	if err != nil {
+		return err
+	}
+	candles.add(trades)
+
+	e.candles.mu.Lock()
+	e.candles.series = candles.series
+	e.candles.mu.Unlock()
+
+	return nil
+}
+
+// handleGetCandles returns the candles of a market, oldest first.
+func (ex *Exchange) handleGetCandles(c echo.Context) error {
+	market := Market(c.Param("market"))
+	eng, ok := ex.engine(market)
+	if !ok {
+		return newAPIError(http.StatusNotFound, ErrCodeUnknownMarket, "market %s not found", market)
+	}
+
+	q := CandlesQuery{Interval: CandleInterval(c.QueryParam("interval"))}
+	if q.Interval.Duration() == 0 {
+		return newAPIError(http.StatusBadRequest, ErrCodeValidation, "interval must be one of %s", validCandleIntervals())
+	}
+	for name, dst := range map[string]*int64{"since": &q.Since, "until": &q.Until} {
+		if err := queryInt64(c, name, dst); err != nil {
+			return err
+		}
+	}
+	// the query is in milliseconds, candles open in nanoseconds
+	q.Since *= 1e6
+	q.Until *= 1e6
+
+	limit, err := queryLimit(c, defaultCandlesLimit, maxCandlesLimit)
+	if err != nil {
+		return err
+	}
+	q.Limit = limit
+
+	return c.JSON(http.StatusOK, eng.candles.query(q))
+}
+
+func validCandleIntervals() string {
+	names := make([]string, len(candleIntervals))
+	for i, interval := range candleIntervals {
+		names[i] = string(interval)
+	}
+
+	return strings.Join(names, ", ")
+}
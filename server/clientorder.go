@@ -0,0 +1,245 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// clientOrderRetention is how long a client order ID is remembered, a
+// retry within it returns the original response.
+const clientOrderRetention = 24 * time.Hour
+
+type clientOrderKey struct {
+	userID        int64
+	clientOrderID string
+}
+
+// clientOrder is an order submitted with a client order ID, retries wait
+// on done for the first submission.
+type clientOrder struct {
+	key     clientOrderKey
+	req     PlaceOrderRequest
+	created time.Time
+	done    chan struct{}
+	resp    *PlaceOrderResponse
+	err     error
+}
+
+// sameOrder tells whether a retry asks for the same order. Nonce and
+// signature differ when a client signs the retry again.
+func sameOrder(a, b *PlaceOrderRequest) bool {
+	return a.Type == b.Type &&
+		a.Bid == b.Bid &&
+		a.Size == b.Size &&
+		a.Notional == b.Notional &&
+		a.Price == b.Price &&
+		a.Market == b.Market
+}
+
+// clientOrderStore deduplicates order submissions by client order ID.
+type clientOrderStore struct {
+	mu        sync.Mutex
+	retention time.Duration
+	orders    map[clientOrderKey]*clientOrder
+	byOrderID map[int64]*clientOrder
+	// queue holds the orders oldest first, so expiring them is cheap
+	queue []*clientOrder
+	now   func() time.Time
+}
+
+func newClientOrderStore(retention time.Duration) *clientOrderStore {
+	return &clientOrderStore{
+		retention: retention,
+		orders:    make(map[clientOrderKey]*clientOrder),
+		byOrderID: make(map[int64]*clientOrder),
+		now:       time.Now,
+	}
+}
+
+// reserve claims the client order ID of the request. If it was submitted
+// before, the earlier submission is returned instead and fresh is false.
+func (s *clientOrderStore) reserve(req *PlaceOrderRequest) (order *clientOrder, fresh bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.expire(now)
+
+	key := clientOrderKey{userID: req.UserID, clientOrderID: req.ClientOrderID}
+	if order, ok := s.orders[key]; ok {
+		if !sameOrder(&order.req, req) {
+			return nil, false, newAPIError(http.StatusConflict, ErrCodeDuplicateOrder,
+				"client order id %s is already used for another order", req.ClientOrderID)
+		}
+		return order, false, nil
+	}
+
+	order = &clientOrder{
+		key:     key,
+		req:     *req,
+		created: now,
+		done:    make(chan struct{}),
+	}
+	s.orders[key] = order
+	s.queue = append(s.queue, order)
+
+	return order, true, nil
+}
+
+// complete records the outcome of a submission. Without an order the
+// client order ID is released.
+func (s *clientOrderStore) complete(order *clientOrder, resp *PlaceOrderResponse, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order.resp, order.err = resp, err
+	if resp == nil {
+		if s.orders[order.key] == order {
+			delete(s.orders, order.key)
+		}
+	} else {
+		s.byOrderID[resp.OrderID] = order
+	}
+	close(order.done)
+}
+
+func (s *clientOrderStore) expire(now time.Time) {
+	for len(s.queue) > 0 && now.Sub(s.queue[0].created) > s.retention {
+		order := s.queue[0]
+		s.queue[0] = nil
+		s.queue = s.queue[1:]
+
+		if s.orders[order.key] == order {
+			delete(s.orders, order.key)
+		}
+		if order.resp != nil && s.byOrderID[order.resp.OrderID] == order {
+			delete(s.byOrderID, order.resp.OrderID)
+		}
+	}
+}
+
+// orderID resolves a client order ID of a user to the order placed for
+// it.
+func (s *clientOrderStore) orderID(userID int64, clientOrderID string) (int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire(s.now())
+
+	order, ok := s.orders[clientOrderKey{userID: userID, clientOrderID: clientOrderID}]
+	if !ok {
+		return 0, false
+	}
+	select {
+	case <-order.done:
+	default:
+		// still being placed
+		return 0, false
+	}
+	if order.resp == nil {
+		return 0, false
+	}
+
+	return order.resp.OrderID, true
+}
+
+// clientOrderID is the client order ID an order was placed with, if any.
+func (s *clientOrderStore) clientOrderID(orderID int64) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if order, ok := s.byOrderID[orderID]; ok {
+		return order.key.clientOrderID
+	}
+
+	return ""
+}
+
+// ClientOrder is a remembered client order ID in a snapshot. Response is
+// nil for an order that was still being placed.
+type ClientOrder struct {
+	Request   PlaceOrderRequest
+	ExpiresAt int64
+	Response  *PlaceOrderResponse `json:",omitempty"`
+	// Error came with the response, like the rejection of a market order.
+	Error       *APIError `json:",omitempty"`
+	ErrorStatus int       `json:",omitempty"`
+}
+
+// list returns the client order IDs still remembered, oldest first.
+func (s *clientOrderStore) list() []ClientOrder {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire(s.now())
+
+	orders := make([]ClientOrder, 0, len(s.orders))
+	for _, order := range s.queue {
+		if s.orders[order.key] != order {
+			// released
+			continue
+		}
+		saved := ClientOrder{
+			Request:   order.req,
+			ExpiresAt: order.created.Add(s.retention).UnixNano(),
+			Response:  order.resp,
+		}
+		if order.err != nil {
+			var apiErr *APIError
+			if !errors.As(order.err, &apiErr) {
+				apiErr = newAPIError(http.StatusInternalServerError, ErrCodeInternal, "internal server error")
+			}
+			saved.Error, saved.ErrorStatus = apiErr, apiErr.Status
+		}
+		orders = append(orders, saved)
+	}
+
+	return orders
+}
+
+// restore brings back the client order IDs of a snapshot. An order that
+// was still being placed may or may not be in the books, a retry of it is
+// refused rather than placed twice.
+func (s *clientOrderStore) restore(orders []ClientOrder) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	orders = append([]ClientOrder{}, orders...)
+	sort.Slice(orders, func(i, j int) bool {
+		return orders[i].ExpiresAt < orders[j].ExpiresAt
+	})
+
+	now := s.now()
+	for _, saved := range orders {
+		created := time.Unix(0, saved.ExpiresAt).Add(-s.retention)
+		if now.Sub(created) > s.retention {
+			continue
+		}
+		order := &clientOrder{
+			key:     clientOrderKey{userID: saved.Request.UserID, clientOrderID: saved.Request.ClientOrderID},
+			req:     saved.Request,
+			created: created,
+			done:    make(chan struct{}),
+			resp:    saved.Response,
+		}
+		switch {
+		case saved.Error != nil:
+			apiErr := *saved.Error
+			apiErr.Status = saved.ErrorStatus
+			order.err = &apiErr
+		case saved.Response == nil:
+			order.err = newAPIError(http.StatusConflict, ErrCodeDuplicateOrder,
+				"client order id %s was being placed during a restart, check the open orders", saved.Request.ClientOrderID)
+		}
+		close(order.done)
+
+		s.orders[order.key] = order
+		if order.resp != nil {
+			s.byOrderID[order.resp.OrderID] = order
+		}
+		s.queue = append(s.queue, order)
+	}
+}
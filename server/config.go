@@ -0,0 +1,392 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// DefaultChainID is the chain of a local development node.
+const DefaultChainID = 1337
+
+// LogFormat is how log records are written.
+type LogFormat string
+
+const (
+	LogFormatText LogFormat = "text"
+	LogFormatJSON LogFormat = "json"
+)
+
+// Duration is a time.Duration written like "30s" in configuration files.
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	return d.Set(s)
+}
+
+// UserConfig provisions a user with the key of their account and the API
+// keys they sign requests with. A missing PrivateKey is read from
+// EXCHANGE_USER_<ID>_PRIVATE_KEY.
+type UserConfig struct {
+	ID         int64
+	PrivateKey string
+	APIKeys    []APIKeyConfig
+}
+
+type APIKeyConfig struct {
+	Key    string
+	Secret string
+}
+
+// Config is everything StartServer needs.
+type Config struct {
+	ListenAddr string
+	// RPCURL is the node settlements are sent to, ChainID the chain it
+	// runs. Orders are signed for ChainID too.
+	RPCURL  string
+	ChainID int64
+	// PrivateKey is the hex key of the exchange account, best passed with
+	// EXCHANGE_PRIVATE_KEY.
+	PrivateKey   string
+	MarketsPath  string
+	SnapshotPath string
+	// SnapshotInterval is also how much a crash can lose, nothing is
+	// journaled between snapshots.
+	SnapshotInterval    Duration
+	TradeArchiveDir     string
+	FillArchiveDir      string
+	RequireSignedOrders bool
+	// ShutdownTimeout bounds how long draining may take on shutdown.
+	ShutdownTimeout Duration
+	// Users are provisioned at startup, together with those of the JSON
+	// list in UsersPath.
+	Users     []UserConfig
+	UsersPath string
+	// AdminKeys sign the admin requests, without one the admin API is off.
+	// AdminKey and AdminSecret add one, never from the config file.
+	AdminKeys   []APIKeyConfig
+	AdminKey    string `json:"-"`
+	AdminSecret string `json:"-"`
+	// AdminListenAddr serves the admin API apart from the public one, on
+	// loopback by default. When empty the admin API is off.
+	AdminListenAddr string
+	// GRPCListenAddr serves the gRPC API when set.
+	GRPCListenAddr string
+	// RateLimits replaces DefaultRateLimits when set.
+	RateLimits *RateLimits `json:",omitempty"`
+	// TrustedProxies are the CIDRs of the proxies in front of the
+	// exchange, their X-Forwarded-For names the client.
+	TrustedProxies []string `json:",omitempty"`
+	// LogLevel is the lowest level logged, like "debug" or "warn".
+	LogLevel  slog.Level
+	LogFormat LogFormat
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		ListenAddr:          ":3000",
+		AdminListenAddr:     "127.0.0.1:3002",
+		RPCURL:              "http://localhost:8545",
+		ChainID:             DefaultChainID,
+		MarketsPath:         "markets.json",
+		SnapshotPath:        "exchange.snapshot.json",
+		SnapshotInterval:    Duration(30 * time.Second),
+		TradeArchiveDir:     "trades",
+		FillArchiveDir:      "fills",
+		RequireSignedOrders: true,
+		ShutdownTimeout:     Duration(30 * time.Second),
+		LogLevel:            slog.LevelInfo,
+		LogFormat:           LogFormatText,
+	}
+}
+
+// configEnv maps the environment variables to the settings they
+// override.
+func (cfg *Config) configEnv() map[string]flag.Value {
+	return map[string]flag.Value{
+		"EXCHANGE_LISTEN_ADDR":           (*stringValue)(&cfg.ListenAddr),
+		"EXCHANGE_ADMIN_LISTEN_ADDR":     (*stringValue)(&cfg.AdminListenAddr),
+		"EXCHANGE_ADMIN_KEY":             (*stringValue)(&cfg.AdminKey),
+		"EXCHANGE_ADMIN_SECRET":          (*stringValue)(&cfg.AdminSecret),
+		"EXCHANGE_GRPC_LISTEN_ADDR":      (*stringValue)(&cfg.GRPCListenAddr),
+		"EXCHANGE_RPC_URL":               (*stringValue)(&cfg.RPCURL),
+		"EXCHANGE_CHAIN_ID":              (*int64Value)(&cfg.ChainID),
+		"EXCHANGE_PRIVATE_KEY":           (*stringValue)(&cfg.PrivateKey),
+		"EXCHANGE_MARKETS":               (*stringValue)(&cfg.MarketsPath),
+		"EXCHANGE_SNAPSHOT":              (*stringValue)(&cfg.SnapshotPath),
+		"EXCHANGE_SNAPSHOT_INTERVAL":     &cfg.SnapshotInterval,
+		"EXCHANGE_TRADE_ARCHIVE":         (*stringValue)(&cfg.TradeArchiveDir),
+		"EXCHANGE_FILL_ARCHIVE":          (*stringValue)(&cfg.FillArchiveDir),
+		"EXCHANGE_REQUIRE_SIGNED_ORDERS": (*boolValue)(&cfg.RequireSignedOrders),
+		"EXCHANGE_USERS":                 (*stringValue)(&cfg.UsersPath),
+		"EXCHANGE_SHUTDOWN_TIMEOUT":      &cfg.ShutdownTimeout,
+		"EXCHANGE_LOG_LEVEL":             (*levelValue)(&cfg.LogLevel),
+		"EXCHANGE_LOG_FORMAT":            (*stringValue)(&cfg.LogFormat),
+	}
+}
+
+// userKeyEnv is the environment variable holding the private key of a
+// user.
+func userKeyEnv(userID int64) string {
+	return fmt.Sprintf("EXCHANGE_USER_%d_PRIVATE_KEY", userID)
+}
+
+// LoadConfig applies the config file, the environment and args over the
+// defaults, in that order, and validates the result.
+func LoadConfig(args []string) (*Config, error) {
+	cfg := DefaultConfig()
+	path := os.Getenv("EXCHANGE_CONFIG")
+
+	fs := flag.NewFlagSet("exchange", flag.ContinueOnError)
+	fs.StringVar(&path, "config", path, "path of the JSON config file")
+	fs.StringVar(&cfg.ListenAddr, "listen", cfg.ListenAddr, "address the API listens on")
+	fs.StringVar(&cfg.AdminListenAddr, "admin-listen", cfg.AdminListenAddr, "address the admin API listens on, none when empty")
+	fs.StringVar(&cfg.AdminKey, "admin-key", cfg.AdminKey, "API key of the admin API")
+	fs.StringVar(&cfg.AdminSecret, "admin-secret", cfg.AdminSecret, "API secret of the admin API")
+	fs.StringVar(&cfg.GRPCListenAddr, "grpc-listen", cfg.GRPCListenAddr, "address the gRPC API listens on, none when empty")
+	fs.StringVar(&cfg.RPCURL, "rpc", cfg.RPCURL, "URL of the Ethereum node")
+	fs.Int64Var(&cfg.ChainID, "chain-id", cfg.ChainID, "chain ID of the Ethereum node")
+	fs.StringVar(&cfg.MarketsPath, "markets", cfg.MarketsPath, "path of the markets file")
+	fs.StringVar(&cfg.SnapshotPath, "snapshot", cfg.SnapshotPath, "path of the snapshot file")
+	fs.Var(&cfg.SnapshotInterval, "snapshot-interval", "time between snapshots")
+	fs.StringVar(&cfg.TradeArchiveDir, "trade-archive", cfg.TradeArchiveDir, "directory of the trade archives")
+	fs.StringVar(&cfg.FillArchiveDir, "fill-archive", cfg.FillArchiveDir, "directory of the fill archives")
+	fs.BoolVar(&cfg.RequireSignedOrders, "require-signed-orders", cfg.RequireSignedOrders, "refuse orders without an EIP-712 signature")
+	fs.StringVar(&cfg.UsersPath, "users", cfg.UsersPath, "path of the users file")
+	fs.Var(&cfg.ShutdownTimeout, "shutdown-timeout", "how long draining may take on shutdown")
+	fs.Var((*levelValue)(&cfg.LogLevel), "log-level", "lowest level logged: debug, info, warn or error")
+	fs.Var((*stringValue)(&cfg.LogFormat), "log-format", "format of the logs: text or json")
+
+	// the first pass only finds the config file, the flags are applied
+	// again once the file and the environment are loaded so they win
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	for name, value := range cfg.configEnv() {
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := value.Set(v); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if cfg.UsersPath != "" {
+		users, err := LoadUsers(cfg.UsersPath)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Users = append(cfg.Users, users...)
+	}
+	for i, user := range cfg.Users {
+		if key, ok := os.LookupEnv(userKeyEnv(user.ID)); ok {
+			cfg.Users[i].PrivateKey = key
+		}
+	}
+	if cfg.AdminKey != "" || cfg.AdminSecret != "" {
+		cfg.AdminKeys = append(cfg.AdminKeys, APIKeyConfig{Key: cfg.AdminKey, Secret: cfg.AdminSecret})
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func (cfg *Config) loadFile(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// LoadUsers reads a JSON list of UserConfig.
+func LoadUsers(path string) ([]UserConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []UserConfig
+	if err := json.Unmarshal(b, &users); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	return users, nil
+}
+
+func (cfg *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(cfg.ListenAddr != "", "listen address is required")
+	check(cfg.RPCURL != "", "RPC URL is required")
+	check(cfg.ChainID > 0, "chain ID must be positive")
+	check(cfg.MarketsPath != "", "markets path is required")
+	check(cfg.SnapshotPath != "", "snapshot path is required")
+	check(cfg.SnapshotInterval > 0, "snapshot interval must be positive")
+	check(cfg.TradeArchiveDir != "", "trade archive directory is required")
+	check(cfg.FillArchiveDir != "", "fill archive directory is required")
+	check(cfg.ShutdownTimeout > 0, "shutdown timeout must be positive")
+	check(cfg.LogFormat == LogFormatText || cfg.LogFormat == LogFormatJSON, "log format must be %s or %s", LogFormatText, LogFormatJSON)
+	if cfg.PrivateKey == "" {
+		check(false, "exchange private key is required, set EXCHANGE_PRIVATE_KEY")
+	} else {
+		_, err := crypto.HexToECDSA(cfg.PrivateKey)
+		check(err == nil, "invalid exchange private key")
+	}
+
+	userIDs := make(map[int64]bool)
+	apiKeys := make(map[string]bool)
+	for _, user := range cfg.Users {
+		check(!userIDs[user.ID], "user %d is provisioned twice", user.ID)
+		userIDs[user.ID] = true
+
+		if user.PrivateKey == "" {
+			check(false, "user %d: private key is required, set %s", user.ID, userKeyEnv(user.ID))
+		} else {
+			_, err := crypto.HexToECDSA(user.PrivateKey)
+			check(err == nil, "user %d: invalid private key", user.ID)
+		}
+
+		for _, key := range user.APIKeys {
+			check(key.Key != "" && key.Secret != "", "user %d: API key and secret are required", user.ID)
+			check(!apiKeys[key.Key], "user %d: API key %s is used twice", user.ID, key.Key)
+			apiKeys[key.Key] = true
+		}
+	}
+	for _, cidr := range cfg.TrustedProxies {
+		_, _, err := net.ParseCIDR(cidr)
+		check(err == nil, "invalid trusted proxy %q", cidr)
+	}
+	// admin keys have their own namespace, a user key of the same name
+	// would still be confusing
+	for _, key := range cfg.AdminKeys {
+		check(key.Key != "" && key.Secret != "", "admin API key and secret are required")
+		check(!apiKeys[key.Key], "admin API key %s is used twice", key.Key)
+		apiKeys[key.Key] = true
+	}
+
+	return errors.Join(errs...)
+}
+
+// ProvisionUsers registers the users of the configuration and their API
+// keys. It must be called before the routes serve requests.
+func (ex *Exchange) ProvisionUsers(users []UserConfig) error {
+	for _, cfg := range users {
+		pk, err := crypto.HexToECDSA(cfg.PrivateKey)
+		if err != nil {
+			return fmt.Errorf("user %d: %w", cfg.ID, err)
+		}
+
+		ex.addUser(&User{ID: cfg.ID, PrivateKey: pk})
+
+		for _, key := range cfg.APIKeys {
+			if err := ex.AddAPIKey(cfg.ID, key.Key, key.Secret); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// stringValue, int64Value, boolValue and levelValue let the environment
+// be applied like flags.
+type (
+	stringValue string
+	int64Value  int64
+	boolValue   bool
+	levelValue  slog.Level
+)
+
+func (v *stringValue) Set(s string) error {
+	*v = stringValue(s)
+	return nil
+}
+
+func (v *stringValue) String() string { return string(*v) }
+
+func (v *int64Value) Set(s string) error {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return err
+	}
+	*v = int64Value(n)
+
+	return nil
+}
+
+func (v *int64Value) String() string { return strconv.FormatInt(int64(*v), 10) }
+
+func (v *boolValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	*v = boolValue(b)
+
+	return nil
+}
+
+func (v *boolValue) String() string { return strconv.FormatBool(bool(*v)) }
+
+func (v *levelValue) Set(s string) error {
+	return (*slog.Level)(v).UnmarshalText([]byte(s))
+}
+
+func (v *levelValue) String() string { return slog.Level(*v).String() }
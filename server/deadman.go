@@ -0,0 +1,124 @@
+package server
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// deadMansSwitch fires trigger for a user once their armed timeout lapses
+// without being refreshed.
+type deadMansSwitch struct {
+	mu      sync.Mutex
+	timers  map[int64]*deadMansTimer
+	trigger func(userID int64)
+	// stopped switches never fire, running counts the triggers under way.
+	stopped bool
+	running sync.WaitGroup
+}
+
+type deadMansTimer struct {
+	timer *time.Timer
+	// gen is bumped on every refresh so a timer that already fired
+	// concurrently with a refresh does not trigger.
+	gen uint64
+}
+
+func newDeadMansSwitch(trigger func(userID int64)) *deadMansSwitch {
+	return &deadMansSwitch{
+		timers:  make(map[int64]*deadMansTimer),
+		trigger: trigger,
+	}
+}
+
+// arm (re)starts the countdown for a user.
+func (d *deadMansSwitch) arm(userID int64, timeout time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.stopped {
+		return
+	}
+	t, ok := d.timers[userID]
+	if !ok {
+		t = &deadMansTimer{}
+		d.timers[userID] = t
+	} else {
+		t.timer.Stop()
+	}
+
+	t.gen++
+	gen := t.gen
+	t.timer = time.AfterFunc(timeout, func() {
+		d.fire(userID, gen)
+	})
+}
+
+// disarm stops the countdown for a user without triggering.
+func (d *deadMansSwitch) disarm(userID int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if t, ok := d.timers[userID]; ok {
+		t.timer.Stop()
+		delete(d.timers, userID)
+	}
+}
+
+// armed reports whether a user has a running countdown.
+func (d *deadMansSwitch) armed(userID int64) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, ok := d.timers[userID]
+	return ok
+}
+
+// trip triggers right away for an armed user, e.g. when their streaming
+// session goes away. Users that never armed the switch are left alone.
+func (d *deadMansSwitch) trip(userID int64) {
+	d.mu.Lock()
+	t, ok := d.timers[userID]
+	if ok {
+		t.timer.Stop()
+		delete(d.timers, userID)
+		d.running.Add(1)
+	}
+	d.mu.Unlock()
+
+	if ok {
+		defer d.running.Done()
+		slog.Info("dead man's switch tripped", "user_id", userID)
+		d.trigger(userID)
+	}
+}
+
+func (d *deadMansSwitch) fire(userID int64, gen uint64) {
+	d.mu.Lock()
+	t, ok := d.timers[userID]
+	if !ok || t.gen != gen {
+		d.mu.Unlock()
+		return
+	}
+	delete(d.timers, userID)
+	d.running.Add(1)
+	d.mu.Unlock()
+
+	defer d.running.Done()
+	slog.Info("dead man's switch lapsed", "user_id", userID)
+	d.trigger(userID)
+}
+
+// stop disarms every user and waits for the triggers under way, the
+// switch never fires again.
+func (d *deadMansSwitch) stop() {
+	d.mu.Lock()
+	d.stopped = true
+	for userID, t := range d.timers {
+		t.timer.Stop()
+		delete(d.timers, userID)
+	}
+	d.mu.Unlock()
+
+	d.running.Wait()
+}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+)
+
+const (
+	orderDomainName    = "crypto-exchange"
+	orderDomainVersion = "1"
+)
+
+// orderTypes are the EIP-712 types of a signed order. Amounts are decimal
+// strings, there are no floats in EIP-712.
+var orderTypes = apitypes.Types{
+	"EIP712Domain": {
+		{Name: "name", Type: "string"},
+		{Name: "version", Type: "string"},
+		{Name: "chainId", Type: "uint256"},
+	},
+	"Order": {
+		{Name: "trader", Type: "address"},
+		{Name: "market", Type: "string"},
+		{Name: "orderType", Type: "string"},
+		{Name: "bid", Type: "bool"},
+		{Name: "price", Type: "string"},
+		{Name: "size", Type: "string"},
+		{Name: "notional", Type: "string"},
+		{Name: "nonce", Type: "uint256"},
+		{Name: "expiry", Type: "uint256"},
+	},
+}
+
+// OrderMessage is the order a user signs with the key of their account.
+type OrderMessage struct {
+	// ChainID is the chain the exchange settles on, orders are signed for
+	// it so a signature never travels to another chain.
+	ChainID  int64
+	Trader   common.Address
+	Market   Market
+	Type     OrderType
+	Bid      bool
+	Price    float64
+	Size     float64
+	Notional float64
+	// Nonce makes otherwise equal orders sign differently, a signature
+	// is only ever accepted once.
+	Nonce uint64
+	// Expiry in unix seconds, zero never expires.
+	Expiry int64
+}
+
+// newOrderMessage is the message the user of the request must have signed.
+func newOrderMessage(chainID int64, trader common.Address, req *PlaceOrderRequest) *OrderMessage {
+	return &OrderMessage{
+		ChainID:  chainID,
+		Trader:   trader,
+		Market:   req.Market,
+		Type:     req.Type,
+		Bid:      req.Bid,
+		Price:    req.Price,
+		Size:     req.Size,
+		Notional: req.Notional,
+		Nonce:    req.Nonce,
+		Expiry:   req.Expiry,
+	}
+}
+
+func formatAmount(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// TypedData is the EIP-712 representation of the order, this is what
+// wallets display and sign.
+func (m *OrderMessage) TypedData() apitypes.TypedData {
+	return apitypes.TypedData{
+		Types:       orderTypes,
+		PrimaryType: "Order",
+		Domain: apitypes.TypedDataDomain{
+			Name:    orderDomainName,
+			Version: orderDomainVersion,
+			ChainId: math.NewHexOrDecimal256(m.ChainID),
+		},
+		Message: apitypes.TypedDataMessage{
+			"trader":    m.Trader.Hex(),
+			"market":    string(m.Market),
+			"orderType": string(m.Type),
+			"bid":       m.Bid,
+			"price":     formatAmount(m.Price),
+			"size":      formatAmount(m.Size),
+			"notional":  formatAmount(m.Notional),
+			"nonce":     new(big.Int).SetUint64(m.Nonce),
+			"expiry":    big.NewInt(m.Expiry),
+		},
+	}
+}
+
+// Hash is the EIP-712 digest that gets signed.
+func (m *OrderMessage) Hash() (common.Hash, error) {
+	hash, _, err := apitypes.TypedDataAndHash(m.TypedData())
+	if err != nil {
+		return common.Hash{}, err
+	}
+
+	return common.BytesToHash(hash), nil
+}
+
+// SignOrder signs the order with the key of the trader. The signature is
+// hex encoded with v being 27 or 28, like eth_signTypedData returns it.
+func SignOrder(pk *ecdsa.PrivateKey, m *OrderMessage) (string, error) {
+	hash, err := m.Hash()
+	if err != nil {
+		return "", err
+	}
+
+	sig, err := crypto.Sign(hash.Bytes(), pk)
+	if err != nil {
+		return "", err
+	}
+	sig[crypto.RecoveryIDOffset] += 27
+
+	return hexutil.Encode(sig), nil
+}
+
+// RecoverOrderSigner returns the address that signed the order.
+func RecoverOrderSigner(m *OrderMessage, signature string) (common.Address, error) {
+	sig, err := hexutil.Decode(signature)
+	if err != nil {
+		return common.Address{}, fmt.Errorf("invalid signature: %w", err)
+	}
+	if len(sig) != crypto.SignatureLength {
+		return common.Address{}, fmt.Errorf("invalid signature length %d", len(sig))
+	}
+	if sig[crypto.RecoveryIDOffset] >= 27 {
+		sig[crypto.RecoveryIDOffset] -= 27
+	}
+
+	hash, err := m.Hash()
+	if err != nil {
+		return common.Address{}, err
+	}
+
+	pub, err := crypto.SigToPub(hash.Bytes(), sig)
+	if err != nil {
+		return common.Address{}, err
+	}
+
+	return crypto.PubkeyToAddress(*pub), nil
+}
+
+// SignedOrder is the proof that a trader asked for an order, anyone can
+// check it with Verify without trusting the exchange.
+type SignedOrder struct {
+	OrderID   int64
+	Message   *OrderMessage
+	Hash      common.Hash
+	Signature string
+}
+
+// Verify checks that the signature was made by the trader of the order.
+func (s *SignedOrder) Verify() error {
+	signer, err := RecoverOrderSigner(s.Message, s.Signature)
+	if err != nil {
+		return err
+	}
+	if signer != s.Message.Trader {
+		return fmt.Errorf("order signed by %s, not by the trader %s", signer, s.Message.Trader)
+	}
+
+	return nil
+}
+
+// verifyOrder checks the signature of an order request against the key
+// of the user placing it.
+func verifyOrder(chainID int64, user *User, req *PlaceOrderRequest) (*SignedOrder, error) {
+	if req.Signature == "" {
+		return nil, fmt.Errorf("order signature is required")
+	}
+	if req.Expiry != 0 && time.Now().Unix() > req.Expiry {
+		return nil, fmt.Errorf("signed order expired")
+	}
+
+	signed := &SignedOrder{
+		Message:   newOrderMessage(chainID, user.Address(), req),
+		Signature: req.Signature,
+	}
+	if err := signed.Verify(); err != nil {
+		return nil, err
+	}
+
+	hash, err := signed.Message.Hash()
+	if err != nil {
+		return nil, err
+	}
+	signed.Hash = hash
+
+	return signed, nil
+}
+
+// signedOrderStore keeps every signed order the exchange accepted.
+type signedOrderStore struct {
+	mu     sync.RWMutex
+	byID   map[int64]*SignedOrder
+	byHash map[common.Hash]int64
+}
+
+func newSignedOrderStore() *signedOrderStore {
+	return &signedOrderStore{
+		byID:   make(map[int64]*SignedOrder),
+		byHash: make(map[common.Hash]int64),
+	}
+}
+
+// add fails if the very same signed order was submitted before.
+func (s *signedOrderStore) add(order *SignedOrder) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id, ok := s.byHash[order.Hash]; ok {
+		return fmt.Errorf("signed order already submitted as order %d", id)
+	}
+	s.byID[order.OrderID] = order
+	s.byHash[order.Hash] = order.OrderID
+
+	return nil
+}
+
+func (s *signedOrderStore) get(orderID int64) (*SignedOrder, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	order, ok := s.byID[orderID]
+	return order, ok
+}
+
+func (s *signedOrderStore) list() []*SignedOrder {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	orders := make([]*SignedOrder, 0, len(s.byID))
+	for _, order := range s.byID {
+		orders = append(orders, order)
+	}
+	sort.Slice(orders, func(i, j int) bool {
+		return orders[i].OrderID < orders[j].OrderID
+	})
+
+	return orders
+}
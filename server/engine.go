@@ -0,0 +1,455 @@
+package server
+
+import (
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Baazaouihamza/crypto-exchange/orderbook"
+)
+
+// maxBatch caps the commands run between two views.
+const maxBatch = 64
+
+// Finished orders stay queryable for orderRetention, up to
+// maxFinishedOrders per market.
+const (
+	orderRetention    = 24 * time.Hour
+	maxFinishedOrders = 100_000
+)
+
+// FinishedOrder is an order that left the book, as kept in snapshots.
+type FinishedOrder struct {
+	OrderStatusResponse
+	FinishedAt int64
+}
+
+type finishedEntry struct {
+	id int64
+	at time.Time
+}
+
+// command is a unit of work executed by an engine against its book.
+type command struct {
+	fn   func(ob *orderbook.Orderbook)
+	done chan struct{}
+}
+
+// engine owns the Orderbook of a single market and runs every command
+// against it, publishing a BookView after each batch.
+type engine struct {
+	market Market
+	// makerFee and takerFee are the fee rates of the market.
+	makerFee float64
+	takerFee float64
+	ob       *orderbook.Orderbook
+	cmds     chan command
+	view     atomic.Pointer[BookView]
+	// mu guards stopped against the senders of cmds, exited is closed
+	// once the engine goroutine returned.
+	mu      sync.RWMutex
+	stopped bool
+	exited  chan struct{}
+	// orders holds the resting and recently finished orders, finished
+	// queues the latter oldest first.
+	orders      map[int64]*orderbook.Order
+	finished    []finishedEntry
+	retention   time.Duration
+	maxFinished int
+	// trades keeps the trades of the market once they left the book.
+	trades  *tradeStore
+	candles *candleStore
+	ticker  tickerStats
+
+	// hub receives the events of this market, it may be nil.
+	hub *streamHub
+	// seq numbers the published views so book deltas can be ordered.
+	seq uint64
+	// orders and fills of the current batch, flushed on publish
+	updatedOrders []*orderbook.Order
+	fills         []Fill
+	// fillStore keeps the fills of every user, it may be nil.
+	fillStore *fillStore
+}
+
+func newEngine(cfg MarketConfig, ob *orderbook.Orderbook, hub *streamHub, fills *fillStore, trades *tradeStore) *engine {
+	e := &engine{
+		market:      cfg.Symbol,
+		makerFee:    cfg.MakerFee,
+		takerFee:    cfg.TakerFee,
+		ob:          ob,
+		hub:         hub,
+		fillStore:   fills,
+		trades:      trades,
+		candles:     newCandleStore(cfg.Symbol),
+		cmds:        make(chan command, 128),
+		exited:      make(chan struct{}),
+		orders:      make(map[int64]*orderbook.Order),
+		retention:   orderRetention,
+		maxFinished: maxFinishedOrders,
+	}
+	for id, order := range ob.Orders {
+		e.orders[id] = order
+	}
+	ob.BumpTradeSeq(trades.last())
+	if err := e.backfillCandles(); err != nil {
+		slog.Error("backfilling candles", "market", e.market, "error", err)
+	}
+	e.publish()
+	go e.run()
+
+	return e
+}
+
+func (e *engine) run() {
+	defer close(e.exited)
+
+	// republish so the 24h statistics slide while the market is quiet
+	refresh := time.NewTicker(tickerBucketSize)
+	defer refresh.Stop()
+
+	batch := make([]command, 0, maxBatch)
+
+	for {
+		var cmd command
+		select {
+		case <-refresh.C:
+			e.publish()
+			continue
+		case c, ok := <-e.cmds:
+			if !ok {
+				return
+			}
+			cmd = c
+		}
+
+		batch = append(batch[:0], cmd)
+	drain:
+		for len(batch) < maxBatch {
+			select {
+			case cmd, ok := <-e.cmds:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, cmd)
+			default:
+				break drain
+			}
+		}
+
+		for _, cmd := range batch {
+			cmd.fn(e.ob)
+		}
+		e.publish()
+
+		// only release the callers once the view reflects their commands
+		for _, cmd := range batch {
+			close(cmd.done)
+		}
+	}
+}
+
+func (e *engine) publish() {
+	trades := e.ob.TakeTrades()
+	for _, trade := range trades {
+		e.ticker.add(trade)
+	}
+	if err := e.trades.add(trades); err != nil {
+		slog.Error("archiving trades", "market", e.market, "error", err)
+	}
+	candles := e.candles.add(trades)
+
+	e.seq++
+	prev := e.view.Load()
+	view := newBookView(e.market, e.ob)
+	view.Seq = e.seq
+	view.Ticker = e.ticker.ticker(e.market, time.Now())
+	view.Ticker.BestBid = view.BestBid
+	view.Ticker.BestAsk = view.BestAsk
+
+	e.view.Store(view)
+	if e.fillStore != nil && len(e.fills) > 0 {
+		e.fillStore.add(e.fills)
+	}
+	e.finishOrders(time.Now())
+	e.emit(prev, view, trades, candles)
+}
+
+// finishOrders queues the orders that left the book and expires old ones.
+func (e *engine) finishOrders(now time.Time) {
+	// an order can be updated more than once per batch
+	seen := make(map[int64]bool)
+	for _, order := range e.updatedOrders {
+		if order.Status.IsOpen() || e.orders[order.ID] != order || seen[order.ID] {
+			continue
+		}
+		seen[order.ID] = true
+		e.finished = append(e.finished, finishedEntry{id: order.ID, at: now})
+	}
+
+	expired := 0
+	for expired < len(e.finished) &&
+		(len(e.finished)-expired > e.maxFinished || now.Sub(e.finished[expired].at) > e.retention) {
+		delete(e.orders, e.finished[expired].id)
+		expired++
+	}
+	e.finished = e.finished[expired:]
+}
+
+// finishedOrders returns the kept finished orders, from the engine
+// goroutine or while it is paused.
+func (e *engine) finishedOrders() []FinishedOrder {
+	orders := make([]FinishedOrder, 0, len(e.finished))
+	for _, entry := range e.finished {
+		orders = append(orders, FinishedOrder{
+			OrderStatusResponse: newOrderStatus(e.market, e.orders[entry.id]),
+			FinishedAt:          entry.at.UnixNano(),
+		})
+	}
+
+	return orders
+}
+
+// restoreFinished brings back finishedOrders, from the engine goroutine.
+func (e *engine) restoreFinished(orders []FinishedOrder) {
+	e.finished = e.finished[:0]
+	for _, order := range orders {
+		e.orders[order.ID] = &orderbook.Order{
+			ID:           order.ID,
+			UserID:       order.UserID,
+			Size:         order.RemainingSize,
+			OriginalSize: order.OriginalSize,
+			FilledSize:   order.FilledSize,
+			AvgFillPrice: order.AvgFillPrice,
+			Price:        order.Price,
+			Bid:          order.Bid,
+			Timestamp:    order.Timestamp,
+			Status:       order.Status,
+			Reason:       order.Reason,
+		}
+		e.finished = append(e.finished, finishedEntry{id: order.ID, at: time.Unix(0, order.FinishedAt)})
+	}
+}
+
+// emit pushes what changed since the previous view to the stream hub.
+func (e *engine) emit(prev, view *BookView, trades []*orderbook.Trade, candles []Candle) {
+	defer func() {
+		e.updatedOrders = e.updatedOrders[:0]
+		e.fills = e.fills[:0]
+	}()
+
+	if e.hub == nil {
+		return
+	}
+
+	key := channelKey(ChannelTrades, e.market)
+	if len(trades) > 0 && e.hub.hasSubscribers(key) {
+		e.hub.publish(key, StreamMessage{Type: ChannelTrades, Channel: ChannelTrades, Market: e.market, Data: trades})
+	}
+
+	key = channelKey(ChannelBook, e.market)
+	if prev != nil && e.hub.hasSubscribers(key) {
+		delta := BookUpdate{
+			Bids: depthDelta(prev.BidDepth, view.BidDepth),
+			Asks: depthDelta(prev.AskDepth, view.AskDepth),
+		}
+		if len(delta.Bids) > 0 || len(delta.Asks) > 0 {
+			e.hub.publish(key, StreamMessage{Type: ChannelBook, Channel: ChannelBook, Market: e.market, Seq: view.Seq, Data: delta})
+		}
+	}
+
+	for _, candle := range candles {
+		key := candleChannelKey(e.market, candle.Interval)
+		if e.hub.hasSubscribers(key) {
+			e.hub.publish(key, StreamMessage{Type: ChannelCandles, Channel: ChannelCandles, Market: e.market, Data: candle})
+		}
+	}
+
+	key = channelKey(ChannelTicker, e.market)
+	if e.hub.hasSubscribers(key) {
+		e.hub.publish(key, StreamMessage{Type: ChannelTicker, Channel: ChannelTicker, Market: e.market, Data: view.Ticker})
+	}
+
+	seen := make(map[int64]bool, len(e.updatedOrders))
+	for _, order := range e.updatedOrders {
+		if seen[order.ID] {
+			continue
+		}
+		seen[order.ID] = true
+
+		key := userChannelKey(ChannelOrders, order.UserID)
+		if e.hub.hasSubscribers(key) {
+			e.hub.publish(key, StreamMessage{Type: ChannelOrders, Channel: ChannelOrders, Market: e.market, Data: newOrderStatus(e.market, order)})
+		}
+	}
+
+	for _, fill := range e.fills {
+		key := userChannelKey(ChannelFills, fill.UserID)
+		if e.hub.hasSubscribers(key) {
+			e.hub.publish(key, StreamMessage{Type: ChannelFills, Channel: ChannelFills, Market: e.market, Data: fill})
+		}
+	}
+}
+
+// depthDelta returns the levels of next that differ from prev, plus a
+// zero sized level for every price that disappeared.
+func depthDelta(prev, next []Level) []Level {
+	prevSizes := make(map[float64]float64, len(prev))
+	for _, level := range prev {
+		prevSizes[level.Price] = level.Size
+	}
+
+	delta := []Level{}
+	for _, level := range next {
+		if size, ok := prevSizes[level.Price]; !ok || size != level.Size {
+			delta = append(delta, level)
+		}
+		delete(prevSizes, level.Price)
+	}
+	for price := range prevSizes {
+		delta = append(delta, Level{Price: price})
+	}
+
+	return delta
+}
+
+// orderUpdated queues a private update for the owner of the order.
+func (e *engine) orderUpdated(order *orderbook.Order) {
+	e.updatedOrders = append(e.updatedOrders, order)
+}
+
+// matched queues the fills and order updates of a market order.
+func (e *engine) matched(taker *orderbook.Order, matches []orderbook.Match) {
+	now := time.Now().UnixNano()
+
+	for _, match := range matches {
+		maker := match.Bid
+		if taker.Bid {
+			maker = match.Ask
+		}
+
+		quote := match.Price * match.SizeFilled
+		e.fills = append(e.fills, Fill{
+			OrderID:   maker.ID,
+			UserID:    maker.UserID,
+			Market:    e.market,
+			Bid:       maker.Bid,
+			Price:     match.Price,
+			Size:      match.SizeFilled,
+			Quote:     quote,
+			Fee:       quote * e.makerFee,
+			Liquidity: LiquidityMaker,
+			Timestamp: now,
+		}, Fill{
+			OrderID:   taker.ID,
+			UserID:    taker.UserID,
+			Market:    e.market,
+			Bid:       taker.Bid,
+			Price:     match.Price,
+			Size:      match.SizeFilled,
+			Quote:     quote,
+			Fee:       quote * e.takerFee,
+			Liquidity: LiquidityTaker,
+			Timestamp: now,
+		})
+		e.orderUpdated(maker)
+	}
+	e.orderUpdated(taker)
+}
+
+// submit queues fn, it fails once the engine stopped.
+func (e *engine) submit(fn func(ob *orderbook.Orderbook)) (chan struct{}, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.stopped {
+		return nil, false
+	}
+	cmd := command{
+		fn:   fn,
+		done: make(chan struct{}),
+	}
+	e.cmds <- cmd
+
+	return cmd.done, true
+}
+
+// do runs fn on the engine goroutine and waits for the resulting view
+// to be published. Once the engine stopped fn is dropped.
+func (e *engine) do(fn func(ob *orderbook.Orderbook)) {
+	done, ok := e.submit(fn)
+	if !ok {
+		slog.Error("engine stopped, command dropped", "market", e.market)
+		return
+	}
+	<-done
+}
+
+// stop runs the queued commands and ends the engine goroutine.
+func (e *engine) stop() {
+	e.mu.Lock()
+	if !e.stopped {
+		e.stopped = true
+		close(e.cmds)
+	}
+	e.mu.Unlock()
+
+	<-e.exited
+}
+
+// pause holds the engine, its earlier commands published, until resume
+// is called. The engine's state may be read meanwhile, or for good once
+// it stopped.
+func (e *engine) pause() (resume func()) {
+	paused := make(chan struct{})
+	release := make(chan struct{})
+	_, ok := e.submit(func(*orderbook.Orderbook) {
+		e.publish()
+		close(paused)
+		<-release
+	})
+	if !ok {
+		// nothing runs anymore
+		<-e.exited
+		return func() {}
+	}
+	<-paused
+
+	return func() { close(release) }
+}
+
+// track records an order in the market's order history.
+func (e *engine) track(order *orderbook.Order) {
+	e.orders[order.ID] = order
+}
+
+// currentView returns the latest published view of the book.
+func (e *engine) currentView() *BookView {
+	return e.view.Load()
+}
+
+// replace swaps the book, recent trades and finished orders on restore.
+func (e *engine) replace(ob *orderbook.Orderbook, trades []orderbook.Trade, finished []FinishedOrder) error {
+	var err error
+	e.do(func(*orderbook.Orderbook) {
+		if err = e.trades.restore(trades); err != nil {
+			return
+		}
+		e.ob = ob
+		e.orders = make(map[int64]*orderbook.Order, len(ob.Orders)+len(finished))
+		e.restoreFinished(finished)
+		for id, order := range ob.Orders {
+			e.orders[id] = order
+		}
+		ob.BumpTradeSeq(e.trades.last())
+
+		e.ticker = tickerStats{}
+		for _, trade := range e.trades.recent() {
+			e.ticker.add(&trade)
+		}
+		err = e.backfillCandles()
+	})
+
+	return err
+}
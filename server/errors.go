@@ -0,0 +1,118 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ErrorCode tells clients what went wrong without parsing messages.
+type ErrorCode string
+
+const (
+	// ErrCodeBadRequest is a request that cannot be decoded at all.
+	ErrCodeBadRequest ErrorCode = "BAD_REQUEST"
+	// ErrCodeValidation is a well formed request with invalid values,
+	// like a price off the tick size.
+	ErrCodeValidation            ErrorCode = "VALIDATION_FAILED"
+	ErrCodeUnauthorized          ErrorCode = "UNAUTHORIZED"
+	ErrCodeForbidden             ErrorCode = "FORBIDDEN"
+	ErrCodeNotFound              ErrorCode = "NOT_FOUND"
+	ErrCodeUnknownMarket         ErrorCode = "UNKNOWN_MARKET"
+	ErrCodeMarketNotTrading      ErrorCode = "MARKET_NOT_TRADING"
+	ErrCodeUnknownOrder          ErrorCode = "UNKNOWN_ORDER"
+	ErrCodeDuplicateOrder        ErrorCode = "DUPLICATE_ORDER"
+	ErrCodeInsufficientLiquidity ErrorCode = "INSUFFICIENT_LIQUIDITY"
+	ErrCodeInsufficientFunds     ErrorCode = "INSUFFICIENT_FUNDS"
+	ErrCodeSettlementFailed      ErrorCode = "SETTLEMENT_FAILED"
+	ErrCodeRateLimited           ErrorCode = "RATE_LIMITED"
+	ErrCodeShuttingDown          ErrorCode = "SHUTTING_DOWN"
+	ErrCodeInternal              ErrorCode = "INTERNAL"
+)
+
+// APIError is the body of every non-2xx response. Handlers return it as
+// an error and httpErrorHandler writes it.
+type APIError struct {
+	// Status is the HTTP status, it is not part of the body.
+	Status  int `json:"-"`
+	Code    ErrorCode
+	Message string
+	Details map[string]any `json:",omitempty"`
+	// RequestID identifies the request in the server logs.
+	RequestID string `json:",omitempty"`
+}
+
+func newAPIError(status int, code ErrorCode, format string, args ...any) *APIError {
+	return &APIError{
+		Status:  status,
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// withDetails adds context a client can act on, like the ID of a
+// rejected order.
+func (e *APIError) withDetails(details map[string]any) *APIError {
+	e.Details = details
+	return e
+}
+
+// codeOfStatus is the code of the errors echo raises itself, like
+// unknown routes.
+func codeOfStatus(status int) ErrorCode {
+	switch status {
+	case http.StatusBadRequest:
+		return ErrCodeBadRequest
+	case http.StatusUnauthorized:
+		return ErrCodeUnauthorized
+	case http.StatusForbidden:
+		return ErrCodeForbidden
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		return ErrCodeNotFound
+	case http.StatusTooManyRequests:
+		return ErrCodeRateLimited
+	case http.StatusServiceUnavailable:
+		return ErrCodeShuttingDown
+	default:
+		return ErrCodeInternal
+	}
+}
+
+// httpErrorHandler writes every error as an APIError, other errors are
+// logged and answered with a generic internal error.
+func httpErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+
+	var (
+		apiErr  *APIError
+		httpErr *echo.HTTPError
+	)
+	switch {
+	case errors.As(err, &apiErr):
+	case errors.As(err, &httpErr):
+		apiErr = newAPIError(httpErr.Code, codeOfStatus(httpErr.Code), "%v", httpErr.Message)
+	default:
+		requestLogger(c).Error("request failed", "method", c.Request().Method, "path", c.Request().URL.Path, "error", err)
+		apiErr = newAPIError(http.StatusInternalServerError, ErrCodeInternal, "internal server error")
+	}
+
+	resp := *apiErr
+	resp.RequestID = c.Response().Header().Get(echo.HeaderXRequestID)
+
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(resp.Status)
+	} else {
+		err = c.JSON(resp.Status, resp)
+	}
+	if err != nil {
+		requestLogger(c).Error("writing error response", "error", err)
+	}
+}
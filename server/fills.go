@@ -0,0 +1,599 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+type Liquidity string
+
+const (
+	LiquidityMaker Liquidity = "MAKER"
+	LiquidityTaker Liquidity = "TAKER"
+)
+
+const (
+	// fillRingSize is how many recent fills are kept in memory, older
+	// ones go to the archive.
+	fillRingSize = 10_000
+
+	defaultFillsLimit = 100
+	maxFillsLimit     = 1000
+
+	// fillRecordSize is nine 8 byte fields and the padded market.
+	fillRecordSize = 9*8 + maxSymbolLength
+
+	fillBid   = 1
+	fillTaker = 2
+)
+
+// Fill is one side of a match as seen by the user that owns the order.
+type Fill struct {
+	// ID grows with every fill across all markets, it is the cursor of
+	// the fills history.
+	ID      int64
+	OrderID int64
+	UserID  int64
+	Market  Market
+	Bid     bool
+	Price   float64
+	Size    float64
+	// Quote is Price * Size, Fee is charged on it in the quote asset.
+	Quote     float64
+	Fee       float64
+	Liquidity Liquidity
+	Timestamp int64
+}
+
+// fillArchive keeps the fills that left the ring in an append only file
+// per user. Appends are serialized by its store, scans may run alongside
+// them, they only read the records complete when the file was opened.
+type fillArchive struct {
+	dir string
+}
+
+func (a *fillArchive) path(userID int64) string {
+	return filepath.Join(a.dir, fmt.Sprintf("%d.fills", userID))
+}
+
+// open opens the archive of a user and returns how many fills it holds.
+// A record torn by a crash mid-write is not counted.
+func (a *fillArchive) open(userID int64, flag int) (*os.File, int, error) {
+	f, err := os.OpenFile(a.path(userID), flag, 0o644)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+
+	return f, int(info.Size() / fillRecordSize), nil
+}
+
+func (a *fillArchive) append(userID int64, fills []Fill) error {
+	f, n, err := a.open(userID, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	b := make([]byte, 0, len(fills)*fillRecordSize)
+	for _, fill := range fills {
+		var flags uint64
+		if fill.Bid {
+			flags |= fillBid
+		}
+		if fill.Liquidity == LiquidityTaker {
+			flags |= fillTaker
+		}
+		b = binary.LittleEndian.AppendUint64(b, uint64(fill.ID))
+		b = binary.LittleEndian.AppendUint64(b, uint64(fill.OrderID))
+		b = binary.LittleEndian.AppendUint64(b, uint64(fill.UserID))
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(fill.Price))
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(fill.Size))
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(fill.Quote))
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(fill.Fee))
+		b = binary.LittleEndian.AppendUint64(b, uint64(fill.Timestamp))
+		b = binary.LittleEndian.AppendUint64(b, flags)
+		var market [maxSymbolLength]byte
+		copy(market[:], fill.Market)
+		b = append(b, market[:]...)
+	}
+	// written over a torn record, if any
+	if _, err := f.WriteAt(b, int64(n)*fillRecordSize); err != nil {
+		return err
+	}
+
+	return f.Truncate(int64(n+len(fills)) * fillRecordSize)
+}
+
+func readFill(f *os.File, i int) (Fill, error) {
+	b := make([]byte, fillRecordSize)
+	if _, err := f.ReadAt(b, int64(i)*fillRecordSize); err != nil {
+		return Fill{}, err
+	}
+
+	flags := binary.LittleEndian.Uint64(b[64:])
+	fill := Fill{
+		ID:        int64(binary.LittleEndian.Uint64(b[0:])),
+		OrderID:   int64(binary.LittleEndian.Uint64(b[8:])),
+		UserID:    int64(binary.LittleEndian.Uint64(b[16:])),
+		Price:     math.Float64frombits(binary.LittleEndian.Uint64(b[24:])),
+		Size:      math.Float64frombits(binary.LittleEndian.Uint64(b[32:])),
+		Quote:     math.Float64frombits(binary.LittleEndian.Uint64(b[40:])),
+		Fee:       math.Float64frombits(binary.LittleEndian.Uint64(b[48:])),
+		Timestamp: int64(binary.LittleEndian.Uint64(b[56:])),
+		Market:    Market(bytes.TrimRight(b[72:], "\x00")),
+		Bid:       flags&fillBid != 0,
+		Liquidity: LiquidityMaker,
+	}
+	if flags&fillTaker != 0 {
+		fill.Liquidity = LiquidityTaker
+	}
+
+	return fill, nil
+}
+
+// scan calls fn with the archived fills of a user below ID before, or
+// all of them when zero, newest first, until fn returns false.
+func (a *fillArchive) scan(userID, before int64, fn func(Fill) bool) error {
+	f, n, err := a.open(userID, os.O_RDONLY)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	end := n
+	if before != 0 {
+		end = sort.Search(n, func(i int) bool {
+			fill, readErr := readFill(f, i)
+			if readErr != nil {
+				err = readErr
+				return true
+			}
+			return fill.ID >= before
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for i := end - 1; i >= 0; i-- {
+		fill, err := readFill(f, i)
+		if err != nil {
+			return err
+		}
+		if !fn(fill) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// lastID is the ID of the last archived fill of a user.
+func (a *fillArchive) lastID(userID int64) (int64, error) {
+	var last int64
+	err := a.scan(userID, 0, func(fill Fill) bool {
+		last = fill.ID
+		return false
+	})
+
+	return last, err
+}
+
+// maxID is the highest ID of the archive, across users.
+func (a *fillArchive) maxID() (int64, error) {
+	paths, err := filepath.Glob(filepath.Join(a.dir, "*.fills"))
+	if err != nil {
+		return 0, err
+	}
+
+	var maxID int64
+	for _, path := range paths {
+		userID, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(path), ".fills"), 10, 64)
+		if err != nil {
+			continue
+		}
+		last, err := a.lastID(userID)
+		if err != nil {
+			return 0, err
+		}
+		maxID = max(maxID, last)
+	}
+
+	return maxID, nil
+}
+
+// fillStore keeps the fills of every user: the recent ones in a ring,
+// ordered by ID, the older ones in the archive.
+type fillStore struct {
+	mu     sync.RWMutex
+	lastID int64
+	ring   ring[Fill]
+	// pending left the ring and wait for the writer, ordered by ID.
+	pending []Fill
+	// archive is nil when fills leaving the ring are dropped.
+	archive *fillArchive
+	// writeMu serializes the archive appends, they happen outside of mu
+	// so the engines never wait on the disk.
+	writeMu sync.Mutex
+	kick    chan struct{}
+	closed  bool
+	writer  chan struct{}
+}
+
+func newFillStore(size int) *fillStore {
+	return &fillStore{ring: newRing[Fill](size)}
+}
+
+// add numbers the fills and stores them. The IDs are written back so the
+// streamed fills carry them too.
+func (s *fillStore) add(fills []Fill) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	evicted := false
+	for i := range fills {
+		s.lastID++
+		fills[i].ID = s.lastID
+		if old, ok := s.ring.push(fills[i]); ok && s.archive != nil {
+			s.pending = append(s.pending, old)
+			evicted = true
+		}
+	}
+	if evicted && !s.closed {
+		select {
+		case s.kick <- struct{}{}:
+		default:
+			// the writer is behind, it picks these up too
+		}
+	}
+}
+
+// write appends the pending fills to the archive until it is closed.
+func (s *fillStore) write() {
+	defer close(s.writer)
+
+	for range s.kick {
+		if err := s.flush(); err != nil {
+			slog.Error("archiving fills", "error", err)
+		}
+	}
+}
+
+// flush archives the pending fills. They stay pending until written, a
+// failed write is tried again with the next ones.
+func (s *fillStore) flush() error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	s.mu.RLock()
+	batch := append([]Fill(nil), s.pending...)
+	s.mu.RUnlock()
+
+	if err := s.archiveFills(batch); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.pending = append([]Fill(nil), s.pending[len(batch):]...)
+	s.mu.Unlock()
+
+	return nil
+}
+
+// close stops the writer and archives what is still pending, nothing
+// may be added after.
+func (s *fillStore) close() error {
+	s.mu.Lock()
+	kick := s.kick
+	if s.closed || kick == nil {
+		s.closed = true
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(kick)
+	s.mu.Unlock()
+
+	<-s.writer
+
+	return s.flush()
+}
+
+// archiveFills appends fills that left the ring to the archive of their
+// users.
+func (s *fillStore) archiveFills(fills []Fill) error {
+	if s.archive == nil || len(fills) == 0 {
+		return nil
+	}
+
+	byUser := make(map[int64][]Fill)
+	for _, fill := range fills {
+		byUser[fill.UserID] = append(byUser[fill.UserID], fill)
+	}
+	var errs []error
+	for userID, userFills := range byUser {
+		if err := s.archive.append(userID, userFills); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// setArchive moves the fills leaving the ring to the archive in dir,
+// from now on.
+func (s *fillStore) setArchive(dir string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	archive := &fillArchive{dir: dir}
+	archived, err := archive.maxID()
+	if err != nil {
+		return err
+	}
+	s.archive = archive
+	s.lastID = max(s.lastID, archived)
+	if s.kick == nil {
+		s.kick = make(chan struct{}, 1)
+		s.writer = make(chan struct{})
+		go s.write()
+	}
+
+	return nil
+}
+
+// recent returns the fills not archived yet, ordered by ID.
+func (s *fillStore) recent() []Fill {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	fills := make([]Fill, 0, len(s.pending)+s.ring.len())
+	fills = append(fills, s.pending...)
+	for i := 0; i < s.ring.len(); i++ {
+		fills = append(fills, *s.ring.at(i))
+	}
+
+	return fills
+}
+
+// restore refills the ring from a snapshot, skipping fills already
+// archived and archiving those that do not fit.
+func (s *fillStore) restore(fills []Fill) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ring = newRing[Fill](cap(s.ring.items))
+	s.pending = nil
+	s.lastID = 0
+	if s.archive != nil {
+		archived, err := s.archive.maxID()
+		if err != nil {
+			return err
+		}
+		s.lastID = archived
+	}
+
+	archived := make(map[int64]int64)
+	var evicted []Fill
+	for _, fill := range fills {
+		last, ok := archived[fill.UserID]
+		if !ok && s.archive != nil {
+			var err error
+			if last, err = s.archive.lastID(fill.UserID); err != nil {
+				return err
+			}
+			archived[fill.UserID] = last
+		}
+		if fill.ID <= last {
+			continue
+		}
+		if old, ok := s.ring.push(fill); ok {
+			evicted = append(evicted, old)
+		}
+		s.lastID = max(s.lastID, fill.ID)
+	}
+
+	return s.archiveFills(evicted)
+}
+
+// FillsQuery filters the fills of a user. Zero values do not filter.
+type FillsQuery struct {
+	Market Market
+	// Since and Until bound the fill timestamps, in unix nanoseconds,
+	// Until is exclusive.
+	Since int64
+	Until int64
+	// Cursor returns the fills older than the fill with that ID.
+	Cursor int64
+	Limit  int
+}
+
+func (q FillsQuery) matches(fill *Fill) bool {
+	if q.Market != "" && fill.Market != q.Market {
+		return false
+	}
+	if q.Since != 0 && fill.Timestamp < q.Since {
+		return false
+	}
+	if q.Until != 0 && fill.Timestamp >= q.Until {
+		return false
+	}
+
+	return true
+}
+
+type FillsResponse struct {
+	// Fills are ordered newest first.
+	Fills []Fill
+	// NextCursor fetches the next page, it is zero on the last page.
+	NextCursor int64 `json:",omitempty"`
+}
+
+// query pages through the fills of a user, newest first: the ring
+// first, then the pending fills and the archive.
+func (s *fillStore) query(userID int64, q FillsQuery) (FillsResponse, error) {
+	resp := FillsResponse{Fills: []Fill{}}
+	// collect returns false once the page is full
+	collect := func(fill Fill) bool {
+		if fill.UserID != userID || !q.matches(&fill) {
+			return true
+		}
+		if len(resp.Fills) == q.Limit {
+			resp.NextCursor = resp.Fills[len(resp.Fills)-1].ID
+			return false
+		}
+		resp.Fills = append(resp.Fills, fill)
+		return true
+	}
+
+	// the archive is scanned without the lock, from below the oldest
+	// fill held in memory
+	var (
+		full    bool
+		pending []Fill
+		before  = q.Cursor
+		archive *fillArchive
+	)
+	func() {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+
+		end := s.ring.len()
+		if q.Cursor != 0 {
+			end = sort.Search(end, func(i int) bool { return s.ring.at(i).ID >= q.Cursor })
+		}
+		for i := end - 1; i >= 0; i-- {
+			if !collect(*s.ring.at(i)) {
+				full = true
+				return
+			}
+		}
+
+		archive = s.archive
+		pending = append(pending, s.pending...)
+		oldest := int64(0)
+		if len(pending) > 0 {
+			oldest = pending[0].ID
+		} else if s.ring.len() > 0 {
+			oldest = s.ring.at(0).ID
+		}
+		if oldest != 0 && (before == 0 || oldest < before) {
+			before = oldest
+		}
+	}()
+	if full || archive == nil {
+		return resp, nil
+	}
+
+	for i := len(pending) - 1; i >= 0; i-- {
+		if q.Cursor != 0 && pending[i].ID >= q.Cursor {
+			continue
+		}
+		if !collect(pending[i]) {
+			return resp, nil
+		}
+	}
+	if err := archive.scan(userID, before, collect); err != nil {
+		return FillsResponse{}, err
+	}
+
+	return resp, nil
+}
+
+// SetFillArchive keeps older fills in dir. It must be called before
+// RestoreSnapshot.
+func (ex *Exchange) SetFillArchive(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	return ex.fills.setArchive(dir)
+}
+
+// handleGetFills returns the fills of the acting user. The query takes
+// market, since and until in unix milliseconds, cursor and limit.
+func (ex *Exchange) handleGetFills(c echo.Context) error {
+	q := FillsQuery{
+		Market: Market(c.QueryParam("market")),
+	}
+
+	for name, dst := range map[string]*int64{"since": &q.Since, "until": &q.Until, "cursor": &q.Cursor} {
+		if err := queryInt64(c, name, dst); err != nil {
+			return err
+		}
+	}
+	// the query is in milliseconds, fills are stamped in nanoseconds
+	q.Since *= 1e6
+	q.Until *= 1e6
+
+	limit, err := queryLimit(c, defaultFillsLimit, maxFillsLimit)
+	if err != nil {
+		return err
+	}
+	q.Limit = limit
+
+	if q.Market != "" {
+		if _, ok := ex.engine(q.Market); !ok {
+			return newAPIError(http.StatusBadRequest, ErrCodeUnknownMarket, "market %s not found", q.Market)
+		}
+	}
+
+	fills, err := ex.fills.query(actingUser(c), q)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, fills)
+}
+
+// queryInt64 parses the non-negative integer query param name into dst,
+// leaving dst alone when the param is missing.
+func queryInt64(c echo.Context, name string, dst *int64) error {
+	v := c.QueryParam(name)
+	if v == "" {
+		return nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return newAPIError(http.StatusBadRequest, ErrCodeValidation, "invalid %s %q", name, v)
+	}
+	*dst = n
+
+	return nil
+}
+
+// queryLimit parses the limit query param, def when it is missing.
+func queryLimit(c echo.Context, def, maxLimit int) (int, error) {
+	v := c.QueryParam("limit")
+	if v == "" {
+		return def, nil
+	}
+	limit, err := strconv.Atoi(v)
+	if err != nil || limit < 1 || limit > maxLimit {
+		return 0, newAPIError(http.StatusBadRequest, ErrCodeValidation, "limit must be between 1 and %d", maxLimit)
+	}
+
+	return limit, nil
+}
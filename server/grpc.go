@@ -0,0 +1,545 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Baazaouihamza/crypto-exchange/orderbook"
+	"github.com/Baazaouihamza/crypto-exchange/rpc"
+	"github.com/labstack/echo/v4"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// RPCAuthMethod takes the place of the HTTP method when signing gRPC
+	// requests, the full method name the one of the path.
+	RPCAuthMethod = "RPC"
+
+	// RPCErrorDomain is the domain of the ErrorInfo of gRPC errors, their
+	// reason is the ErrorCode.
+	RPCErrorDomain = "exchange"
+)
+
+// rpcMethod is how a gRPC method is charged and whether it acts for a
+// user.
+type rpcMethod struct {
+	budget  budget
+	private bool
+}
+
+var rpcMethods = map[string]rpcMethod{
+	rpc.Exchange_PlaceOrder_FullMethodName:      {budget: budgetOrders, private: true},
+	rpc.Exchange_CancelOrder_FullMethodName:     {budget: budgetCancels, private: true},
+	rpc.Exchange_GetOrder_FullMethodName:        {budget: budgetReads, private: true},
+	rpc.Exchange_GetBook_FullMethodName:         {budget: budgetReads},
+	rpc.Exchange_SubscribeTrades_FullMethodName: {budget: budgetReads},
+	rpc.Exchange_SubscribeBook_FullMethodName:   {budget: budgetReads},
+}
+
+type rpcUserKey struct{}
+
+// rpcUser is the user authenticated for a private gRPC call.
+func rpcUser(ctx context.Context) int64 {
+	userID, _ := ctx.Value(rpcUserKey{}).(int64)
+	return userID
+}
+
+// SignRPC signs the unary calls of a gRPC client with an API key, see
+// Sign. The body is the request marshalled deterministically.
+func SignRPC(apiKey, secret string) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		msg, ok := req.(proto.Message)
+		if !ok {
+			return fmt.Errorf("cannot sign a %T", req)
+		}
+		body, err := proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		nonce := hex.EncodeToString(b)
+		timestamp := time.Now().UnixMilli()
+
+		ctx = metadata.AppendToOutgoingContext(ctx,
+			HeaderAPIKey, apiKey,
+			HeaderAPITimestamp, strconv.FormatInt(timestamp, 10),
+			HeaderAPINonce, nonce,
+			HeaderAPISignature, Sign(secret, timestamp, nonce, RPCAuthMethod, method, body),
+		)
+
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// NewGRPCServer returns the gRPC server of the exchange, it serves the
+// same core as the HTTP API. Shutdown stops it.
+func (ex *Exchange) NewGRPCServer() *grpc.Server {
+	srv := grpc.NewServer(
+		grpc.UnaryInterceptor(ex.interceptUnary),
+		grpc.StreamInterceptor(ex.interceptStream),
+	)
+	rpc.RegisterExchangeServer(srv, &rpcServer{ex: ex})
+	ex.grpcServer = srv
+
+	return srv
+}
+
+func (ex *Exchange) interceptUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	var resp any
+	err := ex.serveRPC(ctx, info.FullMethod, req, func(ctx context.Context) error {
+		var err error
+		resp, err = handler(ctx, req)
+		return err
+	})
+
+	return resp, err
+}
+
+func (ex *Exchange) interceptStream(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return ex.serveRPC(stream.Context(), info.FullMethod, nil, func(ctx context.Context) error {
+		return handler(srv, &rpcStream{ServerStream: stream, ctx: ctx})
+	})
+}
+
+// rpcStream hands the context of serveRPC to stream handlers.
+type rpcStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *rpcStream) Context() context.Context {
+	return s.ctx
+}
+
+// serveRPC does for gRPC calls what the middleware does for HTTP
+// requests.
+func (ex *Exchange) serveRPC(ctx context.Context, fullMethod string, req any, call func(context.Context) error) error {
+	start := time.Now()
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	// metadata keys are lower case, Get and Pairs lower the header names
+	id := first(md.Get(echo.HeaderXRequestID))
+	if id == "" {
+		b := make([]byte, 16)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+	grpc.SetHeader(ctx, metadata.Pairs(echo.HeaderXRequestID, id))
+	ctx = withAttrs(ctx, "request_id", id)
+
+	ctx, err := ex.authorizeRPC(ctx, fullMethod, md, req)
+	if err == nil {
+		err = call(ctx)
+	}
+	err = rpcError(ctx, err)
+
+	code := status.Code(err)
+	level := slog.LevelDebug
+	switch code {
+	case codes.OK:
+	case codes.Internal, codes.Unknown, codes.DataLoss:
+		level = slog.LevelError
+	default:
+		level = slog.LevelInfo
+	}
+	loggerFrom(ctx).Log(ctx, level, "rpc", "method", fullMethod, "code", code, "duration", time.Since(start))
+	ex.metrics.rpcDuration.WithLabelValues(fullMethod, code.String()).Observe(time.Since(start).Seconds())
+
+	return err
+}
+
+// authorizeRPC authenticates the private calls, binding the returned
+// context to their user, and charges every call to its budget.
+func (ex *Exchange) authorizeRPC(ctx context.Context, fullMethod string, md metadata.MD, req any) (context.Context, error) {
+	method, ok := rpcMethods[fullMethod]
+	if !ok {
+		return ctx, status.Errorf(codes.Unimplemented, "unknown method %s", fullMethod)
+	}
+
+	// the address pays before the signature is checked
+	var ip string
+	if p, ok := peer.FromContext(ctx); ok {
+		ip = p.Addr.String()
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+	}
+	if ok, limit := ex.limiter.chargeIP(method.budget, ip); !ok {
+		return ctx, rateLimited(method.budget, limit)
+	}
+	if !method.private {
+		return ctx, nil
+	}
+
+	msg, ok := req.(proto.Message)
+	if !ok {
+		return ctx, fmt.Errorf("cannot authenticate a %T", req)
+	}
+	body, err := proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+	if err != nil {
+		return ctx, err
+	}
+	timestamp, err := strconv.ParseInt(first(md.Get(HeaderAPITimestamp)), 10, 64)
+	if err != nil {
+		return ctx, newAPIError(http.StatusUnauthorized, ErrCodeUnauthorized, "invalid timestamp")
+	}
+
+	userID, err := ex.auth.verify(
+		first(md.Get(HeaderAPIKey)),
+		timestamp,
+		first(md.Get(HeaderAPINonce)),
+		first(md.Get(HeaderAPISignature)),
+		RPCAuthMethod,
+		fullMethod,
+		body,
+	)
+	if err != nil {
+		return ctx, newAPIError(http.StatusUnauthorized, ErrCodeUnauthorized, "%v", err)
+	}
+	if ex.userDisabled(userID) {
+		return ctx, newAPIError(http.StatusForbidden, ErrCodeForbidden, "user %d is disabled", userID)
+	}
+
+	if ok, limit := ex.limiter.chargeUser(method.budget, userID); !ok {
+		return ctx, rateLimited(method.budget, limit)
+	}
+	ctx = context.WithValue(ctx, rpcUserKey{}, userID)
+	ctx = withAttrs(ctx, "user_id", userID)
+
+	return ctx, nil
+}
+
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+
+	return values[0]
+}
+
+// rpcCodes maps the error codes of the API to gRPC codes.
+var rpcCodes = map[ErrorCode]codes.Code{
+	ErrCodeBadRequest:            codes.InvalidArgument,
+	ErrCodeValidation:            codes.InvalidArgument,
+	ErrCodeUnauthorized:          codes.Unauthenticated,
+	ErrCodeForbidden:             codes.PermissionDenied,
+	ErrCodeNotFound:              codes.NotFound,
+	ErrCodeUnknownMarket:         codes.NotFound,
+	ErrCodeUnknownOrder:          codes.NotFound,
+	ErrCodeMarketNotTrading:      codes.FailedPrecondition,
+	ErrCodeDuplicateOrder:        codes.AlreadyExists,
+	ErrCodeInsufficientLiquidity: codes.FailedPrecondition,
+	ErrCodeInsufficientFunds:     codes.FailedPrecondition,
+	ErrCodeSettlementFailed:      codes.Internal,
+	ErrCodeRateLimited:           codes.ResourceExhausted,
+	ErrCodeShuttingDown:          codes.Unavailable,
+	ErrCodeInternal:              codes.Internal,
+}
+
+// rpcError turns an error into a gRPC status, an APIError keeps its code
+// and details in an ErrorInfo.
+func rpcError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return status.FromContextError(err).Err()
+		}
+		loggerFrom(ctx).Error("rpc failed", "error", err)
+		apiErr = newAPIError(http.StatusInternalServerError, ErrCodeInternal, "internal server error")
+	}
+
+	code, ok := rpcCodes[apiErr.Code]
+	if !ok {
+		code = codes.Internal
+	}
+	info := &errdetails.ErrorInfo{
+		Reason:   string(apiErr.Code),
+		Domain:   RPCErrorDomain,
+		Metadata: make(map[string]string, len(apiErr.Details)),
+	}
+	for key, value := range apiErr.Details {
+		info.Metadata[key] = fmt.Sprint(value)
+	}
+
+	st, detailsErr := status.New(code, apiErr.Message).WithDetails(info)
+	if detailsErr != nil {
+		return status.Error(code, apiErr.Message)
+	}
+
+	return st.Err()
+}
+
+// rpcServer implements the gRPC API on top of the Exchange, the handlers
+// only translate messages.
+type rpcServer struct {
+	rpc.UnimplementedExchangeServer
+	ex *Exchange
+}
+
+func (s *rpcServer) PlaceOrder(ctx context.Context, req *rpc.PlaceOrderRequest) (*rpc.PlaceOrderResponse, error) {
+	if !s.ex.orderGate.enter() {
+		return nil, newAPIError(http.StatusServiceUnavailable, ErrCodeShuttingDown, "the exchange is shutting down")
+	}
+	defer s.ex.orderGate.leave()
+
+	order := &PlaceOrderRequest{
+		UserID:        rpcUser(ctx),
+		Type:          OrderType(req.Type),
+		Bid:           req.Bid,
+		Size:          req.Size,
+		Notional:      req.Notional,
+		Price:         req.Price,
+		Market:        Market(req.Market),
+		ClientOrderID: req.ClientOrderId,
+		Nonce:         req.Nonce,
+		Expiry:        req.Expiry,
+		Signature:     req.Signature,
+	}
+	resp, err := s.ex.submitOrder(ctx, order, func(ratio float64) {
+		grpc.SetHeader(ctx, metadata.Pairs(HeaderOrderTradeRatio, strconv.FormatFloat(ratio, 'f', 2, 64)))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &rpc.PlaceOrderResponse{
+		OrderId:       resp.OrderID,
+		ClientOrderId: resp.ClientOrderID,
+		Status:        string(resp.Status),
+		Reason:        string(resp.Reason),
+		BaseFilled:    resp.BaseFilled,
+		QuoteFilled:   resp.QuoteFilled,
+	}, nil
+}
+
+// orderID resolves the order a request names, by ID or by client order
+// ID.
+func (s *rpcServer) orderID(ctx context.Context, id int64, clientOrderID string) (int64, error) {
+	if clientOrderID == "" {
+		if id <= 0 {
+			return 0, newAPIError(http.StatusBadRequest, ErrCodeValidation, "order id or client order id is required")
+		}
+		return id, nil
+	}
+
+	id, ok := s.ex.clientOrders.orderID(rpcUser(ctx), clientOrderID)
+	if !ok {
+		return 0, newAPIError(http.StatusNotFound, ErrCodeUnknownOrder, "client order %s not found", clientOrderID)
+	}
+
+	return id, nil
+}
+
+func (s *rpcServer) CancelOrder(ctx context.Context, req *rpc.CancelOrderRequest) (*rpc.CancelOrderResponse, error) {
+	id, err := s.orderID(ctx, req.OrderId, req.ClientOrderId)
+	if err != nil {
+		return nil, err
+	}
+	market, err := s.ex.cancelUserOrder(ctx, rpcUser(ctx), id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rpc.CancelOrderResponse{OrderId: id, Market: string(market)}, nil
+}
+
+func (s *rpcServer) GetOrder(ctx context.Context, req *rpc.GetOrderRequest) (*rpc.OrderStatus, error) {
+	id, err := s.orderID(ctx, req.OrderId, req.ClientOrderId)
+	if err != nil {
+		return nil, err
+	}
+	order, err := s.ex.orderStatus(rpcUser(ctx), id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rpc.OrderStatus{
+		Id:            order.ID,
+		ClientOrderId: order.ClientOrderID,
+		UserId:        order.UserID,
+		Market:        string(order.Market),
+		Bid:           order.Bid,
+		Price:         order.Price,
+		Status:        string(order.Status),
+		Reason:        string(order.Reason),
+		OriginalSize:  order.OriginalSize,
+		RemainingSize: order.RemainingSize,
+		FilledSize:    order.FilledSize,
+		AvgFillPrice:  order.AvgFillPrice,
+		Timestamp:     order.Timestamp,
+	}, nil
+}
+
+func (s *rpcServer) GetBook(ctx context.Context, req *rpc.GetBookRequest) (*rpc.Book, error) {
+	eng, err := s.engine(req.Market)
+	if err != nil {
+		return nil, err
+	}
+	view := eng.currentView()
+
+	return &rpc.Book{
+		Market:         string(view.Market),
+		Seq:            view.Seq,
+		TotalBidVolume: view.Book.TotalBidVolume,
+		TotalAskVolume: view.Book.TotalAskVolume,
+		Asks:           rpcOrders(view.Book.Asks),
+		Bids:           rpcOrders(view.Book.Bids),
+	}, nil
+}
+
+func rpcOrders(orders []*Order) []*rpc.Order {
+	out := make([]*rpc.Order, len(orders))
+	for i, order := range orders {
+		out[i] = &rpc.Order{
+			Id:        order.ID,
+			UserId:    order.UserID,
+			Price:     order.Price,
+			Size:      order.Size,
+			Bid:       order.Bid,
+			Timestamp: order.Timestamp,
+		}
+	}
+
+	return out
+}
+
+func rpcLevels(levels []Level) []*rpc.Level {
+	out := make([]*rpc.Level, len(levels))
+	for i, level := range levels {
+		out[i] = &rpc.Level{Price: level.Price, Size: level.Size}
+	}
+
+	return out
+}
+
+func (s *rpcServer) engine(market string) (*engine, error) {
+	eng, ok := s.ex.engine(Market(market))
+	if !ok {
+		return nil, newAPIError(http.StatusNotFound, ErrCodeUnknownMarket, "market %s not found", market)
+	}
+
+	return eng, nil
+}
+
+func (s *rpcServer) SubscribeTrades(req *rpc.SubscribeTradesRequest, stream grpc.ServerStreamingServer[rpc.Trade]) error {
+	if _, err := s.engine(req.Market); err != nil {
+		return err
+	}
+
+	f, err := s.subscribe(channelKey(ChannelTrades, Market(req.Market)))
+	if err != nil {
+		return err
+	}
+	defer s.ex.stream.unsubscribeFeed(channelKey(ChannelTrades, Market(req.Market)), f)
+
+	return s.follow(stream.Context(), f, func(msg StreamMessage) error {
+		for _, trade := range msg.Data.([]*orderbook.Trade) {
+			err := stream.Send(&rpc.Trade{
+				Market:    req.Market,
+				Id:        trade.ID,
+				Price:     trade.Price,
+				Size:      trade.Size,
+				Bid:       trade.Bid,
+				Timestamp: trade.TimeStamp,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SubscribeBook sends the depth of the current view, then the deltas
+// published after it.
+func (s *rpcServer) SubscribeBook(req *rpc.SubscribeBookRequest, stream grpc.ServerStreamingServer[rpc.BookUpdate]) error {
+	eng, err := s.engine(req.Market)
+	if err != nil {
+		return err
+	}
+
+	f, err := s.subscribe(channelKey(ChannelBook, Market(req.Market)))
+	if err != nil {
+		return err
+	}
+	defer s.ex.stream.unsubscribeFeed(channelKey(ChannelBook, Market(req.Market)), f)
+
+	view := eng.currentView()
+	err = stream.Send(&rpc.BookUpdate{
+		Market:   req.Market,
+		Seq:      view.Seq,
+		Snapshot: true,
+		Bids:     rpcLevels(view.BidDepth),
+		Asks:     rpcLevels(view.AskDepth),
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.follow(stream.Context(), f, func(msg StreamMessage) error {
+		if msg.Seq <= view.Seq {
+			return nil
+		}
+		delta := msg.Data.(BookUpdate)
+		return stream.Send(&rpc.BookUpdate{
+			Market: req.Market,
+			Seq:    msg.Seq,
+			Bids:   rpcLevels(delta.Bids),
+			Asks:   rpcLevels(delta.Asks),
+		})
+	})
+}
+
+// subscribe adds a feed to the channel key. Once the exchange is shutting
+// down no feed is added, closeAll may have run already.
+func (s *rpcServer) subscribe(key string) (*feed, error) {
+	f := newFeed()
+	s.ex.stream.subscribeFeed(key, f)
+	if s.ex.closing.Load() {
+		s.ex.stream.unsubscribeFeed(key, f)
+		return nil, newAPIError(http.StatusServiceUnavailable, ErrCodeShuttingDown, "the exchange is shutting down")
+	}
+
+	return f, nil
+}
+
+// follow sends the messages of f until the client hangs up or the feed
+// is closed.
+func (s *rpcServer) follow(ctx context.Context, f *feed, send func(StreamMessage) error) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-f.closed:
+			return status.Error(codes.Unavailable, f.reason)
+		case msg := <-f.msgs:
+			if err := send(msg); err != nil {
+				return err
+			}
+		}
+	}
+}
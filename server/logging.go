@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type loggerKey struct{}
+
+// withLogger returns a context carrying logger.
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// loggerFrom returns the logger of ctx, the default one if it has none.
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+
+	return slog.Default()
+}
+
+// withAttrs adds attributes to the logger of ctx.
+func withAttrs(ctx context.Context, args ...any) context.Context {
+	return withLogger(ctx, loggerFrom(ctx).With(args...))
+}
+
+// requestLogger is the logger of the request being served.
+func requestLogger(c echo.Context) *slog.Logger {
+	return loggerFrom(c.Request().Context())
+}
+
+// setRequestAttrs adds attributes to the logger of the request being
+// served.
+func setRequestAttrs(c echo.Context, args ...any) {
+	req := c.Request()
+	c.SetRequest(req.WithContext(withAttrs(req.Context(), args...)))
+}
+
+// requestID tags every request and its logs with an ID, the caller's if
+// they sent one, and echoes it in the response.
+func requestID(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id := c.Request().Header.Get(echo.HeaderXRequestID)
+		if id == "" {
+			b := make([]byte, 16)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		c.Response().Header().Set(echo.HeaderXRequestID, id)
+		setRequestAttrs(c, "request_id", id)
+
+		return next(c)
+	}
+}
+
+// logRequests logs every request once it is answered. Errors are handled
+// here so the status they end up with is known.
+func logRequests(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		if err := next(c); err != nil {
+			c.Error(err)
+		}
+
+		status := c.Response().Status
+		level := slog.LevelDebug
+		switch {
+		case status >= http.StatusInternalServerError:
+			level = slog.LevelError
+		case status >= http.StatusBadRequest:
+			level = slog.LevelInfo
+		}
+
+		args := []any{
+			"method", c.Request().Method,
+			"path", c.Request().URL.Path,
+			"status", status,
+			"duration", time.Since(start),
+		}
+		// the logger of the request holds the user once authenticated
+		requestLogger(c).Log(c.Request().Context(), level, "request", args...)
+
+		return nil
+	}
+}
+
+// NewLogger builds the logger the configuration asks for, writing to w.
+func (cfg *Config) NewLogger(w io.Writer) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: cfg.LogLevel}
+	if cfg.LogFormat == LogFormatJSON {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+
+	return slog.New(slog.NewTextHandler(w, opts))
+}
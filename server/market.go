@@ -0,0 +1,338 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/Baazaouihamza/crypto-exchange/orderbook"
+)
+
+type MarketStatus string
+
+const (
+	MarketActive MarketStatus = "ACTIVE"
+	// MarketHalted freezes the book: no orders, no cancels by users.
+	MarketHalted MarketStatus = "HALTED"
+	// MarketCloseOnly lets users pull their orders but not place new ones.
+	MarketCloseOnly MarketStatus = "CLOSE_ONLY"
+	MarketDelisted  MarketStatus = "DELISTED"
+)
+
+type MarketConfig struct {
+	Symbol     Market
+	BaseAsset  string
+	QuoteAsset string
+	// TickSize and LotSize constrain prices and sizes to multiples of
+	// them, zero means unconstrained.
+	TickSize float64
+	LotSize  float64
+	// MakerFee and TakerFee are charged on the quote amount of a fill,
+	// 0.001 is 10 basis points.
+	MakerFee float64 `json:",omitempty"`
+	TakerFee float64 `json:",omitempty"`
+	// Decimals is how many decimals the base asset has on chain, fills
+	// are settled in its smallest unit. Zero means DefaultDecimals.
+	Decimals int `json:",omitempty"`
+	Status   MarketStatus
+}
+
+// DefaultDecimals are the decimals of ETH, fills settle in wei.
+const DefaultDecimals = 18
+
+// DefaultMarkets is used when no market configuration is found.
+func DefaultMarkets() []MarketConfig {
+	return []MarketConfig{
+		{
+			Symbol:     MarketEth,
+			BaseAsset:  "ETH",
+			QuoteAsset: "USD",
+			TickSize:   0.01,
+			LotSize:    0.0001,
+			MakerFee:   0.001,
+			TakerFee:   0.002,
+			Decimals:   DefaultDecimals,
+			Status:     MarketActive,
+		},
+	}
+}
+
+// LoadMarkets reads the market configuration from a JSON file holding a
+// list of MarketConfig. A missing file yields DefaultMarkets.
+func LoadMarkets(path string) ([]MarketConfig, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return DefaultMarkets(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var markets []MarketConfig
+	if err := json.Unmarshal(b, &markets); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	return markets, nil
+}
+
+// maxSymbolLength bounds market symbols so they fit the fill archive.
+const maxSymbolLength = 16
+
+func (cfg MarketConfig) Validate() error {
+	if cfg.Symbol == "" {
+		return fmt.Errorf("market symbol is required")
+	}
+	if len(cfg.Symbol) > maxSymbolLength {
+		return fmt.Errorf("market %s: symbol is longer than %d bytes", cfg.Symbol, maxSymbolLength)
+	}
+	if cfg.BaseAsset == "" || cfg.QuoteAsset == "" {
+		return fmt.Errorf("market %s: base and quote asset are required", cfg.Symbol)
+	}
+	if cfg.TickSize < 0 || cfg.LotSize < 0 {
+		return fmt.Errorf("market %s: tick and lot size must not be negative", cfg.Symbol)
+	}
+	if cfg.MakerFee < 0 || cfg.TakerFee < 0 {
+		return fmt.Errorf("market %s: fees must not be negative", cfg.Symbol)
+	}
+	if cfg.Decimals < 0 || cfg.Decimals > 36 {
+		return fmt.Errorf("market %s: decimals must be between 0 and 36", cfg.Symbol)
+	}
+	switch cfg.Status {
+	case MarketActive, MarketHalted, MarketCloseOnly, MarketDelisted:
+	default:
+		return fmt.Errorf("market %s: unknown status %q", cfg.Symbol, cfg.Status)
+	}
+
+	return nil
+}
+
+// multipleOf reports whether v is a multiple of step, within float rounding.
+func multipleOf(v, step float64) bool {
+	if step == 0 {
+		return true
+	}
+	n := v / step
+	return math.Abs(n-math.Round(n)) < 1e-9*math.Max(1, math.Abs(n))
+}
+
+// baseUnits converts a size to the smallest unit of the base asset, what
+// settlement transfers. What is left below one unit is dropped.
+func (cfg MarketConfig) baseUnits(size float64) *big.Int {
+	decimals := cfg.Decimals
+	if decimals == 0 {
+		decimals = DefaultDecimals
+	}
+	// sizes computed from a notional carry float rounding, 15 significant
+	// digits is what a float64 holds exactly
+	amount, _ := new(big.Float).SetPrec(256).SetString(strconv.FormatFloat(size, 'g', 15, 64))
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals)), nil)
+	units, _ := amount.Mul(amount, new(big.Float).SetInt(scale)).Int(nil)
+
+	return units
+}
+
+// validateOrder checks an order request against the market rules.
+func (cfg MarketConfig) validateOrder(req *PlaceOrderRequest) error {
+	// NaN fails every comparison, so the checks are written to refuse it
+	if !(req.Notional >= 0) || math.IsInf(req.Notional, 1) {
+		return fmt.Errorf("notional must not be negative")
+	}
+	if req.Notional > 0 && req.Type == LimitOrder {
+		return fmt.Errorf("notional is only valid for market orders")
+	}
+	if req.Notional > 0 && req.Size != 0 {
+		return fmt.Errorf("size and notional cannot be both set")
+	}
+	if req.Type == LimitOrder {
+		if !(req.Price > 0) || math.IsInf(req.Price, 1) {
+			return fmt.Errorf("price must be positive")
+		}
+		if !multipleOf(req.Price, cfg.TickSize) {
+			return fmt.Errorf("price %v is not a multiple of the tick size %v", req.Price, cfg.TickSize)
+		}
+	}
+	// a notional order gets its size from the book
+	if req.Notional > 0 {
+		return nil
+	}
+	if !(req.Size > 0) || math.IsInf(req.Size, 1) {
+		return fmt.Errorf("size must be positive")
+	}
+	if !multipleOf(req.Size, cfg.LotSize) {
+		return fmt.Errorf("size %v is not a multiple of the lot size %v", req.Size, cfg.LotSize)
+	}
+
+	return nil
+}
+
+type market struct {
+	config MarketConfig
+	engine *engine
+}
+
+// marketRegistry holds every market the exchange knows about, delisted
+// ones included.
+type marketRegistry struct {
+	mu      sync.RWMutex
+	markets map[Market]*market
+	hub     *streamHub
+	fills   *fillStore
+	// archiveDir holds the trade archives, empty when there are none.
+	archiveDir string
+}
+
+func newMarketRegistry(hub *streamHub, fills *fillStore) *marketRegistry {
+	return &marketRegistry{
+		markets: make(map[Market]*market),
+		hub:     hub,
+		fills:   fills,
+	}
+}
+
+// add lists a new market and starts its engine.
+func (r *marketRegistry) add(cfg MarketConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.markets[cfg.Symbol]; ok {
+		return fmt.Errorf("market %s already exists", cfg.Symbol)
+	}
+	trades := newTradeStore(tradeRingSize)
+	if r.archiveDir != "" {
+		archive, err := openTradeArchive(tradeArchivePath(r.archiveDir, cfg.Symbol))
+		if err != nil {
+			return err
+		}
+		if err := trades.setArchive(archive); err != nil {
+			archive.Close()
+			return err
+		}
+	}
+	r.markets[cfg.Symbol] = &market{
+		config: cfg,
+		engine: newEngine(cfg, orderbook.NewOrderbook(), r.hub, r.fills, trades),
+	}
+
+	return nil
+}
+
+// setArchiveDir opens the trade archive of every market in dir, markets
+// added later get theirs on add.
+func (r *marketRegistry) setArchiveDir(dir string) error {
+	// engines are not called with the lock held, their commands may
+	// need it
+	r.mu.Lock()
+	r.archiveDir = dir
+	engines := make(map[Market]*engine, len(r.markets))
+	for symbol, m := range r.markets {
+		engines[symbol] = m.engine
+	}
+	r.mu.Unlock()
+
+	for symbol, eng := range engines {
+		archive, err := openTradeArchive(tradeArchivePath(dir, symbol))
+		if err != nil {
+			return err
+		}
+		if err := eng.setTradeArchive(archive); err != nil {
+			archive.Close()
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *marketRegistry) get(symbol Market) (*market, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	m, ok := r.markets[symbol]
+	return m, ok
+}
+
+func (r *marketRegistry) config(symbol Market) (MarketConfig, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	m, ok := r.markets[symbol]
+	if !ok {
+		return MarketConfig{}, false
+	}
+	return m.config, true
+}
+
+func (r *marketRegistry) setStatus(symbol Market, status MarketStatus) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m, ok := r.markets[symbol]
+	if !ok {
+		return fmt.Errorf("market %s not found", symbol)
+	}
+	cfg := m.config
+	cfg.Status = status
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	m.config = cfg
+
+	return nil
+}
+
+// list returns the configuration of every market ordered by symbol.
+func (r *marketRegistry) list() []MarketConfig {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	configs := make([]MarketConfig, 0, len(r.markets))
+	for _, m := range r.markets {
+		configs = append(configs, m.config)
+	}
+	sort.Slice(configs, func(i, j int) bool { return configs[i].Symbol < configs[j].Symbol })
+
+	return configs
+}
+
+// engines returns the engine of every market, listed or not.
+func (r *marketRegistry) engines() map[Market]*engine {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	engines := make(map[Market]*engine, len(r.markets))
+	for symbol, m := range r.markets {
+		engines[symbol] = m.engine
+	}
+
+	return engines
+}
+
+// stopEngines stops the engine of every market.
+func (r *marketRegistry) stopEngines() {
+	for _, eng := range r.engines() {
+		eng.stop()
+	}
+}
+
+// closeArchives closes the trade archive of every market.
+func (r *marketRegistry) closeArchives() error {
+	var errs []error
+	for _, eng := range r.engines() {
+		if err := eng.trades.closeArchive(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
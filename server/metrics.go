@@ -0,0 +1,181 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	// durationBuckets fit requests and settlements, in seconds.
+	durationBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	// matchBuckets fit the matching engine, from a microsecond up.
+	matchBuckets = []float64{1e-6, 2.5e-6, 5e-6, 1e-5, 2.5e-5, 5e-5, 1e-4, 2.5e-4, 5e-4, 1e-3, 5e-3, 1e-2}
+)
+
+// exchangeMetrics are the metrics the exchange records as it runs. Every
+// exchange has its own registry.
+type exchangeMetrics struct {
+	registry        *prometheus.Registry
+	orders          *prometheus.CounterVec
+	orderDuration   *prometheus.HistogramVec
+	matchDuration   *prometheus.HistogramVec
+	httpDuration    *prometheus.HistogramVec
+	rpcDuration     *prometheus.HistogramVec
+	settlements     *prometheus.CounterVec
+	settlementDelay *prometheus.HistogramVec
+}
+
+func newExchangeMetrics() *exchangeMetrics {
+	m := &exchangeMetrics{
+		registry: prometheus.NewRegistry(),
+		orders: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "exchange_orders_total",
+			Help: "Orders by market, type and outcome: placed, cancelled or rejected.",
+		}, []string{"market", "type", "outcome"}),
+		orderDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "exchange_order_duration_seconds",
+			Help:    "Time to place an order, settlement included, by market, type and outcome.",
+			Buckets: durationBuckets,
+		}, []string{"market", "type", "outcome"}),
+		matchDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "exchange_match_duration_seconds",
+			Help:    "Time the order book spends matching an order, by market and type.",
+			Buckets: matchBuckets,
+		}, []string{"market", "type"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "exchange_http_request_duration_seconds",
+			Help:    "Duration of HTTP requests by method, route and status.",
+			Buckets: durationBuckets,
+		}, []string{"method", "route", "status"}),
+		rpcDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "exchange_grpc_request_duration_seconds",
+			Help:    "Duration of gRPC calls by method and code.",
+			Buckets: durationBuckets,
+		}, []string{"method", "code"}),
+		settlements: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "exchange_settlements_total",
+			Help: "Settlement transactions by outcome.",
+		}, []string{"outcome"}),
+		settlementDelay: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "exchange_settlement_duration_seconds",
+			Help:    "Time to send a settlement transaction by outcome.",
+			Buckets: durationBuckets,
+		}, []string{"outcome"}),
+	}
+	m.registry.MustRegister(
+		m.orders, m.orderDuration, m.matchDuration, m.httpDuration, m.rpcDuration, m.settlements, m.settlementDelay,
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		collectors.NewGoCollector(),
+	)
+
+	return m
+}
+
+const (
+	orderPlaced    = "placed"
+	orderCancelled = "cancelled"
+	orderRejected  = "rejected"
+)
+
+// orderDone records the outcome of an order submission started at start.
+func (m *exchangeMetrics) orderDone(market Market, orderType OrderType, outcome string, start time.Time) {
+	m.orders.WithLabelValues(string(market), string(orderType), outcome).Inc()
+	m.orderDuration.WithLabelValues(string(market), string(orderType), outcome).Observe(time.Since(start).Seconds())
+}
+
+// matched records how long the book took to match an order started at
+// start.
+func (m *exchangeMetrics) matched(market Market, orderType OrderType, start time.Time) {
+	m.matchDuration.WithLabelValues(string(market), string(orderType)).Observe(time.Since(start).Seconds())
+}
+
+// ordersCancelled counts cancelled orders. Only limit orders rest in a
+// book, so only they can be cancelled.
+func (m *exchangeMetrics) ordersCancelled(market Market, n int) {
+	if n > 0 {
+		m.orders.WithLabelValues(string(market), string(LimitOrder), orderCancelled).Add(float64(n))
+	}
+}
+
+// Settlement outcomes, one for every step of transferETH that can fail.
+const (
+	settlementSent              = "sent"
+	settlementNonceFailed       = "nonce_failed"
+	settlementGasPriceFailed    = "gas_price_failed"
+	settlementSigningFailed     = "signing_failed"
+	settlementInsufficientFunds = "insufficient_funds"
+	settlementSendFailed        = "send_failed"
+)
+
+func (m *exchangeMetrics) settled(outcome string, start time.Time) {
+	if m == nil {
+		return
+	}
+	m.settlements.WithLabelValues(outcome).Inc()
+	m.settlementDelay.WithLabelValues(outcome).Observe(time.Since(start).Seconds())
+}
+
+var (
+	bookDepthDesc  = prometheus.NewDesc("exchange_book_depth", "Resting size by market and side.", []string{"market", "side"}, nil)
+	bookLevelsDesc = prometheus.NewDesc("exchange_book_levels", "Price levels by market and side.", []string{"market", "side"}, nil)
+	bookSpreadDesc = prometheus.NewDesc("exchange_book_spread", "Best ask minus best bid, for markets with both sides.", []string{"market"}, nil)
+)
+
+// bookCollector reads the depth and spread of every market from its
+// current view when the metrics are scraped.
+type bookCollector struct {
+	ex *Exchange
+}
+
+func (c bookCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- bookDepthDesc
+	ch <- bookLevelsDesc
+	ch <- bookSpreadDesc
+}
+
+func (c bookCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, eng := range c.ex.markets.engines() {
+		view := eng.currentView()
+		market := string(view.Market)
+
+		ch <- prometheus.MustNewConstMetric(bookDepthDesc, prometheus.GaugeValue, view.Book.TotalBidVolume, market, "bid")
+		ch <- prometheus.MustNewConstMetric(bookDepthDesc, prometheus.GaugeValue, view.Book.TotalAskVolume, market, "ask")
+		ch <- prometheus.MustNewConstMetric(bookLevelsDesc, prometheus.GaugeValue, float64(len(view.BidDepth)), market, "bid")
+		ch <- prometheus.MustNewConstMetric(bookLevelsDesc, prometheus.GaugeValue, float64(len(view.AskDepth)), market, "ask")
+		if view.BestBid != nil && view.BestAsk != nil {
+			ch <- prometheus.MustNewConstMetric(bookSpreadDesc, prometheus.GaugeValue, view.BestAsk.Price-view.BestBid.Price, market)
+		}
+	}
+}
+
+// instrument times every request by route. Errors are handled here so the
+// status they end up with is known.
+func (ex *Exchange) instrument(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		if err := next(c); err != nil {
+			c.Error(err)
+		}
+
+		// unknown routes all count as one, their paths are unbounded
+		route := c.Path()
+		if route == "" || c.Response().Status == http.StatusNotFound && route == "/*" {
+			route = "unmatched"
+		}
+		ex.metrics.httpDuration.WithLabelValues(c.Request().Method, route, strconv.Itoa(c.Response().Status)).
+			Observe(time.Since(start).Seconds())
+
+		return nil
+	}
+}
+
+// handleMetrics serves the metrics in the Prometheus format.
+func (ex *Exchange) handleMetrics() echo.HandlerFunc {
+	return echo.WrapHandler(promhttp.HandlerFor(ex.metrics.registry, promhttp.HandlerOpts{}))
+}
@@ -0,0 +1,340 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	HeaderRateLimit          = "X-RateLimit-Limit"
+	HeaderRateLimitRemaining = "X-RateLimit-Remaining"
+	HeaderRetryAfter         = "Retry-After"
+	HeaderOrderTradeRatio    = "X-Order-Trade-Ratio"
+
+	// maxBuckets is how many buckets are kept before idle ones are dropped.
+	maxBuckets = 10_000
+)
+
+// budget is what a route spends its tokens on.
+type budget string
+
+const (
+	budgetOrders  budget = "orders"
+	budgetCancels budget = "cancels"
+	budgetReads   budget = "reads"
+)
+
+// RateLimit is a token bucket: Burst requests at once, refilled with Rate
+// requests per second. A zero Rate means no limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// Budgets are the limits of one caller, one bucket per kind of request.
+type Budgets struct {
+	Orders  RateLimit
+	Cancels RateLimit
+	Reads   RateLimit
+}
+
+func (b Budgets) of(kind budget) RateLimit {
+	switch kind {
+	case budgetOrders:
+		return b.Orders
+	case budgetCancels:
+		return b.Cancels
+	default:
+		return b.Reads
+	}
+}
+
+// OrderToTradeLimit blocks users whose orders per trade exceed MaxRatio
+// after MinOrders orders within Window. A zero MaxRatio disables it.
+type OrderToTradeLimit struct {
+	MaxRatio  float64
+	MinOrders int
+	Window    time.Duration
+}
+
+type RateLimits struct {
+	// PerUser applies to every API key user.
+	PerUser Budgets
+	// PerIP applies to every client address, shared by all users behind it.
+	PerIP        Budgets
+	OrderToTrade OrderToTradeLimit
+}
+
+func DefaultRateLimits() RateLimits {
+	return RateLimits{
+		PerUser: Budgets{
+			Orders:  RateLimit{Rate: 20, Burst: 40},
+			Cancels: RateLimit{Rate: 40, Burst: 80},
+			Reads:   RateLimit{Rate: 50, Burst: 100},
+		},
+		PerIP: Budgets{
+			Orders:  RateLimit{Rate: 50, Burst: 100},
+			Cancels: RateLimit{Rate: 100, Burst: 200},
+			Reads:   RateLimit{Rate: 100, Burst: 200},
+		},
+		OrderToTrade: OrderToTradeLimit{
+			MaxRatio:  50,
+			MinOrders: 200,
+			Window:    time.Minute,
+		},
+	}
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill tops up the bucket for the time passed since the last request.
+func (b *tokenBucket) refill(limit RateLimit, now time.Time) {
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+}
+
+// wait is how long until the next token.
+func (b *tokenBucket) wait(limit RateLimit) time.Duration {
+	return time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
+
+// orderTradeWindow counts orders and trades of a user in a fixed window.
+type orderTradeWindow struct {
+	start  time.Time
+	orders int
+	trades int
+}
+
+func (w *orderTradeWindow) ratio() float64 {
+	return float64(w.orders) / math.Max(1, float64(w.trades))
+}
+
+// rateLimiter holds the buckets and order-to-trade windows of callers.
+type rateLimiter struct {
+	mu      sync.Mutex
+	limits  RateLimits
+	buckets map[string]*tokenBucket
+	windows map[int64]*orderTradeWindow
+	now     func() time.Time
+}
+
+func newRateLimiter(limits RateLimits) *rateLimiter {
+	return &rateLimiter{
+		limits:  limits,
+		buckets: make(map[string]*tokenBucket),
+		windows: make(map[int64]*orderTradeWindow),
+		now:     time.Now,
+	}
+}
+
+// limitStatus is the tightest of the buckets that were checked.
+type limitStatus struct {
+	limit      int
+	remaining  int
+	retryAfter time.Duration
+}
+
+// retryAfterSeconds is retryAfter rounded up, as told to clients.
+func (s *limitStatus) retryAfterSeconds() int {
+	return int(math.Ceil(s.retryAfter.Seconds()))
+}
+
+// allow takes a token from the bucket of every key, or from none.
+func (l *rateLimiter) allow(keys map[string]RateLimit) (bool, *limitStatus) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if len(l.buckets) > maxBuckets {
+		l.prune(now)
+	}
+
+	var status *limitStatus
+	for key, limit := range keys {
+		if limit.Rate == 0 {
+			continue
+		}
+		bucket, ok := l.buckets[key]
+		if !ok {
+			bucket = &tokenBucket{tokens: float64(limit.Burst), last: now}
+			l.buckets[key] = bucket
+		}
+		bucket.refill(limit, now)
+
+		if bucket.tokens < 1 {
+			return false, &limitStatus{limit: limit.Burst, retryAfter: bucket.wait(limit)}
+		}
+		remaining := int(bucket.tokens) - 1
+		if status == nil || remaining < status.remaining {
+			status = &limitStatus{limit: limit.Burst, remaining: remaining}
+		}
+	}
+	for key, limit := range keys {
+		if limit.Rate != 0 {
+			l.buckets[key].tokens--
+		}
+	}
+
+	return true, status
+}
+
+// chargeIP takes a token of kind from the bucket of a client address.
+func (l *rateLimiter) chargeIP(kind budget, ip string) (bool, *limitStatus) {
+	return l.allow(map[string]RateLimit{
+		fmt.Sprintf("ip:%s:%s", ip, kind): l.limits.PerIP.of(kind),
+	})
+}
+
+// chargeUser takes a token of kind from the bucket of a user.
+func (l *rateLimiter) chargeUser(kind budget, userID int64) (bool, *limitStatus) {
+	return l.allow(map[string]RateLimit{
+		fmt.Sprintf("user:%d:%s", userID, kind): l.limits.PerUser.of(kind),
+	})
+}
+
+// prune drops the buckets idle for a minute, they are full by then.
+func (l *rateLimiter) prune(now time.Time) {
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.last) > time.Minute {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (l *rateLimiter) window(userID int64, now time.Time) *orderTradeWindow {
+	w, ok := l.windows[userID]
+	if !ok || now.Sub(w.start) >= l.limits.OrderToTrade.Window {
+		w = &orderTradeWindow{start: now}
+		l.windows[userID] = w
+	}
+
+	return w
+}
+
+// placeOrder counts an order of the user, it fails over the
+// order-to-trade ratio.
+func (l *rateLimiter) placeOrder(userID int64) (float64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limit := l.limits.OrderToTrade
+	if limit.MaxRatio == 0 {
+		return 0, nil
+	}
+
+	w := l.window(userID, l.now())
+	if w.orders >= limit.MinOrders && w.ratio() > limit.MaxRatio {
+		return w.ratio(), fmt.Errorf("order to trade ratio %.1f exceeds %.1f", w.ratio(), limit.MaxRatio)
+	}
+	w.orders++
+
+	return w.ratio(), nil
+}
+
+// traded credits a trade to the user.
+func (l *rateLimiter) traded(userID int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.limits.OrderToTrade.MaxRatio == 0 {
+		return
+	}
+	l.window(userID, l.now()).trades++
+}
+
+// SetRateLimits replaces the limits before the routes serve requests.
+func (ex *Exchange) SetRateLimits(limits RateLimits) {
+	ex.limiter = newRateLimiter(limits)
+}
+
+// SetTrustedProxies takes the client address from X-Forwarded-For for
+// requests coming from cidrs.
+func (ex *Exchange) SetTrustedProxies(cidrs []string) error {
+	if len(cidrs) == 0 {
+		ex.ipExtractor = echo.ExtractIPDirect()
+		return nil
+	}
+
+	options := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		options = append(options, echo.TrustIPRange(ipNet))
+	}
+	ex.ipExtractor = echo.ExtractIPFromXFFHeader(options...)
+
+	return nil
+}
+
+// clientIP is the IP extractor of the servers of the exchange.
+func (ex *Exchange) clientIP(req *http.Request) string {
+	return ex.ipExtractor(req)
+}
+
+// limitIP charges the request to the client address, before authenticate.
+func (ex *Exchange) limitIP(kind budget) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			ok, status := ex.limiter.chargeIP(kind, c.RealIP())
+			if err := limited(c, kind, ok, status); err != nil {
+				return err
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// limitUser charges the request to the acting user, after authenticate.
+func (ex *Exchange) limitUser(kind budget) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			ok, status := ex.limiter.chargeUser(kind, actingUser(c))
+			if err := limited(c, kind, ok, status); err != nil {
+				return err
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// limited reports the tightest bucket and refuses the request once empty.
+func limited(c echo.Context, kind budget, ok bool, status *limitStatus) error {
+	header := c.Response().Header()
+	if status != nil {
+		remaining, err := strconv.Atoi(header.Get(HeaderRateLimitRemaining))
+		if err != nil || status.remaining < remaining {
+			header.Set(HeaderRateLimit, strconv.Itoa(status.limit))
+			header.Set(HeaderRateLimitRemaining, strconv.Itoa(status.remaining))
+		}
+	}
+	if !ok {
+		header.Set(HeaderRetryAfter, strconv.Itoa(status.retryAfterSeconds()))
+		return rateLimited(kind, status)
+	}
+
+	return nil
+}
+
+// rateLimited is the error of a request refused for status.
+func rateLimited(kind budget, status *limitStatus) *APIError {
+	return newAPIError(http.StatusTooManyRequests, ErrCodeRateLimited, "%s rate limit exceeded", kind).
+		withDetails(map[string]any{"RetryAfter": status.retryAfterSeconds()})
+}
@@ -5,11 +5,17 @@ import (
 	"crypto/ecdsa"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"math/big"
+	"net"
 	"net/http"
+	"os/signal"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/Baazaouihamza/crypto-exchange/orderbook"
 	"github.com/ethereum/go-ethereum/common"
@@ -17,6 +23,7 @@ import (
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/labstack/echo/v4"
+	"google.golang.org/grpc"
 )
 
 const (
@@ -25,8 +32,6 @@ const (
 	LimitOrder OrderType = "LIMIT"
 
 	MarketEth Market = "ETH"
-
-	exchangePrivateKey = "4f3edf983ac636a65a842ce7c78d9aa706d3b113bce9c46f30d7d21715b23b1d"
 )
 
 type (
@@ -39,8 +44,18 @@ type (
 		Type   OrderType // limit or market
 		Bid    bool
 		Size   float64
-		Price  float64
-		Market Market
+		// Notional places a market order for a quote amount instead of Size.
+		Notional float64
+		Price    float64
+		Market   Market
+		// ClientOrderID is chosen by the client and unique per user, a
+		// retry with the same ID returns the response of the first try.
+		ClientOrderID string `json:",omitempty"`
+		// Nonce, Expiry and Signature carry the EIP-712 signature of the
+		// order made with the key of the user, see OrderMessage.
+		Nonce     uint64 `json:",omitempty"`
+		Expiry    int64  `json:",omitempty"`
+		Signature string `json:",omitempty"`
 	}
 	Order struct {
 		UserID    int64
@@ -64,79 +79,194 @@ type (
 		Size   float64
 		ID     int64
 	}
-
-	APIError struct {
-		Error string
-	}
 )
 
-func StartServer() {
+// StartServer runs the exchange until SIGINT or SIGTERM, then shuts it
+// down gracefully.
+func StartServer(cfg *Config) error {
 	e := echo.New()
-	e.HTTPErrorHandler = httpErrorHandler
 
-	client, err := ethclient.Dial("http://localhost:8545")
+	client, err := ethclient.Dial(cfg.RPCURL)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	ex, err := NewExchange(exchangePrivateKey, client)
+	markets, err := LoadMarkets(cfg.MarketsPath)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	buyerBalance, err := ex.Client.BalanceAt(context.Background(),
-		common.HexToAddress("0x28a8746e75304c0780E011BEd21C72cD78cd535E"), nil)
+	ex, err := NewExchange(cfg.PrivateKey, client, markets)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	ex.ChainID = cfg.ChainID
+	ex.Settler = ethSettler{client: client, chainID: big.NewInt(cfg.ChainID), metrics: ex.metrics}
+	ex.RequireSignedOrders = cfg.RequireSignedOrders
+	if cfg.RateLimits != nil {
+		ex.SetRateLimits(*cfg.RateLimits)
+	}
+	if err := ex.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		return err
 	}
-	fmt.Println("buyer balance:", buyerBalance)
 
-	sellerBalance, err := ex.Client.BalanceAt(context.Background(),
-		common.HexToAddress("0xACa94ef8bD5ffEE41947b4585a84BdA5a3d3DA6E"), nil)
-	if err != nil {
-		log.Fatal(err)
+	for _, key := range cfg.AdminKeys {
+		if err := ex.AddAdminKey(key.Key, key.Secret); err != nil {
+			return err
+		}
+	}
+	// the users of the config go first, the snapshot holds which of them
+	// are disabled
+	if err := ex.ProvisionUsers(cfg.Users); err != nil {
+		return err
 	}
-	fmt.Println("seller balance:", sellerBalance)
 
-	pkStr8 := "829e924fdf021ba3dbbc4225edfece9aca04b929d6e75613329ca6f1d31c0bb4"
-	user8 := NewUser(pkStr8, 8)
-	ex.Users[user8.ID] = user8
+	if err := ex.SetTradeArchive(cfg.TradeArchiveDir); err != nil {
+		return err
+	}
+	if err := ex.SetFillArchive(cfg.FillArchiveDir); err != nil {
+		return err
+	}
+	if err := ex.RestoreSnapshot(cfg.SnapshotPath); err != nil {
+		return err
+	}
+	snapshots, stopSnapshots := context.WithCancel(context.Background())
+	defer stopSnapshots()
+	snapshotsDone := make(chan struct{})
+	go func() {
+		ex.runSnapshots(snapshots, cfg.SnapshotPath, time.Duration(cfg.SnapshotInterval))
+		close(snapshotsDone)
+	}()
+
+	for _, user := range cfg.Users {
+		u, _ := ex.user(user.ID)
+		address := u.Address()
+		balance, err := client.BalanceAt(context.Background(), address, nil)
+		if err != nil {
+			return err
+		}
+		slog.Info("provisioned user", "user_id", user.ID, "address", address, "balance", balance)
+	}
 
-	pkstr7 := "a453611d9419d0e56f499079478fd72c37b251a94bfde4d19872c44cf65386e3"
-	user7 := NewUser(pkstr7, 7)
-	ex.Users[user7.ID] = user7
+	ex.useMiddleware(e)
+	ex.registerPublicRoutes(e)
+
+	// the admin API never shares the public listener
+	var admin *echo.Echo
+	if cfg.AdminListenAddr != "" && len(cfg.AdminKeys) > 0 {
+		admin = echo.New()
+		admin.HideBanner = true
+		ex.useMiddleware(admin)
+		ex.registerAdminRoutes(admin)
+	} else {
+		slog.Warn("admin API disabled, it needs an admin listen address and key")
+	}
 
-	johnPk := "e485d098507f54e7733a205420dfddbe58db035fa577fc294ebd14db90767a52"
-	john := NewUser(johnPk, 666)
-	ex.Users[john.ID] = john
+	var grpcListener net.Listener
+	if cfg.GRPCListenAddr != "" {
+		grpcListener, err = net.Listen("tcp", cfg.GRPCListenAddr)
+		if err != nil {
+			return err
+		}
+	}
 
-	johnBalance, err := client.BalanceAt(context.Background(),
-		common.HexToAddress("0x3E5e9111Ae8eB78Fe1CC3bb8915d5D461F3Ef9A9"), nil)
-	if err != nil {
-		log.Fatal(err)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	errc := make(chan error, 3)
+	go func() {
+		errc <- e.Start(cfg.ListenAddr)
+	}()
+	if admin != nil {
+		go func() {
+			errc <- admin.Start(cfg.AdminListenAddr)
+		}()
 	}
+	if grpcListener != nil {
+		srv := ex.NewGRPCServer()
+		slog.Info("gRPC server started", "addr", grpcListener.Addr())
+		go func() {
+			errc <- srv.Serve(grpcListener)
+		}()
+	}
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	slog.Info("shutting down")
 
-	fmt.Println("john balance:", johnBalance)
+	// the periodic snapshots stop so only the final one is written
+	stopSnapshots()
+	<-snapshotsDone
 
-	e.POST("/order", ex.handlePlaceOrder)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout))
+	defer cancel()
 
-	e.GET("/trades/:market", ex.handleGetTrades)
-	e.GET("/order/:userID", ex.handleGetOrders)
-	e.GET("/book/:market/ask", ex.handleGetBook)
-	e.GET("/book/:market", ex.handleGetBook)
-	e.GET("/book/:market/bid", ex.handleGetBestBid)
-	e.GET("/book/:market/ask", ex.handleGetBestAsk)
+	if admin != nil {
+		if err := admin.Shutdown(ctx); err != nil {
+			slog.Error("shutting down the admin server", "error", err)
+		}
+	}
 
-	e.DELETE("/order/:id", ex.cancelOrder)
+	return ex.Shutdown(ctx, e, cfg.SnapshotPath)
+}
 
-	e.Start(":3000")
+// useMiddleware sets up the error handling, logging and metrics every
+// server of the exchange shares.
+func (ex *Exchange) useMiddleware(e *echo.Echo) {
+	e.HTTPErrorHandler = httpErrorHandler
+	e.IPExtractor = ex.clientIP
+	e.Use(requestID, logRequests, ex.instrument)
+}
 
-	fmt.Println("working")
+func (ex *Exchange) registerPublicRoutes(e *echo.Echo) {
+	reads := ex.limitIP(budgetReads)
+
+	e.GET("/trades/:market", ex.handleGetTrades, reads)
+	e.GET("/book/:market", ex.handleGetBook, reads)
+	e.GET("/ticker/:market", ex.handleGetTicker, reads)
+	e.GET("/candles/:market", ex.handleGetCandles, reads)
+	e.GET("/markets", ex.handleGetMarkets, reads)
+
+	e.GET("/ws", ex.handleStream, reads)
+	e.GET("/metrics", ex.handleMetrics(), reads)
+
+	// everything below acts for the user bound to the API key. This is not
+	// a group: a group with middleware also catches unknown routes.
+	var (
+		orders       = ex.private(budgetOrders)
+		cancels      = ex.private(budgetCancels)
+		privateReads = ex.private(budgetReads)
+	)
+
+	e.POST("/order", ex.handlePlaceOrder, append(orders, ex.acceptOrders)...)
+	e.GET("/order/:userID", ex.handleGetOrders, privateReads...)
+	e.GET("/orders/:id", ex.handleGetOrder, privateReads...)
+	e.GET("/orders/:id/signature", ex.handleGetSignedOrder, privateReads...)
+	e.GET("/orders/client/:clientOrderID", ex.handleGetOrderByClientID, privateReads...)
+	e.GET("/fills", ex.handleGetFills, privateReads...)
+
+	e.DELETE("/order/:id", ex.cancelOrder, cancels...)
+	e.DELETE("/order/client/:clientOrderID", ex.cancelOrderByClientID, cancels...)
+	e.DELETE("/orders", ex.handleCancelOrders, cancels...)
+
+	// heartbeats keep orders alive, they share the budget of cancels
+	e.POST("/heartbeat", ex.handleHeartbeat, cancels...)
+}
+
+// private authenticates a route. The address pays before the signature
+// is checked, the user once known.
+func (ex *Exchange) private(kind budget) []echo.MiddlewareFunc {
+	return []echo.MiddlewareFunc{ex.limitIP(kind), ex.authenticate, ex.limitUser(kind)}
 }
 
 type User struct {
 	ID         int64
 	PrivateKey *ecdsa.PrivateKey
+	// Disabled users cannot authenticate anymore, it is guarded by the
+	// users lock of the exchange.
+	Disabled bool
 }
 
 func NewUser(privateKey string, id int64) *User {
@@ -151,46 +281,197 @@ func NewUser(privateKey string, id int64) *User {
 	}
 }
 
-func httpErrorHandler(err error, c echo.Context) {
-	fmt.Println(err)
+// Address is the account of the user, orders must be signed by it.
+func (u *User) Address() common.Address {
+	return crypto.PubkeyToAddress(u.PrivateKey.PublicKey)
+}
+
+// user returns a registered user. Users are added at runtime, the map
+// must not be read without the lock.
+func (ex *Exchange) user(id int64) (*User, bool) {
+	ex.usersMu.RLock()
+	defer ex.usersMu.RUnlock()
+
+	user, ok := ex.Users[id]
+	return user, ok
+}
+
+func (ex *Exchange) addUser(user *User) {
+	ex.usersMu.Lock()
+	defer ex.usersMu.Unlock()
+
+	ex.Users[user.ID] = user
+}
+
+func (ex *Exchange) userDisabled(id int64) bool {
+	ex.usersMu.RLock()
+	defer ex.usersMu.RUnlock()
+
+	user, ok := ex.Users[id]
+	return ok && user.Disabled
 }
 
 type Exchange struct {
-	Client *ethclient.Client
-	mu     sync.RWMutex
-	Users  map[int64]*User
+	Client  *ethclient.Client
+	mu      sync.RWMutex
+	usersMu sync.RWMutex
+	Users   map[int64]*User
 	// Orders maps a user to his orders.
 	Orders     map[int64][]*orderbook.Order
 	PrivateKey *ecdsa.PrivateKey
-	orderbooks map[Market]*orderbook.Orderbook
+	// ChainID is the chain signed orders are bound to.
+	ChainID int64
+	Settler Settler
+	// RequireSignedOrders refuses orders without an EIP-712 signature of
+	// the user, signed orders are always verified.
+	RequireSignedOrders bool
+	signedOrders        *signedOrderStore
+	clientOrders        *clientOrderStore
+	fills               *fillStore
+	limiter             *rateLimiter
+	ipExtractor         echo.IPExtractor
+	auth                *authenticator
+	adminAuth           *authenticator
+	auditTrail          *auditLog
+	markets             *marketRegistry
+	deadMan             *deadMansSwitch
+	stream              *streamHub
+	metrics             *exchangeMetrics
+	orderGate           orderGate
+	// grpcServer is set by NewGRPCServer, Shutdown stops it.
+	grpcServer *grpc.Server
+	// closing is set once Shutdown started.
+	closing   atomic.Bool
+	startedAt time.Time
+	// createdUsers are the users created through the admin API, they
+	// are kept in the snapshots. It is guarded by usersMu.
+	createdUsers []UserConfig
 }
 
-func NewExchange(privateKey string, client *ethclient.Client) (*Exchange, error) {
-	orderbooks := make(map[Market]*orderbook.Orderbook)
-	orderbooks[MarketEth] = orderbook.NewOrderbook()
+func NewExchange(privateKey string, client *ethclient.Client, markets []MarketConfig) (*Exchange, error) {
+	hub := newStreamHub()
+	fills := newFillStore(fillRingSize)
+	registry := newMarketRegistry(hub, fills)
+	for _, cfg := range markets {
+		if err := registry.add(cfg); err != nil {
+			return nil, err
+		}
+	}
 
 	pk, err := crypto.HexToECDSA(privateKey)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Exchange{
-		Client:     client,
-		Users:      make(map[int64]*User),
-		Orders:     make(map[int64][]*orderbook.Order),
-		PrivateKey: pk,
-		orderbooks: orderbooks,
-	}, nil
+	metrics := newExchangeMetrics()
+	ex := &Exchange{
+		Client:       client,
+		Users:        make(map[int64]*User),
+		Orders:       make(map[int64][]*orderbook.Order),
+		PrivateKey:   pk,
+		ChainID:      DefaultChainID,
+		Settler:      ethSettler{client: client, chainID: big.NewInt(DefaultChainID), metrics: metrics},
+		metrics:      metrics,
+		auth:         newAuthenticator(),
+		adminAuth:    newAuthenticator(),
+		auditTrail:   &auditLog{},
+		startedAt:    time.Now(),
+		markets:      registry,
+		signedOrders: newSignedOrderStore(),
+		clientOrders: newClientOrderStore(clientOrderRetention),
+		fills:        fills,
+		limiter:      newRateLimiter(DefaultRateLimits()),
+		ipExtractor:  echo.ExtractIPDirect(),
+		stream:       hub,
+	}
+	ex.deadMan = newDeadMansSwitch(ex.cancelAllUserOrders)
+	metrics.registry.MustRegister(bookCollector{ex: ex})
+
+	return ex, nil
 }
 
-func (ex *Exchange) handleGetTrades(c echo.Context) error {
-	market := Market(c.Param("market"))
-	ob, ok := ex.orderbooks[market]
+// engine returns the engine of a listed or delisted market.
+func (ex *Exchange) engine(market Market) (*engine, bool) {
+	m, ok := ex.markets.get(market)
 	if !ok {
-		return c.JSON(http.StatusBadRequest, APIError{Error: "orderbook not found"})
+		return nil, false
 	}
+	return m.engine, true
+}
+
+// tradingMarket returns a market that accepts new orders.
+func (ex *Exchange) tradingMarket(market Market) (MarketConfig, *engine, error) {
+	m, ok := ex.markets.get(market)
+	if !ok {
+		return MarketConfig{}, nil, newAPIError(http.StatusBadRequest, ErrCodeUnknownMarket, "market %s not found", market)
+	}
+	cfg, _ := ex.markets.config(market)
+	if cfg.Status != MarketActive {
+		return MarketConfig{}, nil, newAPIError(http.StatusBadRequest, ErrCodeMarketNotTrading, "market %s is %s", market, strings.ToLower(string(cfg.Status)))
+	}
+
+	return cfg, m.engine, nil
+}
+
+func (ex *Exchange) handleGetMarkets(c echo.Context) error {
+	return c.JSON(http.StatusOK, ex.markets.list())
+}
 
-	return c.JSON(http.StatusOK, ob.Trades)
+// handleListMarket adds a market at runtime.
+func (ex *Exchange) handleListMarket(c echo.Context) error {
+	var cfg MarketConfig
+
+	if err := json.NewDecoder(c.Request().Body).Decode(&cfg); err != nil {
+		return newAPIError(http.StatusBadRequest, ErrCodeBadRequest, "invalid market config: %v", err)
+	}
+	if cfg.Status == "" {
+		cfg.Status = MarketActive
+	}
+
+	if err := ex.markets.add(cfg); err != nil {
+		return newAPIError(http.StatusBadRequest, ErrCodeValidation, "%v", err)
+	}
+
+	ex.audit(c, ActionListMarket, string(cfg.Symbol), c.QueryParam("reason"), map[string]any{
+		"BaseAsset":  cfg.BaseAsset,
+		"QuoteAsset": cfg.QuoteAsset,
+	})
+
+	return c.JSON(http.StatusOK, cfg)
+}
+
+// handleDelistMarket stops a market from trading and cancels every order
+// resting in it. Its orders and trades can still be queried.
+func (ex *Exchange) handleDelistMarket(c echo.Context) error {
+	market := Market(c.Param("market"))
+
+	if err := ex.markets.setStatus(market, MarketDelisted); err != nil {
+		return newAPIError(http.StatusNotFound, ErrCodeUnknownMarket, "%v", err)
+	}
+
+	eng, _ := ex.engine(market)
+	var cancelled []orderbook.CancelledOrder
+	eng.do(func(ob *orderbook.Orderbook) {
+		cancelled = ob.CancelOrders(func(*orderbook.Order) bool { return true }, orderbook.ReasonMarketDelisted)
+		for _, order := range cancelled {
+			eng.orderUpdated(eng.orders[order.ID])
+		}
+	})
+
+	ex.mu.Lock()
+	for _, order := range cancelled {
+		ex.forgetOrder(order.UserID, order.ID)
+	}
+	ex.mu.Unlock()
+
+	ex.metrics.ordersCancelled(market, len(cancelled))
+	ex.audit(c, ActionDelistMarket, string(market), c.QueryParam("reason"), map[string]any{
+		"Cancelled": len(cancelled),
+	})
+
+	cfg, _ := ex.markets.config(market)
+
+	return c.JSON(http.StatusOK, cfg)
 }
 
 type GetOrderResponse struct {
@@ -201,129 +482,461 @@ type GetOrderResponse struct {
 func (ex *Exchange) handleGetOrders(c echo.Context) error {
 	userID, err := strconv.Atoi(c.Param("userID"))
 	if err != nil {
-		return err
+		return newAPIError(http.StatusBadRequest, ErrCodeBadRequest, "invalid user id")
+	}
+	if int64(userID) != actingUser(c) {
+		return newAPIError(http.StatusForbidden, ErrCodeForbidden, "cannot read the orders of another user")
 	}
 
 	ex.mu.RLock()
-	orderbooksOrders := ex.Orders[int64(userID)]
+	orderbooksOrders := make([]*orderbook.Order, len(ex.Orders[int64(userID)]))
+	copy(orderbooksOrders, ex.Orders[int64(userID)])
+	ex.mu.RUnlock()
+
 	ordersResp := GetOrderResponse{
 		Asks: []Order{},
 		Bids: []Order{},
 	}
 
-	for i := 0; i < len(orderbooksOrders); i++ {
-		// It could be that the order is getting filled even though its included in this
-		// response. We must double check if the limit is not nil
-		if orderbooksOrders[i].Limit == nil {
-			continue
-		}
-		order := Order{
-			ID:        orderbooksOrders[i].ID,
-			UserID:    orderbooksOrders[i].UserID,
-			Price:     orderbooksOrders[i].Limit.Price,
-			Size:      orderbooksOrders[i].Size,
-			Timestamp: orderbooksOrders[i].Timestamp,
-			Bid:       orderbooksOrders[i].Bid,
-		}
-		if order.Bid {
-			ordersResp.Bids = append(ordersResp.Bids, order)
-		} else {
-			ordersResp.Asks = append(ordersResp.Asks, order)
-		}
+	for _, eng := range ex.markets.engines() {
+		eng.do(func(ob *orderbook.Orderbook) {
+			for i := 0; i < len(orderbooksOrders); i++ {
+				// It could be that the order got filled or cancelled since we
+				// copied the index. Only orders still resting in this book count.
+				if ob.Orders[orderbooksOrders[i].ID] != orderbooksOrders[i] {
+					continue
+				}
+				order := Order{
+					ID:        orderbooksOrders[i].ID,
+					UserID:    orderbooksOrders[i].UserID,
+					Price:     orderbooksOrders[i].Limit.Price,
+					Size:      orderbooksOrders[i].Size,
+					Timestamp: orderbooksOrders[i].Timestamp,
+					Bid:       orderbooksOrders[i].Bid,
+				}
+				if order.Bid {
+					ordersResp.Bids = append(ordersResp.Bids, order)
+				} else {
+					ordersResp.Asks = append(ordersResp.Asks, order)
+				}
+			}
+		})
 	}
-	ex.mu.RUnlock()
+
 	return c.JSON(http.StatusOK, ordersResp)
 }
 
 func (ex *Exchange) handleGetBook(c echo.Context) error {
 	market := Market(c.Param("market"))
-	ob, ok := ex.orderbooks[market]
+	eng, ok := ex.engine(market)
+
+	if !ok {
+		return newAPIError(http.StatusNotFound, ErrCodeUnknownMarket, "market %s not found", market)
+	}
+
+	return c.JSON(http.StatusOK, eng.currentView().Book)
+}
+
+// handleGetTicker returns the top of book and the 24h statistics of a
+// market as of the latest published view.
+func (ex *Exchange) handleGetTicker(c echo.Context) error {
+	market := Market(c.Param("market"))
+	eng, ok := ex.engine(market)
+	if !ok {
+		return newAPIError(http.StatusNotFound, ErrCodeUnknownMarket, "market %s not found", market)
+	}
+
+	return c.JSON(http.StatusOK, eng.currentView().Ticker)
+}
+
+func (ex *Exchange) cancelOrder(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, ErrCodeBadRequest, "invalid order id")
+	}
+
+	return ex.replyCancel(c, int64(id))
+}
 
+// cancelOrderByClientID cancels an order by the client order ID it was
+// placed with.
+func (ex *Exchange) cancelOrderByClientID(c echo.Context) error {
+	clientOrderID := c.Param("clientOrderID")
+
+	id, ok := ex.clientOrders.orderID(actingUser(c), clientOrderID)
 	if !ok {
-		return c.JSON(http.StatusBadRequest, map[string]any{"msg": "market not found"})
-	}
-
-	orderBookData := OrderBookData{
-		TotalBidVolume: ob.BidTotalVolume(),
-		TotalAskVolume: ob.AskTotalVolume(),
-		Asks:           []*Order{},
-		Bids:           []*Order{},
-	}
-	for _, limits := range ob.Asks() {
-		for _, order := range limits.Orders {
-			o := Order{
-				UserID:    order.UserID,
-				ID:        order.ID,
-				Price:     limits.Price,
-				Size:      order.Size,
-				Bid:       order.Bid,
-				Timestamp: order.Timestamp,
+		return newAPIError(http.StatusNotFound, ErrCodeUnknownOrder, "client order %s not found", clientOrderID)
+	}
+
+	return ex.replyCancel(c, id)
+}
+
+// replyCancel cancels a resting order of the acting user.
+func (ex *Exchange) replyCancel(c echo.Context, id int64) error {
+	if _, err := ex.cancelUserOrder(c.Request().Context(), actingUser(c), id); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{"msg": "order deleted"})
+}
+
+// cancelUserOrder cancels a resting order of userID and returns its
+// market.
+func (ex *Exchange) cancelUserOrder(ctx context.Context, userID, id int64) (Market, error) {
+	market, err := ex.cancelResting(id, orderbook.ReasonCancelledByUser, func(market Market, order *orderbook.Order) error {
+		if order.UserID != userID {
+			// do not tell others the order exists
+			return newAPIError(http.StatusNotFound, ErrCodeUnknownOrder, "order %d not found", id)
+		}
+		return ex.acceptsCancels(market)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	loggerFrom(ctx).Info("order cancelled", "order_id", id, "market", market)
+
+	return market, nil
+}
+
+// cancelResting cancels the resting order id for reason and returns its
+// market. check may refuse the cancel, its error is returned then.
+func (ex *Exchange) cancelResting(id int64, reason orderbook.Reason, check func(Market, *orderbook.Order) error) (Market, error) {
+	// orders do not know their market, look for it in every book
+	for market, eng := range ex.markets.engines() {
+		var (
+			order *orderbook.Order
+			err   error
+		)
+		eng.do(func(ob *orderbook.Orderbook) {
+			order = ob.Orders[id]
+			if order == nil {
+				return
+			}
+			if err = check(market, order); err != nil {
+				return
 			}
-			orderBookData.Asks = append(orderBookData.Asks, &o)
+			ob.CancelOrderWithReason(order, reason)
+			eng.orderUpdated(order)
+		})
+		if err != nil {
+			return market, err
+		}
+		if order != nil {
+			ex.forgetOrders(order)
+			ex.metrics.ordersCancelled(market, 1)
+			return market, nil
 		}
 	}
 
-	for _, limits := range ob.Bids() {
-		for _, order := range limits.Orders {
-			o := Order{
-				UserID:    order.UserID,
-				ID:        order.ID,
-				Price:     limits.Price,
-				Size:      order.Size,
-				Bid:       order.Bid,
-				Timestamp: order.Timestamp,
+	return "", newAPIError(http.StatusNotFound, ErrCodeUnknownOrder, "order %d not found", id)
+}
+
+// acceptsCancels refuses the cancels of users in halted markets, their
+// books are frozen.
+func (ex *Exchange) acceptsCancels(market Market) error {
+	cfg, _ := ex.markets.config(market)
+	if cfg.Status == MarketHalted {
+		return newAPIError(http.StatusBadRequest, ErrCodeMarketNotTrading, "market %s is halted, orders cannot be cancelled", market)
+	}
+
+	return nil
+}
+
+type OrderStatusResponse struct {
+	ID            int64
+	ClientOrderID string `json:",omitempty"`
+	UserID        int64
+	Market        Market
+	Bid           bool
+	// Price is the limit price, zero for market orders.
+	Price  float64
+	Status orderbook.OrderStatus
+	Reason orderbook.Reason
+	// RemainingSize is what is still open, or what was left when the
+	// order got cancelled, expired or rejected.
+	OriginalSize  float64
+	RemainingSize float64
+	FilledSize    float64
+	AvgFillPrice  float64
+	Timestamp     int64
+}
+
+// newOrderStatus must be called from the engine goroutine owning order.
+func newOrderStatus(market Market, order *orderbook.Order) OrderStatusResponse {
+	return OrderStatusResponse{
+		ID:            order.ID,
+		UserID:        order.UserID,
+		Market:        market,
+		Bid:           order.Bid,
+		Price:         order.Price,
+		Status:        order.Status,
+		Reason:        order.Reason,
+		OriginalSize:  order.OriginalSize,
+		RemainingSize: order.Size,
+		FilledSize:    order.FilledSize,
+		AvgFillPrice:  order.AvgFillPrice,
+		Timestamp:     order.Timestamp,
+	}
+}
+
+func (ex *Exchange) handleGetOrder(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, ErrCodeBadRequest, "invalid order id")
+	}
+
+	return ex.replyOrderStatus(c, int64(id))
+}
+
+// handleGetOrderByClientID looks an order up by the client order ID it was
+// placed with.
+func (ex *Exchange) handleGetOrderByClientID(c echo.Context) error {
+	clientOrderID := c.Param("clientOrderID")
+
+	id, ok := ex.clientOrders.orderID(actingUser(c), clientOrderID)
+	if !ok {
+		return newAPIError(http.StatusNotFound, ErrCodeUnknownOrder, "client order %s not found", clientOrderID)
+	}
+
+	return ex.replyOrderStatus(c, id)
+}
+
+// replyOrderStatus answers with the status of an order of the acting
+// user.
+func (ex *Exchange) replyOrderStatus(c echo.Context, id int64) error {
+	resp, err := ex.orderStatus(actingUser(c), id)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+// orderStatus returns the status of an order of userID.
+func (ex *Exchange) orderStatus(userID, id int64) (*OrderStatusResponse, error) {
+	for market, eng := range ex.markets.engines() {
+		var (
+			resp  OrderStatusResponse
+			found bool
+		)
+		eng.do(func(ob *orderbook.Orderbook) {
+			order, ok := eng.orders[id]
+			if !ok || order.UserID != userID {
+				return
 			}
-			orderBookData.Bids = append(orderBookData.Bids, &o)
+			found = true
+			resp = newOrderStatus(market, order)
+		})
+		if found {
+			resp.ClientOrderID = ex.clientOrders.clientOrderID(id)
+			return &resp, nil
 		}
 	}
-	return c.JSON(http.StatusOK, orderBookData)
+
+	return nil, newAPIError(http.StatusNotFound, ErrCodeUnknownOrder, "order %d not found", id)
 }
 
-type PriceResponse struct {
-	Price float64
+// handleGetSignedOrder returns the signed order the user submitted, the
+// proof they asked for the order.
+func (ex *Exchange) handleGetSignedOrder(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, ErrCodeBadRequest, "invalid order id")
+	}
+
+	signed, ok := ex.signedOrders.get(int64(id))
+	user, known := ex.user(actingUser(c))
+	if !ok || !known || signed.Message.Trader != user.Address() {
+		return newAPIError(http.StatusNotFound, ErrCodeUnknownOrder, "signed order %d not found", id)
+	}
+
+	return c.JSON(http.StatusOK, signed)
 }
 
-func (ex *Exchange) handleGetBestBid(c echo.Context) error {
-	market := Market(c.Param("market"))
-	ob := ex.orderbooks[market]
-	if len(ob.Bids()) == 0 {
-		return fmt.Errorf("the bids are empty")
+type CancelOrdersResponse struct {
+	Cancelled []orderbook.CancelledOrder
+}
+
+// handleCancelOrders pulls every resting order of the acting user in a
+// market, optionally only on one side (?side=bid or ?side=ask).
+func (ex *Exchange) handleCancelOrders(c echo.Context) error {
+	userID := actingUser(c)
+
+	market := Market(c.QueryParam("market"))
+	if _, ok := ex.engine(market); !ok {
+		return newAPIError(http.StatusBadRequest, ErrCodeUnknownMarket, "market %s not found", market)
+	}
+
+	var bid *bool
+	switch c.QueryParam("side") {
+	case "":
+	case "bid":
+		bid = new(bool)
+		*bid = true
+	case "ask":
+		bid = new(bool)
+	default:
+		return newAPIError(http.StatusBadRequest, ErrCodeValidation, "side must be bid or ask")
 	}
-	bestBidPrice := ob.Bids()[0].Price
-	pr := PriceResponse{
-		Price: bestBidPrice,
+
+	if err := ex.acceptsCancels(market); err != nil {
+		return err
 	}
+	cancelled := ex.massCancel(market, userID, bid, orderbook.ReasonMassCancel)
+
+	requestLogger(c).Info("mass cancel", "market", market, "cancelled", len(cancelled))
 
-	return c.JSON(http.StatusOK, pr)
+	return c.JSON(http.StatusOK, CancelOrdersResponse{Cancelled: cancelled})
 }
 
-func (ex *Exchange) handleGetBestAsk(c echo.Context) error {
-	market := Market(c.Param("market"))
-	ob := ex.orderbooks[market]
-	if len(ob.Asks()) == 0 {
-		return fmt.Errorf("the asks are empty")
+// cancelAllUserOrders pulls the resting orders of a user in every market.
+func (ex *Exchange) cancelAllUserOrders(userID int64) {
+	for market := range ex.markets.engines() {
+		cancelled := ex.massCancel(market, userID, nil, orderbook.ReasonCancelOnDisconnect)
+		if len(cancelled) > 0 {
+			slog.Info("cancelled orders on disconnect", "user_id", userID, "market", market, "cancelled", len(cancelled))
+		}
+	}
+}
+
+type HeartbeatRequest struct {
+	// TimeoutMillis arms or refreshes the dead man's switch, 0 disarms it.
+	TimeoutMillis int64
+}
+
+type HeartbeatResponse struct {
+	Armed bool
+	// ExpiresAt is when the user's orders get cancelled unless another
+	// heartbeat comes in, in unix nanoseconds.
+	ExpiresAt int64
+}
+
+// handleHeartbeat drives the dead man's switch: once armed, a user must
+// keep sending heartbeats or all their resting orders get cancelled.
+func (ex *Exchange) handleHeartbeat(c echo.Context) error {
+	var heartbeat HeartbeatRequest
+	userID := actingUser(c)
+
+	if err := json.NewDecoder(c.Request().Body).Decode(&heartbeat); err != nil {
+		return newAPIError(http.StatusBadRequest, ErrCodeBadRequest, "invalid heartbeat: %v", err)
+	}
+
+	if heartbeat.TimeoutMillis < 0 {
+		return newAPIError(http.StatusBadRequest, ErrCodeValidation, "timeout must not be negative")
 	}
-	bestAskPrice := ob.Asks()[0].Price
-	pr := PriceResponse{
-		Price: bestAskPrice,
+
+	if heartbeat.TimeoutMillis == 0 {
+		ex.deadMan.disarm(userID)
+		return c.JSON(http.StatusOK, HeartbeatResponse{})
 	}
 
-	return c.JSON(http.StatusOK, pr)
+	timeout := time.Duration(heartbeat.TimeoutMillis) * time.Millisecond
+	ex.deadMan.arm(userID, timeout)
+
+	return c.JSON(http.StatusOK, HeartbeatResponse{
+		Armed:     true,
+		ExpiresAt: time.Now().Add(timeout).UnixNano(),
+	})
 }
 
-func (ex *Exchange) cancelOrder(c echo.Context) error {
-	id, _ := strconv.Atoi(c.Param("id"))
-	ob := ex.orderbooks[MarketEth]
-	ob.CancelOrder(ob.Orders[int64(id)])
+// massCancel cancels the resting orders of a user in a market. When bid
+// is not nil only the orders on that side are cancelled.
+func (ex *Exchange) massCancel(market Market, userID int64, bid *bool, reason orderbook.Reason) []orderbook.CancelledOrder {
+	cancelled := []orderbook.CancelledOrder{}
 
-	log.Println("order canceled id =>", id)
+	eng, ok := ex.engine(market)
+	if !ok {
+		return cancelled
+	}
 
-	return c.JSON(http.StatusOK, map[string]any{"msg": "order deleted"})
+	eng.do(func(ob *orderbook.Orderbook) {
+		if bid == nil {
+			cancelled = ob.CancelUserOrders(userID, reason)
+		} else {
+			cancelled = ob.CancelUserSideOrders(userID, *bid, reason)
+		}
+		for _, order := range cancelled {
+			eng.orderUpdated(eng.orders[order.ID])
+		}
+	})
+
+	ex.mu.Lock()
+	for _, order := range cancelled {
+		ex.forgetOrder(order.UserID, order.ID)
+	}
+	ex.mu.Unlock()
+	ex.metrics.ordersCancelled(market, len(cancelled))
+
+	return cancelled
+}
+
+// forgetOrders drops orders that no longer rest in a book from the
+// user -> orders index.
+func (ex *Exchange) forgetOrders(orders ...*orderbook.Order) {
+	if len(orders) == 0 {
+		return
+	}
+
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	for _, order := range orders {
+		ex.forgetOrder(order.UserID, order.ID)
+	}
+}
+
+// forgetOrder must be called with ex.mu held.
+func (ex *Exchange) forgetOrder(userID, orderID int64) {
+	userOrders := ex.Orders[userID]
+	for i := 0; i < len(userOrders); i++ {
+		if userOrders[i].ID == orderID {
+			userOrders = append(userOrders[:i], userOrders[i+1:]...)
+			break
+		}
+	}
+	if len(userOrders) == 0 {
+		delete(ex.Orders, userID)
+	} else {
+		ex.Orders[userID] = userOrders
+	}
 }
 
-func (ex *Exchange) handlePlaceMarketOrder(market Market, order *orderbook.Order) ([]orderbook.Match, []*MatchedOrders) {
-	ob := ex.orderbooks[market]
-	matches := ob.PlaceMarketOrder(order)
+func (ex *Exchange) handlePlaceMarketOrder(ctx context.Context, market Market, order *orderbook.Order) ([]orderbook.Match, []*MatchedOrders, error) {
+	var (
+		matches []orderbook.Match
+		filled  []*orderbook.Order
+		err     error
+	)
+
+	eng, _ := ex.engine(market)
+	eng.do(func(ob *orderbook.Orderbook) {
+		eng.track(order)
+
+		start := time.Now()
+		matches, err = ob.PlaceMarketOrder(order)
+		if err != nil {
+			eng.orderUpdated(order)
+			return
+		}
+		ex.metrics.matched(market, MarketOrder, start)
+		eng.matched(order, matches)
+
+		// collect the limit orders that got filled while we still own the book
+		for _, match := range matches {
+			resting := match.Bid
+			if order.Bid {
+				resting = match.Ask
+			}
+			if resting.IsFilled() {
+				filled = append(filled, resting)
+			}
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
 	matchedOrders := make([]*MatchedOrders, len(matches))
 
 	isBid := false
@@ -331,8 +944,7 @@ func (ex *Exchange) handlePlaceMarketOrder(market Market, order *orderbook.Order
 		isBid = true
 	}
 
-	totalSizeFilled := 0.0
-	sumPrice := 0.0
+	logger := loggerFrom(ctx)
 	for i := 0; i < len(matchedOrders); i++ {
 		id := matches[i].Bid.ID
 		limitUserID := matches[i].Bid.UserID
@@ -346,90 +958,216 @@ func (ex *Exchange) handlePlaceMarketOrder(market Market, order *orderbook.Order
 			Price:  matches[i].Price,
 			ID:     id,
 		}
-		totalSizeFilled += matches[i].SizeFilled
-		sumPrice += matches[i].Price
+		logger.Debug("matched", "maker_order_id", id, "maker_user_id", limitUserID, "price", matches[i].Price, "size", matches[i].SizeFilled)
 	}
 
-	avgPrice := sumPrice / float64(len(matches))
+	totalSizeFilled, quoteFilled := orderbook.MatchTotals(matches)
+	avgPrice := quoteFilled / totalSizeFilled
 
-	log.Printf("filled market order => %d | size: [%.2f] avgPrice: [%.2f]", order.ID, totalSizeFilled, avgPrice)
+	logger.Info("filled market order", "bid", order.Bid, "size", totalSizeFilled, "quote", quoteFilled, "avg_price", avgPrice, "matches", len(matches))
 
-	newOrderMap := make(map[int64][]*orderbook.Order)
-	ex.mu.Lock()
-	for userID, orderbookOrders := range ex.Orders {
-		for i := 0; i < len(orderbookOrders); i++ {
-			// if the order is not filled we place it in the map copy
-			// this means that size of the order = 0
-			if orderbookOrders[i].IsFilled() {
-				newOrderMap[userID] = append(newOrderMap[userID], orderbookOrders[i])
-			}
-		}
-	}
-	ex.Orders = newOrderMap
-	ex.mu.Unlock()
+	ex.forgetOrders(filled...)
 
-	return matches, matchedOrders
+	return matches, matchedOrders, nil
 }
 
-func (ex *Exchange) handlePlaceLimitOrder(market Market, price float64, order *orderbook.Order) error {
-	ob := ex.orderbooks[market]
-	ob.PlaceLimitOrder(price, order)
+func (ex *Exchange) handlePlaceLimitOrder(ctx context.Context, market Market, price float64, order *orderbook.Order) error {
+	size := order.Size
 
-	// keep track of the user orders
-	ex.mu.Lock()
-	ex.Orders[order.UserID] = append(ex.Orders[order.UserID], order)
-	ex.mu.Unlock()
+	eng, _ := ex.engine(market)
+	eng.do(func(ob *orderbook.Orderbook) {
+		start := time.Now()
+		ob.PlaceLimitOrder(price, order)
+		ex.metrics.matched(market, LimitOrder, start)
+		eng.track(order)
+		eng.orderUpdated(order)
+
+		// keep track of the user orders before anyone can fill it
+		ex.mu.Lock()
+		ex.Orders[order.UserID] = append(ex.Orders[order.UserID], order)
+		ex.mu.Unlock()
+	})
 
-	log.Printf("new LIMIT order => [%t] price [%.2f] | size [%.2f]", order.Bid, order.Limit.Price, order.Size)
+	loggerFrom(ctx).Info("placed limit order", "bid", order.Bid, "price", price, "size", size)
 
 	return nil
 }
 
 type PlaceOrderResponse struct {
-	OrderID int64
+	OrderID       int64
+	ClientOrderID string `json:",omitempty"`
+	Status        orderbook.OrderStatus
+	Reason        orderbook.Reason
+	// BaseFilled and QuoteFilled are only set for market orders, the
+	// quote is what got spent by a buy or received by a sell.
+	BaseFilled  float64
+	QuoteFilled float64
 }
 
 func (ex *Exchange) handlePlaceOrder(c echo.Context) error {
 	var placeOrderData PlaceOrderRequest
 
 	if err := json.NewDecoder(c.Request().Body).Decode(&placeOrderData); err != nil {
+		return newAPIError(http.StatusBadRequest, ErrCodeBadRequest, "invalid order: %v", err)
+	}
+
+	// the order always belongs to the user of the API key
+	if placeOrderData.UserID != 0 && placeOrderData.UserID != actingUser(c) {
+		return newAPIError(http.StatusForbidden, ErrCodeForbidden, "cannot place orders for another user")
+	}
+	placeOrderData.UserID = actingUser(c)
+
+	resp, err := ex.submitOrder(c.Request().Context(), &placeOrderData, func(ratio float64) {
+		c.Response().Header().Set(HeaderOrderTradeRatio, strconv.FormatFloat(ratio, 'f', 2, 64))
+	})
+	if err != nil {
 		return err
 	}
 
+	return c.JSON(http.StatusOK, resp)
+}
+
+// submitOrder places an order for placeOrderData.UserID, whatever the
+// transport. onRatio receives the order-to-trade ratio of the user.
+func (ex *Exchange) submitOrder(ctx context.Context, placeOrderData *PlaceOrderRequest, onRatio func(float64)) (*PlaceOrderResponse, error) {
+	if placeOrderData.ClientOrderID == "" {
+		return ex.placeOrder(ctx, placeOrderData, onRatio)
+	}
+
+	submission, fresh, err := ex.clientOrders.reserve(placeOrderData)
+	if err != nil {
+		return nil, err
+	}
+	if !fresh {
+		<-submission.done
+		return submission.resp, submission.err
+	}
+	resp, err := ex.placeOrder(ctx, placeOrderData, onRatio)
+	ex.clientOrders.complete(submission, resp, err)
+
+	return resp, err
+}
+
+// placeOrder validates and places an order, rejected orders come with
+// both a response and an error.
+func (ex *Exchange) placeOrder(ctx context.Context, placeOrderData *PlaceOrderRequest, onRatio func(float64)) (resp *PlaceOrderResponse, err error) {
 	market := Market(placeOrderData.Market)
-	order := orderbook.NewOrder(placeOrderData.Bid, placeOrderData.Size, placeOrderData.UserID)
+	cfg, _, err := ex.tradingMarket(market)
+	if err != nil {
+		return nil, err
+	}
+	if placeOrderData.Type != LimitOrder && placeOrderData.Type != MarketOrder {
+		return nil, newAPIError(http.StatusBadRequest, ErrCodeValidation, "order type must be LIMIT or MARKET")
+	}
+
+	// only known markets and types are counted, the others would make up
+	// labels
+	start := time.Now()
+	defer func() {
+		outcome := orderPlaced
+		if resp == nil || resp.Status == orderbook.StatusRejected {
+			outcome = orderRejected
+		}
+		ex.metrics.orderDone(market, placeOrderData.Type, outcome, start)
+	}()
+
+	if err := cfg.validateOrder(placeOrderData); err != nil {
+		return nil, newAPIError(http.StatusBadRequest, ErrCodeValidation, "%v", err)
+	}
+	var order *orderbook.Order
+	if placeOrderData.Notional > 0 {
+		order = orderbook.NewNotionalOrder(placeOrderData.Bid, placeOrderData.Notional, placeOrderData.UserID)
+	} else {
+		order = orderbook.NewOrder(placeOrderData.Bid, placeOrderData.Size, placeOrderData.UserID)
+	}
+
+	// everything logged for the order from here on, settlement included,
+	// carries its ID
+	ctx = withAttrs(ctx, "order_id", order.ID, "market", market)
+	if placeOrderData.ClientOrderID != "" {
+		ctx = withAttrs(ctx, "client_order_id", placeOrderData.ClientOrderID)
+	}
+
+	// abusive accounts are throttled before anything gets placed
+	ratio, err := ex.limiter.placeOrder(placeOrderData.UserID)
+	onRatio(ratio)
+	if err != nil {
+		return nil, newAPIError(http.StatusTooManyRequests, ErrCodeRateLimited, "%v", err)
+	}
+
+	if placeOrderData.Signature != "" || ex.RequireSignedOrders {
+		user, ok := ex.user(placeOrderData.UserID)
+		if !ok {
+			return nil, newAPIError(http.StatusBadRequest, ErrCodeValidation, "user %d not found", placeOrderData.UserID)
+		}
+		signed, err := verifyOrder(ex.ChainID, user, placeOrderData)
+		if err != nil {
+			return nil, newAPIError(http.StatusUnauthorized, ErrCodeUnauthorized, "%v", err)
+		}
+		signed.OrderID = order.ID
+		if err := ex.signedOrders.add(signed); err != nil {
+			return nil, newAPIError(http.StatusConflict, ErrCodeDuplicateOrder, "%v", err)
+		}
+	}
 
 	// limit orders
 	if placeOrderData.Type == LimitOrder {
-		if err := ex.handlePlaceLimitOrder(market, placeOrderData.Price, order); err != nil {
-			return err
+		if err := ex.handlePlaceLimitOrder(ctx, market, placeOrderData.Price, order); err != nil {
+			return nil, err
 		}
 	}
 
+	// limit orders never match on entry and accepted market orders are
+	// always filled completely
+	resp = &PlaceOrderResponse{
+		OrderID:       order.ID,
+		ClientOrderID: placeOrderData.ClientOrderID,
+		Status:        orderbook.StatusNew,
+	}
+
 	// market orders
 	if placeOrderData.Type == MarketOrder {
-		matches, _ := ex.handlePlaceMarketOrder(market, order)
-		if err := ex.handleMatches(matches); err != nil {
-			return err
+		matches, _, err := ex.handlePlaceMarketOrder(ctx, market, order)
+		if err != nil {
+			loggerFrom(ctx).Info("market order rejected", "reason", orderbook.ReasonInsufficientLiquidity, "error", err)
+			resp.Status = orderbook.StatusRejected
+			resp.Reason = orderbook.ReasonInsufficientLiquidity
+			return resp, newAPIError(http.StatusUnprocessableEntity, ErrCodeInsufficientLiquidity, "market order rejected: %v", err).
+				withDetails(map[string]any{
+					"OrderID": order.ID,
+					"Status":  orderbook.StatusRejected,
+					"Reason":  orderbook.ReasonInsufficientLiquidity,
+				})
+		}
+		for _, match := range matches {
+			ex.limiter.traded(match.Ask.UserID)
+			ex.limiter.traded(match.Bid.UserID)
+		}
+		resp.Status = orderbook.StatusFilled
+		resp.BaseFilled, resp.QuoteFilled = orderbook.MatchTotals(matches)
+		// the order traded whether settlement works out or not
+		if err := ex.handleMatches(ctx, cfg, matches); err != nil {
+			return resp, err
 		}
 	}
 
-	resp := &PlaceOrderResponse{
-		OrderID: order.ID,
-	}
-	return c.JSON(200, resp)
+	return resp, nil
 }
 
-func (ex *Exchange) handleMatches(matches []orderbook.Match) error {
+// handleMatches settles the matches of a market order in cfg. It goes on
+// if the client hangs up, a settlement must not stop halfway.
+func (ex *Exchange) handleMatches(ctx context.Context, cfg MarketConfig, matches []orderbook.Match) error {
+	ctx = context.WithoutCancel(ctx)
+
 	for _, match := range matches {
-		fromUser, ok := ex.Users[match.Ask.UserID]
+		fromUser, ok := ex.user(match.Ask.UserID)
 		if !ok {
-			return fmt.Errorf("user not found %d", match.Ask.UserID)
+			return newAPIError(http.StatusInternalServerError, ErrCodeSettlementFailed, "user not found %d", match.Ask.UserID)
 		}
 
-		toUser, ok := ex.Users[match.Bid.UserID]
+		toUser, ok := ex.user(match.Bid.UserID)
 		if !ok {
-			return fmt.Errorf("user not found %d", match.Bid.UserID)
+			return newAPIError(http.StatusInternalServerError, ErrCodeSettlementFailed, "user not found %d", match.Bid.UserID)
 		}
 		toAddress := crypto.PubkeyToAddress(toUser.PrivateKey.PublicKey)
 
@@ -439,20 +1177,54 @@ func (ex *Exchange) handleMatches(matches []orderbook.Match) error {
 		// 	return fmt.Errorf("cannot assert type: publicKey is not of type *ecdsa.PublicKey")
 		// }
 
-		amount := big.NewInt(int64(match.SizeFilled))
+		amount := cfg.baseUnits(match.SizeFilled)
 
 		// transfer => user => exchange
-		err := transferETH(ex.Client, fromUser.PrivateKey, toAddress, amount)
+		settleCtx := withAttrs(ctx, "ask_order_id", match.Ask.ID, "bid_order_id", match.Bid.ID)
+		err := ex.Settler.Transfer(settleCtx, fromUser.PrivateKey, toAddress, amount)
+		if err != nil && isInsufficientFunds(err) {
+			return newAPIError(http.StatusUnprocessableEntity, ErrCodeInsufficientFunds, "user %d cannot settle the trade: %v", fromUser.ID, err)
+		}
 		if err != nil {
-			return err
+			return newAPIError(http.StatusBadGateway, ErrCodeSettlementFailed, "settlement failed: %v", err)
 		}
 
 	}
 	return nil
 }
 
-func transferETH(client *ethclient.Client, fromPrivKey *ecdsa.PrivateKey, to common.Address, amount *big.Int) error {
-	ctx := context.Background()
+// isInsufficientFunds reports whether a transfer failed for lack of
+// funds, node errors arrive as plain text.
+func isInsufficientFunds(err error) bool {
+	return strings.Contains(err.Error(), "insufficient funds")
+}
+
+// Settler moves the funds of a match between users.
+type Settler interface {
+	Transfer(ctx context.Context, from *ecdsa.PrivateKey, to common.Address, amount *big.Int) error
+}
+
+// ethSettler settles matches with plain ETH transfers.
+type ethSettler struct {
+	client  *ethclient.Client
+	chainID *big.Int
+	// metrics records the outcome of every transfer, it may be nil.
+	metrics *exchangeMetrics
+}
+
+func (s ethSettler) Transfer(ctx context.Context, from *ecdsa.PrivateKey, to common.Address, amount *big.Int) error {
+	return transferETH(ctx, s.client, s.chainID, s.metrics, from, to, amount)
+}
+
+func transferETH(ctx context.Context, client *ethclient.Client, chainID *big.Int, metrics *exchangeMetrics, fromPrivKey *ecdsa.PrivateKey, to common.Address, amount *big.Int) (err error) {
+	outcome := settlementSigningFailed
+	defer func(start time.Time) {
+		metrics.settled(outcome, start)
+		if err != nil {
+			loggerFrom(ctx).Warn("settlement failed", "outcome", outcome, "to", to, "amount", amount, "error", err)
+		}
+	}(time.Now())
+
 	publicKey := fromPrivKey.Public()
 	publicKeyECDSA, ok := publicKey.(*ecdsa.PublicKey)
 	if !ok {
@@ -463,25 +1235,34 @@ func transferETH(client *ethclient.Client, fromPrivKey *ecdsa.PrivateKey, to com
 
 	nonce, err := client.PendingNonceAt(ctx, fromAddress)
 	if err != nil {
+		outcome = settlementNonceFailed
 		return err
 	}
 
 	gasLimit := uint64(21000) // in units
 	gasPrice, err := client.SuggestGasPrice(ctx)
 	if err != nil {
+		outcome = settlementGasPriceFailed
 		return err
 	}
 	tx := types.NewTransaction(nonce, to, amount, gasLimit, gasPrice, nil)
-	chainID := big.NewInt(1337)
 	signedTx, err := types.SignTx(tx, types.NewEIP155Signer(chainID), fromPrivKey)
 	if err != nil {
+		outcome = settlementSigningFailed
 		return err
 	}
 
 	err = client.SendTransaction(ctx, signedTx)
+	if err != nil && isInsufficientFunds(err) {
+		outcome = settlementInsufficientFunds
+		return err
+	}
 	if err != nil {
+		outcome = settlementSendFailed
 		return err
 	}
+	outcome = settlementSent
+	loggerFrom(ctx).Info("settlement sent", "tx", signedTx.Hash(), "to", to, "amount", amount)
 
 	return nil
 }
@@ -0,0 +1,2491 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Baazaouihamza/crypto-exchange/orderbook"
+	"github.com/Baazaouihamza/crypto-exchange/rpc"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func assert(t *testing.T, a, b any) {
+	t.Helper()
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+// testSettler accepts every transfer, there is no chain in the tests.
+type testSettler struct{}
+
+func (testSettler) Transfer(context.Context, *ecdsa.PrivateKey, common.Address, *big.Int) error {
+	return nil
+}
+
+// blockingSettler holds every transfer until release is closed, entered
+// receives one value per transfer started.
+type blockingSettler struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s blockingSettler) Transfer(context.Context, *ecdsa.PrivateKey, common.Address, *big.Int) error {
+	s.entered <- struct{}{}
+	<-s.release
+	return nil
+}
+
+// testUsers are registered on every test exchange, user n signs with
+// testKey(n).
+const testUsers = 8
+
+func testKey(userID int64) (key, secret string) {
+	return fmt.Sprintf("key-%d", userID), fmt.Sprintf("secret-%d", userID)
+}
+
+// testAdminKey and testAdminSecret sign the admin requests of the tests.
+const (
+	testAdminKey    = "admin"
+	testAdminSecret = "admin-secret"
+)
+
+// testPrivateKey is the account key of the exchange and of every test
+// user.
+const testPrivateKey = "4f3edf983ac636a65a842ce7c78d9aa706d3b113bce9c46f30d7d21715b23b1d"
+
+func newTestExchange(t *testing.T) (*Exchange, *echo.Echo) {
+	ex, err := NewExchange(testPrivateKey, nil, DefaultMarkets())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex.Settler = testSettler{}
+	// the tests hammer the exchange from a single address
+	ex.SetRateLimits(RateLimits{})
+
+	for id := int64(0); id < testUsers; id++ {
+		ex.Users[id] = NewUser(testPrivateKey, id)
+		key, secret := testKey(id)
+		if err := ex.AddAPIKey(id, key, secret); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ex.AddAdminKey(testAdminKey, testAdminSecret); err != nil {
+		t.Fatal(err)
+	}
+
+	// the admin routes share the server so the tests can reach both
+	e := echo.New()
+	ex.useMiddleware(e)
+	ex.registerPublicRoutes(e)
+	ex.registerAdminRoutes(e)
+
+	return ex, e
+}
+
+func engineOf(ex *Exchange, market Market) *engine {
+	eng, _ := ex.engine(market)
+	return eng
+}
+
+func doRequest(e *echo.Echo, method, path string, body any) *httptest.ResponseRecorder {
+	var b []byte
+	if body != nil {
+		b, _ = json.Marshal(body)
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(b))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	return rec
+}
+
+var testNonce atomic.Int64
+
+// doRequestAs sends a request signed with the API key of userID.
+func doRequestAs(e *echo.Echo, userID int64, method, path string, body any) *httptest.ResponseRecorder {
+	var b []byte
+	if body != nil {
+		b, _ = json.Marshal(body)
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(b))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	signRequest(req, userID, b)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	return rec
+}
+
+// doAdminRequest sends a request signed with the test admin key.
+func doAdminRequest(e *echo.Echo, method, path string, body any) *httptest.ResponseRecorder {
+	var b []byte
+	if body != nil {
+		b, _ = json.Marshal(body)
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(b))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	signRequestWith(req, testAdminKey, testAdminSecret, b)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	return rec
+}
+
+func signRequest(req *http.Request, userID int64, body []byte) {
+	key, secret := testKey(userID)
+	signRequestWith(req, key, secret, body)
+}
+
+func signRequestWith(req *http.Request, key, secret string, body []byte) {
+	timestamp := time.Now().UnixMilli()
+	nonce := strconv.FormatInt(testNonce.Add(1), 10)
+
+	req.Header.Set(HeaderAPIKey, key)
+	req.Header.Set(HeaderAPITimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderAPINonce, nonce)
+	req.Header.Set(HeaderAPISignature, Sign(secret, timestamp, nonce, req.Method, req.URL.RequestURI(), body))
+}
+
+// TestConcurrentLoad is meant to be run with -race.
+func TestConcurrentLoad(t *testing.T) {
+	ex, e := newTestExchange(t)
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			for i := 0; i < 50; i++ {
+				bid := i%2 == 0
+				price := 10_000.0 + float64(i)
+				if bid {
+					price = 9_000.0 - float64(i)
+				}
+
+				rec := doRequestAs(e, int64(w), http.MethodPost, "/order", PlaceOrderRequest{
+					UserID: int64(w),
+					Type:   LimitOrder,
+					Bid:    bid,
+					Size:   10,
+					Price:  price,
+					Market: MarketEth,
+				})
+				var resp PlaceOrderResponse
+				json.NewDecoder(rec.Body).Decode(&resp)
+
+				doRequestAs(e, int64(w), http.MethodPost, "/order", PlaceOrderRequest{
+					UserID: int64(w),
+					Type:   MarketOrder,
+					Bid:    !bid,
+					Size:   3,
+					Market: MarketEth,
+				})
+
+				if i%3 == 0 {
+					doRequestAs(e, int64(w), http.MethodDelete, fmt.Sprintf("/order/%d", resp.OrderID), nil)
+				}
+				doRequest(e, http.MethodGet, "/book/ETH", nil)
+				doRequest(e, http.MethodGet, "/ticker/ETH", nil)
+				doRequestAs(e, int64(w), http.MethodGet, fmt.Sprintf("/order/%d", w), nil)
+				doRequest(e, http.MethodGet, "/trades/ETH", nil)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	engineOf(ex, MarketEth).do(func(ob *orderbook.Orderbook) {
+		if err := ob.Validate(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestBookViewPublishedAfterCommand(t *testing.T) {
+	ex, e := newTestExchange(t)
+	eng := engineOf(ex, MarketEth)
+
+	old := eng.currentView()
+	assert(t, old.BestAsk == nil, true)
+
+	doRequestAs(e, 1, http.MethodPost, "/order", PlaceOrderRequest{
+		UserID: 1,
+		Type:   LimitOrder,
+		Size:   10,
+		Price:  10_000,
+		Market: MarketEth,
+	})
+	doRequestAs(e, 1, http.MethodPost, "/order", PlaceOrderRequest{
+		UserID: 1,
+		Type:   LimitOrder,
+		Size:   5,
+		Price:  10_000,
+		Market: MarketEth,
+	})
+
+	view := eng.currentView()
+	assert(t, *view.BestAsk, Level{Price: 10_000, Size: 15})
+	assert(t, len(view.Book.Asks), 2)
+	assert(t, view.Book.TotalAskVolume, 15.0)
+
+	// views already handed out never change
+	assert(t, old.BestAsk == nil, true)
+	assert(t, len(old.Book.Asks), 0)
+}
+
+func TestEnginePause(t *testing.T) {
+	ex, _ := newTestExchange(t)
+	eng := engineOf(ex, MarketEth)
+
+	resume := eng.pause()
+	done := make(chan struct{})
+	go func() {
+		eng.do(func(ob *orderbook.Orderbook) {
+			ob.PlaceLimitOrder(10_000, orderbook.NewOrder(false, 1, 1))
+		})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("command ran on a paused engine")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert(t, len(eng.ob.Orders), 0)
+
+	resume()
+	<-done
+	assert(t, eng.currentView().Book.TotalAskVolume, 1.0)
+}
+
+func TestCancelOrders(t *testing.T) {
+	ex, e := newTestExchange(t)
+
+	place := func(userID int64, bid bool, price float64) {
+		doRequestAs(e, userID, http.MethodPost, "/order", PlaceOrderRequest{
+			UserID: userID,
+			Type:   LimitOrder,
+			Bid:    bid,
+			Size:   10,
+			Price:  price,
+			Market: MarketEth,
+		})
+	}
+	place(1, false, 10_000)
+	place(1, false, 10_100)
+	place(1, true, 9_000)
+	place(2, false, 10_000)
+
+	rec := doRequestAs(e, 1, http.MethodDelete, "/orders?market=ETH&side=ask", nil)
+	assert(t, rec.Code, http.StatusOK)
+
+	var resp CancelOrdersResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, len(resp.Cancelled), 2)
+	assert(t, resp.Cancelled[0].Price, 10_000.0)
+	assert(t, resp.Cancelled[1].Size, 10.0)
+
+	assert(t, len(ex.Orders[1]), 1)
+	view := engineOf(ex, MarketEth).currentView()
+	assert(t, view.Book.TotalAskVolume, 10.0)
+	assert(t, view.Book.TotalBidVolume, 10.0)
+
+	rec = doRequestAs(e, 1, http.MethodDelete, "/orders?market=BTC", nil)
+	assert(t, rec.Code, http.StatusBadRequest)
+}
+
+func TestDeadMansSwitch(t *testing.T) {
+	ex, e := newTestExchange(t)
+
+	doRequestAs(e, 1, http.MethodPost, "/order", PlaceOrderRequest{
+		UserID: 1,
+		Type:   LimitOrder,
+		Size:   10,
+		Price:  10_000,
+		Market: MarketEth,
+	})
+	doRequestAs(e, 2, http.MethodPost, "/order", PlaceOrderRequest{
+		UserID: 2,
+		Type:   LimitOrder,
+		Size:   10,
+		Price:  10_000,
+		Market: MarketEth,
+	})
+
+	rec := doRequestAs(e, 1, http.MethodPost, "/heartbeat", HeartbeatRequest{TimeoutMillis: 50})
+	assert(t, rec.Code, http.StatusOK)
+
+	// keep refreshing for a while, nothing may get cancelled
+	for i := 0; i < 4; i++ {
+		time.Sleep(20 * time.Millisecond)
+		doRequestAs(e, 1, http.MethodPost, "/heartbeat", HeartbeatRequest{TimeoutMillis: 50})
+	}
+	assert(t, engineOf(ex, MarketEth).currentView().Book.TotalAskVolume, 20.0)
+
+	time.Sleep(150 * time.Millisecond)
+	assert(t, ex.deadMan.armed(1), false)
+	assert(t, engineOf(ex, MarketEth).currentView().Book.TotalAskVolume, 10.0)
+
+	ex.mu.RLock()
+	assert(t, len(ex.Orders[1]), 0)
+	ex.mu.RUnlock()
+}
+
+func TestGetOrderStatus(t *testing.T) {
+	_, e := newTestExchange(t)
+
+	rec := doRequestAs(e, 1, http.MethodPost, "/order", PlaceOrderRequest{
+		UserID: 1,
+		Type:   LimitOrder,
+		Size:   10,
+		Price:  10_000,
+		Market: MarketEth,
+	})
+	var placed PlaceOrderResponse
+	json.NewDecoder(rec.Body).Decode(&placed)
+	assert(t, placed.Status, orderbook.StatusNew)
+
+	rec = doRequestAs(e, 2, http.MethodPost, "/order", PlaceOrderRequest{
+		UserID: 2,
+		Type:   MarketOrder,
+		Bid:    true,
+		Size:   20,
+		Market: MarketEth,
+	})
+	assert(t, rec.Code, http.StatusUnprocessableEntity)
+	var rejected APIError
+	json.NewDecoder(rec.Body).Decode(&rejected)
+	assert(t, rejected.Code, ErrCodeInsufficientLiquidity)
+	rejectedID := int64(rejected.Details["OrderID"].(float64))
+
+	doRequestAs(e, 1, http.MethodDelete, fmt.Sprintf("/order/%d", placed.OrderID), nil)
+
+	var status OrderStatusResponse
+	rec = doRequestAs(e, 1, http.MethodGet, fmt.Sprintf("/orders/%d", placed.OrderID), nil)
+	json.NewDecoder(rec.Body).Decode(&status)
+	assert(t, status.Status, orderbook.StatusCancelled)
+	assert(t, status.Reason, orderbook.ReasonCancelledByUser)
+	assert(t, status.Price, 10_000.0)
+	assert(t, status.RemainingSize, 10.0)
+
+	rec = doRequestAs(e, 2, http.MethodGet, fmt.Sprintf("/orders/%d", rejectedID), nil)
+	json.NewDecoder(rec.Body).Decode(&status)
+	assert(t, status.Status, orderbook.StatusRejected)
+	assert(t, status.Reason, orderbook.ReasonInsufficientLiquidity)
+
+	rec = doRequestAs(e, 1, http.MethodGet, "/orders/424242", nil)
+	assert(t, rec.Code, http.StatusNotFound)
+}
+
+func TestFinishedOrders(t *testing.T) {
+	ex, e := newTestExchange(t)
+
+	place := func() int64 {
+		rec := doRequestAs(e, 1, http.MethodPost, "/order", PlaceOrderRequest{Type: LimitOrder, Size: 1, Price: 10_000, Market: MarketEth})
+		var placed PlaceOrderResponse
+		json.NewDecoder(rec.Body).Decode(&placed)
+		doRequestAs(e, 1, http.MethodDelete, fmt.Sprintf("/order/%d", placed.OrderID), nil)
+		return placed.OrderID
+	}
+	status := func(e *echo.Echo, id int64) int {
+		return doRequestAs(e, 1, http.MethodGet, fmt.Sprintf("/orders/%d", id), nil).Code
+	}
+
+	// cancelled orders survive a restart
+	first := place()
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	if err := ex.WriteSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	restored, restoredEcho := newTestExchange(t)
+	if err := restored.RestoreSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, status(restoredEcho, first), http.StatusOK)
+
+	// the oldest are forgotten past the limit
+	eng := engineOf(ex, MarketEth)
+	eng.do(func(*orderbook.Orderbook) { eng.maxFinished = 2 })
+	second, third := place(), place()
+	assert(t, status(e, first), http.StatusNotFound)
+	assert(t, status(e, second), http.StatusOK)
+	assert(t, status(e, third), http.StatusOK)
+
+	// and once the retention passed
+	eng.do(func(*orderbook.Orderbook) { eng.retention = 0 })
+	assert(t, status(e, third), http.StatusNotFound)
+}
+
+func TestNotionalOrders(t *testing.T) {
+	ex, e := newTestExchange(t)
+	settler := &recordingSettler{}
+	ex.Settler = settler
+
+	place := func(userID int64, req PlaceOrderRequest) *httptest.ResponseRecorder {
+		req.Market = MarketEth
+		return doRequestAs(e, userID, http.MethodPost, "/order", req)
+	}
+	rejected := func(rec *httptest.ResponseRecorder, status int, code ErrorCode) {
+		t.Helper()
+		assert(t, rec.Code, status)
+		var apiErr APIError
+		json.NewDecoder(rec.Body).Decode(&apiErr)
+		assert(t, apiErr.Code, code)
+	}
+
+	place(1, PlaceOrderRequest{Type: LimitOrder, Size: 1, Price: 10_000})
+	place(1, PlaceOrderRequest{Type: LimitOrder, Size: 1, Price: 10_100})
+
+	rejected(place(2, PlaceOrderRequest{Type: MarketOrder, Bid: true, Size: 1, Notional: 10_000}), http.StatusBadRequest, ErrCodeValidation)
+	rejected(place(2, PlaceOrderRequest{Type: MarketOrder, Bid: true, Notional: -10_000}), http.StatusBadRequest, ErrCodeValidation)
+	rejected(place(2, PlaceOrderRequest{Type: LimitOrder, Bid: true, Price: 9_000, Notional: 9_000}), http.StatusBadRequest, ErrCodeValidation)
+	rejected(place(2, PlaceOrderRequest{Type: MarketOrder, Bid: true, Notional: 1_000_000}), http.StatusUnprocessableEntity, ErrCodeInsufficientLiquidity)
+	assert(t, len(settler.amounts), 0)
+
+	var prev PlaceOrderResponse
+	json.NewDecoder(place(1, PlaceOrderRequest{Type: LimitOrder, Size: 1, Price: 11_000}).Body).Decode(&prev)
+
+	// the second level is taken out by half, in wei
+	rec := place(2, PlaceOrderRequest{Type: MarketOrder, Bid: true, Notional: 15_050})
+	assert(t, rec.Code, http.StatusOK)
+	var filled PlaceOrderResponse
+	json.NewDecoder(rec.Body).Decode(&filled)
+	assert(t, filled.Status, orderbook.StatusFilled)
+	// a notional order takes a single order ID
+	assert(t, filled.OrderID, prev.OrderID+1)
+	assert(t, filled.BaseFilled, 1.5)
+	assert(t, filled.QuoteFilled, 15_050.0)
+	assert(t, len(settler.amounts), 2)
+	assert(t, settler.amounts[0].String(), "1000000000000000000")
+	assert(t, settler.amounts[1].String(), "500000000000000000")
+
+	cfg := MarketConfig{Decimals: 6}
+	assert(t, cfg.baseUnits(0.1).String(), "100000")
+	assert(t, cfg.baseUnits(1.0000005).String(), "1000000")
+}
+
+func TestOrderValidation(t *testing.T) {
+	ex, e := newTestExchange(t)
+
+	for _, req := range []PlaceOrderRequest{
+		{Type: LimitOrder, Size: -5, Notional: -1, Price: 10_000},
+		{Type: LimitOrder, Size: 1, Notional: 10_000, Price: 10_000},
+		{Type: LimitOrder, Notional: 10_000, Price: 10_000},
+		{Type: LimitOrder, Size: -5, Price: 10_000},
+		{Type: LimitOrder, Size: 0.00001, Price: 10_000},
+		{Type: MarketOrder, Size: -5, Notional: -1},
+		{Type: MarketOrder, Size: 1, Notional: -1},
+	} {
+		req.Market = MarketEth
+		rec := doRequestAs(e, 1, http.MethodPost, "/order", req)
+		assert(t, rec.Code, http.StatusBadRequest)
+		var apiErr APIError
+		json.NewDecoder(rec.Body).Decode(&apiErr)
+		assert(t, apiErr.Code, ErrCodeValidation)
+	}
+
+	// gRPC requests can carry what JSON cannot
+	cfg := DefaultMarkets()[0]
+	for _, req := range []PlaceOrderRequest{
+		{Type: LimitOrder, Size: math.NaN(), Price: 10_000},
+		{Type: LimitOrder, Size: 1, Price: math.Inf(1)},
+		{Type: MarketOrder, Notional: math.NaN()},
+	} {
+		if err := cfg.validateOrder(&req); err == nil {
+			t.Errorf("%+v is valid", req)
+		}
+	}
+
+	eng := engineOf(ex, MarketEth)
+	eng.do(func(ob *orderbook.Orderbook) {
+		assert(t, len(ob.Orders), 0)
+		if err := ob.Validate(); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestMarketRegistry(t *testing.T) {
+	_, e := newTestExchange(t)
+
+	rec := doRequestAs(e, 1, http.MethodPost, "/admin/markets", MarketConfig{
+		Symbol:     "BTC",
+		BaseAsset:  "BTC",
+		QuoteAsset: "USD",
+		TickSize:   0.5,
+		LotSize:    0.001,
+	})
+	assert(t, rec.Code, http.StatusUnauthorized)
+
+	rec = doAdminRequest(e, http.MethodPost, "/admin/markets", MarketConfig{
+		Symbol:     "BTC",
+		BaseAsset:  "BTC",
+		QuoteAsset: "USD",
+		TickSize:   0.5,
+		LotSize:    0.001,
+	})
+	assert(t, rec.Code, http.StatusOK)
+
+	rec = doRequest(e, http.MethodGet, "/markets", nil)
+	var markets []MarketConfig
+	json.NewDecoder(rec.Body).Decode(&markets)
+	assert(t, len(markets), 2)
+	assert(t, markets[0].Symbol, Market("BTC"))
+	assert(t, markets[0].Status, MarketActive)
+
+	btcOrder := PlaceOrderRequest{
+		UserID: 1,
+		Type:   LimitOrder,
+		Size:   1,
+		Price:  60_000.25,
+		Market: "BTC",
+	}
+	rec = doRequestAs(e, 1, http.MethodPost, "/order", btcOrder)
+	assert(t, rec.Code, http.StatusBadRequest)
+
+	btcOrder.Price = 60_000.5
+	rec = doRequestAs(e, 1, http.MethodPost, "/order", btcOrder)
+	assert(t, rec.Code, http.StatusOK)
+	var placed PlaceOrderResponse
+	json.NewDecoder(rec.Body).Decode(&placed)
+
+	rec = doAdminRequest(e, http.MethodDelete, "/admin/markets/BTC?reason=test", nil)
+	assert(t, rec.Code, http.StatusOK)
+
+	rec = doRequestAs(e, 1, http.MethodPost, "/order", btcOrder)
+	assert(t, rec.Code, http.StatusBadRequest)
+
+	var status OrderStatusResponse
+	rec = doRequestAs(e, 1, http.MethodGet, fmt.Sprintf("/orders/%d", placed.OrderID), nil)
+	json.NewDecoder(rec.Body).Decode(&status)
+	assert(t, status.Market, Market("BTC"))
+	assert(t, status.Status, orderbook.StatusCancelled)
+	assert(t, status.Reason, orderbook.ReasonMarketDelisted)
+
+	rec = doRequest(e, http.MethodGet, "/book/DOGE", nil)
+	assert(t, rec.Code, http.StatusNotFound)
+}
+
+func TestAdminRoutesNeedAdminKey(t *testing.T) {
+	ex, e := newTestExchange(t)
+
+	params := strings.NewReplacer(":market", string(MarketEth), ":id", "1")
+	routes := 0
+	for _, route := range e.Routes() {
+		if !strings.HasPrefix(route.Path, "/admin") {
+			continue
+		}
+		routes++
+		path := params.Replace(route.Path)
+		assert(t, doRequest(e, route.Method, path, nil).Code, http.StatusUnauthorized)
+		assert(t, doRequestAs(e, 1, route.Method, path, nil).Code, http.StatusUnauthorized)
+	}
+	if routes == 0 {
+		t.Fatal("no admin routes")
+	}
+
+	cfg, _ := ex.markets.config(MarketEth)
+	assert(t, cfg.Status, MarketActive)
+}
+
+func TestTickerStats(t *testing.T) {
+	var stats tickerStats
+	now := time.Now()
+	trade := func(ago time.Duration, price, size float64) {
+		stats.add(&orderbook.Trade{Price: price, Size: size, TimeStamp: now.Add(-ago).UnixNano()})
+	}
+
+	trade(30*time.Hour, 500, 1)
+	trade(23*time.Hour, 1_000, 1)
+	trade(2*time.Hour, 1_300, 2)
+	trade(time.Hour, 900, 1)
+	trade(time.Minute, 1_100, 4)
+
+	ticker := stats.ticker(MarketEth, now)
+	assert(t, ticker.LastPrice, 1_100.0)
+	assert(t, ticker.LastSize, 4.0)
+	assert(t, ticker.Open, 1_000.0)
+	assert(t, ticker.High, 1_300.0)
+	assert(t, ticker.Low, 900.0)
+	assert(t, ticker.Volume, 8.0)
+	assert(t, ticker.QuoteVolume, 8_900.0)
+	assert(t, ticker.Change, 100.0)
+	assert(t, ticker.ChangePercent, 10.0)
+}
+
+func TestGetTicker(t *testing.T) {
+	_, e := newTestExchange(t)
+
+	doRequestAs(e, 1, http.MethodPost, "/order", PlaceOrderRequest{
+		UserID: 1,
+		Type:   LimitOrder,
+		Size:   10,
+		Price:  10_000,
+		Market: MarketEth,
+	})
+	doRequestAs(e, 1, http.MethodPost, "/order", PlaceOrderRequest{
+		UserID: 1,
+		Type:   LimitOrder,
+		Bid:    true,
+		Size:   5,
+		Price:  9_000,
+		Market: MarketEth,
+	})
+	// settlement fails without users, the trade is still on the tape
+	doRequestAs(e, 2, http.MethodPost, "/order", PlaceOrderRequest{
+		UserID: 2,
+		Type:   MarketOrder,
+		Bid:    true,
+		Size:   4,
+		Market: MarketEth,
+	})
+
+	rec := doRequest(e, http.MethodGet, "/ticker/ETH", nil)
+	var ticker Ticker
+	json.NewDecoder(rec.Body).Decode(&ticker)
+	assert(t, *ticker.BestAsk, Level{Price: 10_000, Size: 6})
+	assert(t, *ticker.BestBid, Level{Price: 9_000, Size: 5})
+	assert(t, ticker.LastPrice, 10_000.0)
+	assert(t, ticker.Volume, 4.0)
+
+	rec = doRequest(e, http.MethodGet, "/ticker/DOGE", nil)
+	assert(t, rec.Code, http.StatusNotFound)
+}
+
+func TestAuthentication(t *testing.T) {
+	ex, e := newTestExchange(t)
+
+	order := PlaceOrderRequest{
+		Type:   LimitOrder,
+		Size:   10,
+		Price:  10_000,
+		Market: MarketEth,
+	}
+
+	rec := doRequest(e, http.MethodPost, "/order", order)
+	assert(t, rec.Code, http.StatusUnauthorized)
+
+	// the signature covers the body
+	body, _ := json.Marshal(order)
+	req := httptest.NewRequest(http.MethodPost, "/order", bytes.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	signRequest(req, 1, []byte(`{}`))
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert(t, rec.Code, http.StatusUnauthorized)
+
+	// a replayed request is refused
+	req = httptest.NewRequest(http.MethodPost, "/order", bytes.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	signRequest(req, 1, body)
+	replay := req.Clone(req.Context())
+	replay.Body = io.NopCloser(bytes.NewReader(body))
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert(t, rec.Code, http.StatusOK)
+	var placed PlaceOrderResponse
+	json.NewDecoder(rec.Body).Decode(&placed)
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, replay)
+	assert(t, rec.Code, http.StatusUnauthorized)
+
+	// stale timestamps are refused
+	ex.auth.now = func() time.Time { return time.Now().Add(time.Minute) }
+	rec = doRequestAs(e, 1, http.MethodGet, fmt.Sprintf("/orders/%d", placed.OrderID), nil)
+	assert(t, rec.Code, http.StatusUnauthorized)
+	ex.auth.now = time.Now
+
+	// signed bodies are capped
+	big := bytes.Repeat([]byte(" "), maxSignedBody+1)
+	req = httptest.NewRequest(http.MethodPost, "/order", bytes.NewReader(big))
+	signRequest(req, 1, big)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert(t, rec.Code, http.StatusRequestEntityTooLarge)
+
+	// users only ever act for themselves
+	order.UserID = 1
+	rec = doRequestAs(e, 2, http.MethodPost, "/order", order)
+	assert(t, rec.Code, http.StatusForbidden)
+	rec = doRequestAs(e, 2, http.MethodGet, "/order/1", nil)
+	assert(t, rec.Code, http.StatusForbidden)
+	rec = doRequestAs(e, 2, http.MethodGet, fmt.Sprintf("/orders/%d", placed.OrderID), nil)
+	assert(t, rec.Code, http.StatusNotFound)
+	rec = doRequestAs(e, 2, http.MethodDelete, fmt.Sprintf("/order/%d", placed.OrderID), nil)
+	assert(t, rec.Code, http.StatusNotFound)
+	assert(t, engineOf(ex, MarketEth).currentView().Book.TotalAskVolume, 10.0)
+
+	rec = doRequestAs(e, 1, http.MethodGet, fmt.Sprintf("/orders/%d", placed.OrderID), nil)
+	var status OrderStatusResponse
+	json.NewDecoder(rec.Body).Decode(&status)
+	assert(t, status.UserID, int64(1))
+}
+
+func TestNonceExpiry(t *testing.T) {
+	a := newAuthenticator()
+	a.addKey(&APIKey{Key: "k", Secret: "s", UserID: 1})
+	base := time.Now()
+	now := base
+	a.now = func() time.Time { return now }
+
+	verify := func(sent time.Time) error {
+		ts := sent.UnixMilli()
+		_, err := a.verify("k", ts, "n", Sign("s", ts, "n", http.MethodGet, "/", nil), http.MethodGet, "/", nil)
+		return err
+	}
+
+	assert(t, verify(now), nil)
+	// replays are refused for as long as the timestamp is valid
+	now = base.Add(50 * time.Second)
+	if verify(base.Add(20*time.Second)) == nil {
+		t.Fatal("nonce reused")
+	}
+	now = base.Add(70 * time.Second)
+	if verify(base.Add(40*time.Second)) == nil {
+		t.Fatal("nonce reused after a rotation")
+	}
+	// and forgotten after
+	now = base.Add(130 * time.Second)
+	assert(t, verify(now), nil)
+	assert(t, len(a.previous), 0)
+}
+
+func TestSignedOrders(t *testing.T) {
+	ex, e := newTestExchange(t)
+	ex.RequireSignedOrders = true
+	user := ex.Users[1]
+
+	order := PlaceOrderRequest{
+		Type:   LimitOrder,
+		Size:   10,
+		Price:  10_000,
+		Market: MarketEth,
+		Nonce:  1,
+	}
+	rec := doRequestAs(e, 1, http.MethodPost, "/order", order)
+	assert(t, rec.Code, http.StatusUnauthorized)
+
+	other, _ := crypto.GenerateKey()
+	order.Signature, _ = SignOrder(other, newOrderMessage(DefaultChainID, user.Address(), &order))
+	rec = doRequestAs(e, 1, http.MethodPost, "/order", order)
+	assert(t, rec.Code, http.StatusUnauthorized)
+
+	order.Signature, _ = SignOrder(user.PrivateKey, newOrderMessage(DefaultChainID, user.Address(), &order))
+	rec = doRequestAs(e, 1, http.MethodPost, "/order", order)
+	assert(t, rec.Code, http.StatusOK)
+	var placed PlaceOrderResponse
+	json.NewDecoder(rec.Body).Decode(&placed)
+
+	// the signature does not cover a different price
+	tampered := order
+	tampered.Price = 10_100
+	rec = doRequestAs(e, 1, http.MethodPost, "/order", tampered)
+	assert(t, rec.Code, http.StatusUnauthorized)
+
+	// a signed order is only ever placed once
+	rec = doRequestAs(e, 1, http.MethodPost, "/order", order)
+	assert(t, rec.Code, http.StatusConflict)
+
+	expired := order
+	expired.Nonce = 2
+	expired.Expiry = time.Now().Add(-time.Minute).Unix()
+	expired.Signature, _ = SignOrder(user.PrivateKey, newOrderMessage(DefaultChainID, user.Address(), &expired))
+	rec = doRequestAs(e, 1, http.MethodPost, "/order", expired)
+	assert(t, rec.Code, http.StatusUnauthorized)
+
+	// the stored proof verifies without the exchange
+	rec = doRequestAs(e, 1, http.MethodGet, fmt.Sprintf("/orders/%d/signature", placed.OrderID), nil)
+	assert(t, rec.Code, http.StatusOK)
+	var signed SignedOrder
+	json.NewDecoder(rec.Body).Decode(&signed)
+	assert(t, signed.OrderID, placed.OrderID)
+	assert(t, signed.Message.Trader, user.Address())
+	assert(t, signed.Verify(), nil)
+
+	signed.Message.Size = 20
+	if signed.Verify() == nil {
+		t.Fatal("tampered signed order verified")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	ex, e := newTestExchange(t)
+	ex.SetRateLimits(RateLimits{
+		PerUser: Budgets{
+			Orders: RateLimit{Rate: 1, Burst: 2},
+		},
+		PerIP: Budgets{
+			Reads: RateLimit{Rate: 1, Burst: 3},
+		},
+	})
+	now := time.Now()
+	ex.limiter.now = func() time.Time { return now }
+
+	order := PlaceOrderRequest{
+		Type:   LimitOrder,
+		Size:   10,
+		Price:  10_000,
+		Market: MarketEth,
+	}
+	rec := doRequestAs(e, 1, http.MethodPost, "/order", order)
+	assert(t, rec.Code, http.StatusOK)
+	assert(t, rec.Header().Get(HeaderRateLimit), "2")
+	assert(t, rec.Header().Get(HeaderRateLimitRemaining), "1")
+	doRequestAs(e, 1, http.MethodPost, "/order", order)
+
+	rec = doRequestAs(e, 1, http.MethodPost, "/order", order)
+	assert(t, rec.Code, http.StatusTooManyRequests)
+	assert(t, rec.Header().Get(HeaderRetryAfter), "1")
+
+	// budgets are per user and per kind of request
+	rec = doRequestAs(e, 2, http.MethodPost, "/order", order)
+	assert(t, rec.Code, http.StatusOK)
+	rec = doRequestAs(e, 1, http.MethodDelete, "/orders?market=ETH", nil)
+	assert(t, rec.Code, http.StatusOK)
+
+	now = now.Add(time.Second)
+	rec = doRequestAs(e, 1, http.MethodPost, "/order", order)
+	assert(t, rec.Code, http.StatusOK)
+
+	// reads are limited per address, signed or not
+	doRequest(e, http.MethodGet, "/book/ETH", nil)
+	doRequest(e, http.MethodGet, "/markets", nil)
+	doRequestAs(e, 2, http.MethodGet, "/order/2", nil)
+	rec = doRequest(e, http.MethodGet, "/ticker/ETH", nil)
+	assert(t, rec.Code, http.StatusTooManyRequests)
+}
+
+func TestRateLimitBeforeAuth(t *testing.T) {
+	ex, e := newTestExchange(t)
+	ex.SetRateLimits(RateLimits{
+		PerIP: Budgets{
+			Orders: RateLimit{Rate: 1, Burst: 2},
+		},
+	})
+	now := time.Now()
+	ex.limiter.now = func() time.Time { return now }
+
+	// failed signatures pay like the others
+	badSignature := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/order", strings.NewReader("{}"))
+		signRequestWith(req, "key-1", "wrong", []byte("{}"))
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	assert(t, badSignature(), http.StatusUnauthorized)
+	assert(t, doRequest(e, http.MethodPost, "/order", nil).Code, http.StatusUnauthorized)
+	assert(t, badSignature(), http.StatusTooManyRequests)
+	rec := doRequestAs(e, 1, http.MethodPost, "/order", PlaceOrderRequest{Type: LimitOrder, Size: 1, Price: 10_000, Market: MarketEth})
+	assert(t, rec.Code, http.StatusTooManyRequests)
+}
+
+func TestRateLimitForwardedFor(t *testing.T) {
+	ex, e := newTestExchange(t)
+	ex.SetRateLimits(RateLimits{
+		PerIP: Budgets{
+			Reads: RateLimit{Rate: 1, Burst: 2},
+		},
+	})
+	now := time.Now()
+	ex.limiter.now = func() time.Time { return now }
+
+	// httptest requests come from 192.0.2.1
+	read := func(forwardedFor string) int {
+		req := httptest.NewRequest(http.MethodGet, "/markets", nil)
+		req.Header.Set(echo.HeaderXForwardedFor, forwardedFor)
+		req.Header.Set(echo.HeaderXRealIP, forwardedFor)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// a spoofed header does not get a fresh bucket
+	assert(t, read("10.0.0.1"), http.StatusOK)
+	assert(t, read("10.0.0.2"), http.StatusOK)
+	assert(t, read("10.0.0.3"), http.StatusTooManyRequests)
+
+	// behind a trusted proxy every client has its own
+	if err := ex.SetTrustedProxies([]string{"192.0.2.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, read("10.0.0.4"), http.StatusOK)
+	assert(t, read("10.0.0.5"), http.StatusOK)
+	assert(t, read("10.0.0.4"), http.StatusOK)
+	assert(t, read("10.0.0.4"), http.StatusTooManyRequests)
+}
+
+func TestOrderToTradeRatio(t *testing.T) {
+	ex, e := newTestExchange(t)
+	ex.SetRateLimits(RateLimits{
+		OrderToTrade: OrderToTradeLimit{MaxRatio: 2, MinOrders: 3, Window: time.Minute},
+	})
+
+	order := PlaceOrderRequest{
+		Type:   LimitOrder,
+		Size:   1,
+		Price:  10_000,
+		Market: MarketEth,
+	}
+	for i := 0; i < 3; i++ {
+		rec := doRequestAs(e, 1, http.MethodPost, "/order", order)
+		assert(t, rec.Code, http.StatusOK)
+	}
+	rec := doRequestAs(e, 1, http.MethodPost, "/order", order)
+	assert(t, rec.Code, http.StatusTooManyRequests)
+	assert(t, rec.Header().Get(HeaderOrderTradeRatio), "3.00")
+
+	// trading brings the ratio back down
+	rec = doRequestAs(e, 2, http.MethodPost, "/order", PlaceOrderRequest{
+		Type:   MarketOrder,
+		Bid:    true,
+		Size:   2,
+		Market: MarketEth,
+	})
+	assert(t, rec.Code, http.StatusOK)
+	rec = doRequestAs(e, 1, http.MethodPost, "/order", order)
+	assert(t, rec.Code, http.StatusOK)
+	assert(t, rec.Header().Get(HeaderOrderTradeRatio), "2.00")
+}
+
+func TestErrorResponses(t *testing.T) {
+	_, e := newTestExchange(t)
+
+	decode := func(rec *httptest.ResponseRecorder) APIError {
+		t.Helper()
+		var apiErr APIError
+		if err := json.NewDecoder(rec.Body).Decode(&apiErr); err != nil {
+			t.Fatal(err)
+		}
+		assert(t, apiErr.RequestID, rec.Header().Get(echo.HeaderXRequestID))
+		return apiErr
+	}
+
+	rec := doRequestAs(e, 1, http.MethodPost, "/order", PlaceOrderRequest{
+		Type:   LimitOrder,
+		Size:   10,
+		Price:  10_000.001,
+		Market: MarketEth,
+	})
+	assert(t, rec.Code, http.StatusBadRequest)
+	assert(t, decode(rec).Code, ErrCodeValidation)
+
+	rec = doRequestAs(e, 1, http.MethodPost, "/order", PlaceOrderRequest{
+		Type:   LimitOrder,
+		Size:   10,
+		Price:  10_000,
+		Market: "DOGE",
+	})
+	assert(t, decode(rec).Code, ErrCodeUnknownMarket)
+
+	rec = doRequestAs(e, 1, http.MethodPost, "/order", "not an order")
+	assert(t, rec.Code, http.StatusBadRequest)
+	assert(t, decode(rec).Code, ErrCodeBadRequest)
+
+	rec = doRequestAs(e, 1, http.MethodDelete, "/order/424242", nil)
+	assert(t, rec.Code, http.StatusNotFound)
+	assert(t, decode(rec).Code, ErrCodeUnknownOrder)
+
+	rec = doRequest(e, http.MethodGet, "/nowhere", nil)
+	assert(t, rec.Code, http.StatusNotFound)
+	assert(t, decode(rec).Code, ErrCodeNotFound)
+
+	// the ID of the caller is kept
+	req := httptest.NewRequest(http.MethodGet, "/book/DOGE", nil)
+	req.Header.Set(echo.HeaderXRequestID, "req-1")
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert(t, decode(rec), APIError{
+		Code:      ErrCodeUnknownMarket,
+		Message:   "market DOGE not found",
+		RequestID: "req-1",
+	})
+}
+
+func TestClientOrderID(t *testing.T) {
+	ex, e := newTestExchange(t)
+
+	order := PlaceOrderRequest{
+		ClientOrderID: "a",
+		Type:          LimitOrder,
+		Size:          10,
+		Price:         10_000,
+		Market:        MarketEth,
+	}
+	place := func(userID int64, order PlaceOrderRequest) (*httptest.ResponseRecorder, PlaceOrderResponse) {
+		t.Helper()
+		rec := doRequestAs(e, userID, http.MethodPost, "/order", order)
+		var resp PlaceOrderResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec, resp
+	}
+
+	rec, first := place(1, order)
+	assert(t, rec.Code, http.StatusOK)
+	assert(t, first.ClientOrderID, "a")
+
+	// a retry returns the original response and places nothing
+	rec, retry := place(1, order)
+	assert(t, rec.Code, http.StatusOK)
+	assert(t, retry, first)
+	assert(t, engineOf(ex, MarketEth).currentView().Book.TotalAskVolume, 10.0)
+
+	changed := order
+	changed.Price = 10_100
+	rec, _ = place(1, changed)
+	assert(t, rec.Code, http.StatusConflict)
+
+	// client order IDs are per user
+	rec, other := place(2, order)
+	assert(t, rec.Code, http.StatusOK)
+	if other.OrderID == first.OrderID {
+		t.Fatal("orders of different users deduplicated")
+	}
+
+	// invalid orders do not use up the ID
+	invalid := order
+	invalid.ClientOrderID = "b"
+	invalid.Price = 10_000.001
+	rec, _ = place(1, invalid)
+	assert(t, rec.Code, http.StatusBadRequest)
+	invalid.Price = 10_000
+	rec, _ = place(1, invalid)
+	assert(t, rec.Code, http.StatusOK)
+
+	// rejected orders are answered the same on retry
+	rejected := PlaceOrderRequest{
+		ClientOrderID: "m",
+		Type:          MarketOrder,
+		Bid:           true,
+		Size:          1_000,
+		Market:        MarketEth,
+	}
+	rec, _ = place(3, rejected)
+	assert(t, rec.Code, http.StatusUnprocessableEntity)
+	body := rec.Body.String()
+	rec, _ = place(3, rejected)
+	assert(t, rec.Code, http.StatusUnprocessableEntity)
+	var firstErr, retryErr APIError
+	json.Unmarshal([]byte(body), &firstErr)
+	json.Unmarshal(rec.Body.Bytes(), &retryErr)
+	assert(t, retryErr.Details, firstErr.Details)
+
+	rec = doRequestAs(e, 1, http.MethodGet, "/orders/client/a", nil)
+	assert(t, rec.Code, http.StatusOK)
+	var status OrderStatusResponse
+	json.NewDecoder(rec.Body).Decode(&status)
+	assert(t, status.ID, first.OrderID)
+	assert(t, status.ClientOrderID, "a")
+
+	rec = doRequestAs(e, 1, http.MethodDelete, "/order/client/a", nil)
+	assert(t, rec.Code, http.StatusOK)
+	rec = doRequestAs(e, 1, http.MethodGet, "/orders/client/a", nil)
+	json.NewDecoder(rec.Body).Decode(&status)
+	assert(t, status.Status, orderbook.StatusCancelled)
+
+	rec = doRequestAs(e, 4, http.MethodGet, "/orders/client/a", nil)
+	assert(t, rec.Code, http.StatusNotFound)
+
+	// client order IDs survive a restart, one still being placed is
+	// refused rather than placed twice
+	inFlight := order
+	inFlight.UserID, inFlight.ClientOrderID = 1, "p"
+	if _, _, err := ex.clientOrders.reserve(&inFlight); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	if err := ex.WriteSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	restored, re := newTestExchange(t)
+	if err := restored.RestoreSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	rec = doRequestAs(re, 1, http.MethodPost, "/order", order)
+	assert(t, rec.Code, http.StatusOK)
+	json.NewDecoder(rec.Body).Decode(&retry)
+	assert(t, retry, first)
+	rec = doRequestAs(re, 3, http.MethodPost, "/order", rejected)
+	assert(t, rec.Code, http.StatusUnprocessableEntity)
+	rec = doRequestAs(re, 1, http.MethodPost, "/order", inFlight)
+	assert(t, rec.Code, http.StatusConflict)
+	rec = doRequestAs(re, 1, http.MethodGet, "/orders/client/a", nil)
+	assert(t, rec.Code, http.StatusOK)
+
+	// after the retention window the ID is forgotten
+	ex.clientOrders.now = func() time.Time { return time.Now().Add(clientOrderRetention + time.Minute) }
+	rec = doRequestAs(e, 1, http.MethodGet, "/orders/client/a", nil)
+	assert(t, rec.Code, http.StatusNotFound)
+}
+
+func TestFills(t *testing.T) {
+	ex, e := newTestExchange(t)
+
+	for _, price := range []float64{10_000, 10_100, 10_200} {
+		doRequestAs(e, 1, http.MethodPost, "/order", PlaceOrderRequest{
+			Type:   LimitOrder,
+			Size:   1,
+			Price:  price,
+			Market: MarketEth,
+		})
+	}
+	for i := 0; i < 3; i++ {
+		rec := doRequestAs(e, 2, http.MethodPost, "/order", PlaceOrderRequest{
+			Type:   MarketOrder,
+			Bid:    true,
+			Size:   1,
+			Market: MarketEth,
+		})
+		assert(t, rec.Code, http.StatusOK)
+	}
+
+	getFills := func(userID int64, query string) FillsResponse {
+		t.Helper()
+		rec := doRequestAs(e, userID, http.MethodGet, "/fills"+query, nil)
+		assert(t, rec.Code, http.StatusOK)
+		var resp FillsResponse
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return resp
+	}
+
+	// computed at runtime like the engine does, constants are exact
+	fee := func(quote, rate float64) float64 { return quote * rate }
+
+	page := getFills(2, "?limit=2")
+	assert(t, len(page.Fills), 2)
+	assert(t, page.Fills[0].Price, 10_200.0)
+	assert(t, page.Fills[0].Liquidity, LiquidityTaker)
+	assert(t, page.Fills[0].Fee, fee(10_200, 0.002))
+	assert(t, page.Fills[1].Price, 10_100.0)
+
+	page = getFills(2, fmt.Sprintf("?limit=2&cursor=%d", page.NextCursor))
+	assert(t, len(page.Fills), 1)
+	assert(t, page.Fills[0].Price, 10_000.0)
+	assert(t, page.NextCursor, int64(0))
+
+	maker := getFills(1, "?market=ETH")
+	assert(t, len(maker.Fills), 3)
+	assert(t, maker.Fills[2].Liquidity, LiquidityMaker)
+	assert(t, maker.Fills[2].Fee, fee(10_000, 0.001))
+
+	future := time.Now().Add(time.Hour).UnixMilli()
+	assert(t, len(getFills(1, fmt.Sprintf("?since=%d", future)).Fills), 0)
+	assert(t, len(getFills(1, fmt.Sprintf("?until=%d", future)).Fills), 3)
+	assert(t, len(getFills(3, "").Fills), 0)
+
+	rec := doRequestAs(e, 1, http.MethodGet, "/fills?market=DOGE", nil)
+	assert(t, rec.Code, http.StatusBadRequest)
+	rec = doRequestAs(e, 1, http.MethodGet, "/fills?limit=0", nil)
+	assert(t, rec.Code, http.StatusBadRequest)
+
+	// fills survive a restart
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	if err := ex.WriteSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	restored, _ := newTestExchange(t)
+	if err := restored.RestoreSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := ex.fills.query(1, FillsQuery{Limit: 10})
+	got, err := restored.fills.query(1, FillsQuery{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, got, want)
+}
+
+func TestFillStore(t *testing.T) {
+	dir := t.TempDir()
+	store := newFillStore(3)
+	if err := store.setArchive(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	fills := []Fill{}
+	for i := int64(1); i <= 10; i++ {
+		fills = append(fills, Fill{
+			UserID:    1 + i%2,
+			Market:    MarketEth,
+			Bid:       i%3 == 0,
+			Price:     float64(i),
+			Size:      0.5,
+			Liquidity: LiquidityMaker,
+			Timestamp: i * 100,
+		})
+	}
+	fills[9].Liquidity = LiquidityTaker
+	// the fills leaving the ring wait for the writer, a snapshot keeps
+	// them meanwhile
+	store.add(fills)
+	if err := store.flush(); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, store.ring.len(), 3)
+	assert(t, len(store.pending), 0)
+	assert(t, len(store.recent()), 3)
+
+	ids := func(store *fillStore, userID int64, q FillsQuery) ([]int64, int64) {
+		t.Helper()
+		resp, err := store.query(userID, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := []int64{}
+		for _, fill := range resp.Fills {
+			ids = append(ids, fill.ID)
+		}
+		return ids, resp.NextCursor
+	}
+
+	// pages run from the ring into the archive
+	page, cursor := ids(store, 2, FillsQuery{Limit: 3})
+	assert(t, page, []int64{9, 7, 5})
+	assert(t, cursor, int64(5))
+	page, cursor = ids(store, 2, FillsQuery{Limit: 3, Cursor: cursor})
+	assert(t, page, []int64{3, 1})
+	assert(t, cursor, int64(0))
+	page, _ = ids(store, 1, FillsQuery{Limit: 10, Since: 350, Until: 801})
+	assert(t, page, []int64{8, 6, 4})
+
+	archived, err := store.query(2, FillsQuery{Limit: 1, Cursor: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, archived.Fills[0], fills[2])
+
+	// a restart continues the IDs and does not archive fills twice
+	restored := newFillStore(3)
+	if err := restored.setArchive(dir); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, restored.lastID, int64(7))
+	if err := restored.restore(store.recent()); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, restored.lastID, int64(10))
+	page, _ = ids(restored, 1, FillsQuery{Limit: 10})
+	assert(t, page, []int64{10, 8, 6, 4, 2})
+
+	// a snapshot holding more fills than the ring archives the rest
+	dir = t.TempDir()
+	overflow := newFillStore(3)
+	if err := overflow.setArchive(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := overflow.restore(fills); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, overflow.ring.len(), 3)
+	page, _ = ids(overflow, 2, FillsQuery{Limit: 10})
+	assert(t, page, []int64{9, 7, 5, 3, 1})
+
+	// pending fills are queried and archived on close
+	dir = t.TempDir()
+	closing := newFillStore(3)
+	if err := closing.setArchive(dir); err != nil {
+		t.Fatal(err)
+	}
+	closing.mu.Lock()
+	closing.pending = append(closing.pending, fills[:2]...)
+	closing.mu.Unlock()
+	page, _ = ids(closing, 2, FillsQuery{Limit: 10})
+	assert(t, page, []int64{1})
+	if err := closing.close(); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, len(closing.pending), 0)
+	archived, err = closing.query(1, FillsQuery{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, archived.Fills, []Fill{fills[1]})
+}
+
+func TestTradeStore(t *testing.T) {
+	store := newTradeStore(3)
+	archive, err := openTradeArchive(filepath.Join(t.TempDir(), "ETH.trades"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+	if err := store.setArchive(archive); err != nil {
+		t.Fatal(err)
+	}
+
+	trades := []*orderbook.Trade{}
+	for i := int64(1); i <= 10; i++ {
+		trades = append(trades, &orderbook.Trade{ID: i, Price: float64(i), Size: 1, Bid: i%2 == 0, TimeStamp: i * 100})
+	}
+	if err := store.add(trades); err != nil {
+		t.Fatal(err)
+	}
+	// trades already stored are skipped
+	if err := store.add(trades[8:]); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, store.ring.len(), 3)
+	assert(t, archive.n, 7)
+
+	ids := func(q TradesQuery) []int64 {
+		t.Helper()
+		trades, err := store.query(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := []int64{}
+		for _, trade := range trades {
+			ids = append(ids, trade.ID)
+		}
+		return ids
+	}
+
+	assert(t, ids(TradesQuery{Limit: 2}), []int64{9, 10})
+	assert(t, ids(TradesQuery{Limit: 4, FromID: 6}), []int64{6, 7, 8, 9})
+	assert(t, ids(TradesQuery{Limit: 10, Since: 250, Until: 500}), []int64{3, 4})
+	assert(t, ids(TradesQuery{Limit: 2, Until: 500}), []int64{3, 4})
+	assert(t, ids(TradesQuery{Limit: 10, FromID: 11}), []int64{})
+
+	archived, err := store.query(TradesQuery{Limit: 1, FromID: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, archived[0], *trades[1])
+
+	// a reopened archive continues where it stopped
+	reopened, err := openTradeArchive(archive.f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	restored := newTradeStore(3)
+	if err := restored.setArchive(reopened); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, restored.last(), int64(7))
+}
+
+func TestGetTrades(t *testing.T) {
+	ex, e := newTestExchange(t)
+	if err := ex.SetTradeArchive(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, price := range []float64{10_000, 10_100, 10_200} {
+		doRequestAs(e, 1, http.MethodPost, "/order", PlaceOrderRequest{
+			Type:   LimitOrder,
+			Size:   1,
+			Price:  price,
+			Market: MarketEth,
+		})
+	}
+	for i := 0; i < 3; i++ {
+		rec := doRequestAs(e, 2, http.MethodPost, "/order", PlaceOrderRequest{
+			Type:   MarketOrder,
+			Bid:    true,
+			Size:   1,
+			Market: MarketEth,
+		})
+		assert(t, rec.Code, http.StatusOK)
+	}
+
+	getTrades := func(query string) []orderbook.Trade {
+		t.Helper()
+		rec := doRequest(e, http.MethodGet, "/trades/ETH"+query, nil)
+		assert(t, rec.Code, http.StatusOK)
+		trades := []orderbook.Trade{}
+		json.NewDecoder(rec.Body).Decode(&trades)
+		return trades
+	}
+
+	trades := getTrades("")
+	assert(t, len(trades), 3)
+	assert(t, trades[0].ID, int64(1))
+	assert(t, trades[2].Price, 10_200.0)
+
+	latest := getTrades("?limit=1")
+	assert(t, len(latest), 1)
+	assert(t, latest[0].ID, int64(3))
+
+	page := getTrades("?fromId=2&limit=1")
+	assert(t, len(page), 1)
+	assert(t, page[0].Price, 10_100.0)
+
+	future := time.Now().Add(time.Hour).UnixMilli()
+	assert(t, len(getTrades(fmt.Sprintf("?since=%d", future))), 0)
+	assert(t, len(getTrades(fmt.Sprintf("?until=%d", future))), 3)
+
+	rec := doRequest(e, http.MethodGet, "/trades/ETH?limit=0", nil)
+	assert(t, rec.Code, http.StatusBadRequest)
+	rec = doRequest(e, http.MethodGet, "/trades/ETH?fromId=x", nil)
+	assert(t, rec.Code, http.StatusBadRequest)
+
+	// trade IDs keep growing across a restart
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	if err := ex.WriteSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	restored, e := newTestExchange(t)
+	if err := restored.RestoreSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	eng, _ := restored.engine(MarketEth)
+	assert(t, eng.trades.recent(), ex.markets.engines()[MarketEth].trades.recent())
+
+	doRequestAs(e, 1, http.MethodPost, "/order", PlaceOrderRequest{
+		Type:   LimitOrder,
+		Size:   1,
+		Price:  10_000,
+		Market: MarketEth,
+	})
+	doRequestAs(e, 2, http.MethodPost, "/order", PlaceOrderRequest{
+		Type:   MarketOrder,
+		Bid:    true,
+		Size:   1,
+		Market: MarketEth,
+	})
+	latest = getTrades("?limit=1")
+	assert(t, latest[0].ID, int64(4))
+}
+
+func TestCandles(t *testing.T) {
+	store := newCandleStore(MarketEth)
+	minute := int64(time.Minute)
+	trades := []*orderbook.Trade{
+		{ID: 1, Price: 100, Size: 1, TimeStamp: 10 * minute},
+		{ID: 2, Price: 120, Size: 2, TimeStamp: 10*minute + 1},
+		{ID: 3, Price: 90, Size: 1, TimeStamp: 11 * minute},
+		{ID: 4, Price: 110, Size: 1, TimeStamp: 16 * minute},
+	}
+
+	changed := store.add(trades[:2])
+	assert(t, len(changed), len(candleIntervals))
+	assert(t, changed[0], Candle{
+		Market:      MarketEth,
+		Interval:    Candle1m,
+		OpenTime:    10 * minute,
+		Open:        100,
+		High:        120,
+		Low:         100,
+		Close:       120,
+		Volume:      3,
+		QuoteVolume: 340,
+		Trades:      2,
+	})
+	store.add(trades[2:])
+
+	oneMinute := store.query(CandlesQuery{Interval: Candle1m, Limit: 10})
+	assert(t, len(oneMinute), 3)
+	assert(t, oneMinute[1].OpenTime, 11*minute)
+
+	fiveMinutes := store.query(CandlesQuery{Interval: Candle5m, Limit: 10})
+	assert(t, len(fiveMinutes), 2)
+	assert(t, fiveMinutes[0].Low, 90.0)
+	assert(t, fiveMinutes[0].Close, 90.0)
+	assert(t, fiveMinutes[0].Trades, 3)
+	assert(t, fiveMinutes[1].OpenTime, 15*minute)
+
+	assert(t, len(store.query(CandlesQuery{Interval: Candle1m, Limit: 1})), 1)
+	assert(t, store.query(CandlesQuery{Interval: Candle1m, Limit: 1})[0].OpenTime, 16*minute)
+	assert(t, len(store.query(CandlesQuery{Interval: Candle1m, Since: 11 * minute, Until: 16 * minute, Limit: 10})), 1)
+
+	latest, ok := store.latest(Candle1h)
+	assert(t, ok, true)
+	assert(t, latest.Volume, 5.0)
+}
+
+func TestGetCandles(t *testing.T) {
+	ex, e := newTestExchange(t)
+	if err := ex.SetTradeArchive(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	doRequestAs(e, 1, http.MethodPost, "/order", PlaceOrderRequest{
+		Type:   LimitOrder,
+		Size:   2,
+		Price:  10_000,
+		Market: MarketEth,
+	})
+	for i := 0; i < 2; i++ {
+		doRequestAs(e, 2, http.MethodPost, "/order", PlaceOrderRequest{
+			Type:   MarketOrder,
+			Bid:    true,
+			Size:   1,
+			Market: MarketEth,
+		})
+	}
+
+	getCandles := func(query string) []Candle {
+		t.Helper()
+		rec := doRequest(e, http.MethodGet, "/candles/ETH"+query, nil)
+		assert(t, rec.Code, http.StatusOK)
+		candles := []Candle{}
+		json.NewDecoder(rec.Body).Decode(&candles)
+		return candles
+	}
+
+	for _, interval := range candleIntervals {
+		// the trades may straddle the end of an interval
+		volume, trades := 0.0, 0
+		for _, candle := range getCandles("?interval=" + string(interval)) {
+			volume += candle.Volume
+			trades += candle.Trades
+		}
+		assert(t, volume, 2.0)
+		assert(t, trades, 2)
+	}
+	future := time.Now().Add(time.Hour).UnixMilli()
+	assert(t, len(getCandles(fmt.Sprintf("?interval=1m&since=%d", future))), 0)
+
+	rec := doRequest(e, http.MethodGet, "/candles/ETH", nil)
+	assert(t, rec.Code, http.StatusBadRequest)
+	rec = doRequest(e, http.MethodGet, "/candles/ETH?interval=2m", nil)
+	assert(t, rec.Code, http.StatusBadRequest)
+	rec = doRequest(e, http.MethodGet, "/candles/DOGE?interval=1m", nil)
+	assert(t, rec.Code, http.StatusNotFound)
+
+	// candles are backfilled from the stored trades on restore
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	if err := ex.WriteSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	restored, e := newTestExchange(t)
+	if err := restored.RestoreSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	candles := getCandles("?interval=1d&limit=1")
+	assert(t, len(candles), 1)
+	assert(t, candles[0].Trades > 0, true)
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	users := filepath.Join(dir, "users.json")
+	os.WriteFile(users, []byte(`[{"ID": 2, "PrivateKey": "`+testPrivateKey+`", "APIKeys": [{"Key": "k2", "Secret": "s2"}]}]`), 0o600)
+	path := filepath.Join(dir, "config.json")
+	os.WriteFile(path, []byte(`{
+		"ListenAddr": ":4000",
+		"RPCURL": "http://node:8545",
+		"SnapshotInterval": "1m",
+		"LogLevel": "debug",
+		"UsersPath": "`+users+`",
+		"Users": [
+			{"ID": 1, "PrivateKey": "`+testPrivateKey+`", "APIKeys": [{"Key": "k1", "Secret": "s1"}]},
+			{"ID": 3, "APIKeys": [{"Key": "k3", "Secret": "s3"}]}
+		]
+	}`), 0o600)
+
+	t.Setenv("EXCHANGE_CONFIG", path)
+	t.Setenv("EXCHANGE_PRIVATE_KEY", testPrivateKey)
+	t.Setenv("EXCHANGE_RPC_URL", "http://env:8545")
+	t.Setenv("EXCHANGE_CHAIN_ID", "5")
+	t.Setenv("EXCHANGE_LOG_FORMAT", "json")
+	t.Setenv("EXCHANGE_ADMIN_KEY", "admin")
+	t.Setenv("EXCHANGE_USER_3_PRIVATE_KEY", testPrivateKey)
+
+	cfg, err := LoadConfig([]string{"-chain-id", "7", "-admin-secret", "s3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, cfg.ListenAddr, ":4000")
+	assert(t, cfg.RPCURL, "http://env:8545")
+	assert(t, cfg.ChainID, int64(7))
+	assert(t, cfg.SnapshotInterval, Duration(time.Minute))
+	assert(t, cfg.MarketsPath, DefaultConfig().MarketsPath)
+	assert(t, cfg.LogLevel, slog.LevelDebug)
+	assert(t, cfg.LogFormat, LogFormatJSON)
+	assert(t, len(cfg.Users), 3)
+	assert(t, cfg.Users[1].PrivateKey, testPrivateKey)
+	assert(t, cfg.AdminKeys, []APIKeyConfig{{Key: "admin", Secret: "s3"}})
+	assert(t, cfg.AdminListenAddr, "127.0.0.1:3002")
+
+	ex, _ := newTestExchange(t)
+	if err := ex.ProvisionUsers(cfg.Users); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UnixMilli()
+	userID, err := ex.auth.verify("k2", now, "n", Sign("s2", now, "n", "GET", "/", nil), "GET", "/", nil)
+	assert(t, err, nil)
+	assert(t, userID, int64(2))
+
+	t.Setenv("EXCHANGE_PRIVATE_KEY", "")
+	t.Setenv("EXCHANGE_CHAIN_ID", "x")
+	if _, err := LoadConfig(nil); err == nil {
+		t.Fatal("invalid environment accepted")
+	}
+	t.Setenv("EXCHANGE_CHAIN_ID", "5")
+	t.Setenv("EXCHANGE_USER_3_PRIVATE_KEY", "")
+	duplicate := filepath.Join(dir, "duplicate.json")
+	os.WriteFile(duplicate, []byte(`[{"ID": 1, "PrivateKey": "`+testPrivateKey+`"}]`), 0o600)
+	_, err = LoadConfig([]string{"-users", duplicate})
+	if err == nil || !strings.Contains(err.Error(), "private key is required") || !strings.Contains(err.Error(), "user 1 is provisioned twice") ||
+		!strings.Contains(err.Error(), "user 3: private key is required, set EXCHANGE_USER_3_PRIVATE_KEY") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+// TestRequestLogging follows a market order through the logs by the ID
+// of its request.
+func TestRequestLogging(t *testing.T) {
+	var buf bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	defer slog.SetDefault(defaultLogger)
+
+	_, e := newTestExchange(t)
+	doRequestAs(e, 1, http.MethodPost, "/order", PlaceOrderRequest{Type: LimitOrder, Size: 2, Price: 10_000, Market: MarketEth})
+
+	b, _ := json.Marshal(PlaceOrderRequest{Type: MarketOrder, Bid: true, Size: 1, Market: MarketEth})
+	req := httptest.NewRequest(http.MethodPost, "/order", bytes.NewReader(b))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(echo.HeaderXRequestID, "trace-me")
+	signRequest(req, 2, b)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert(t, rec.Code, http.StatusOK)
+
+	var resp PlaceOrderResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+
+	records := map[string]map[string]any{}
+	for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		var record map[string]any
+		if err := json.Unmarshal(line, &record); err != nil {
+			t.Fatal(err)
+		}
+		if record["request_id"] == "trace-me" {
+			records[record["msg"].(string)] = record
+		}
+	}
+
+	filled, ok := records["filled market order"]
+	if !ok {
+		t.Fatalf("no fill logged for the request: %v", records)
+	}
+	assert(t, filled["order_id"], float64(resp.OrderID))
+	assert(t, filled["market"], string(MarketEth))
+	assert(t, filled["user_id"], 2.0)
+	assert(t, records["matched"]["order_id"], float64(resp.OrderID))
+
+	request, ok := records["request"]
+	if !ok {
+		t.Fatalf("request not logged: %v", records)
+	}
+	assert(t, request["status"], float64(http.StatusOK))
+	assert(t, request["level"], "DEBUG")
+}
+
+func TestShutdown(t *testing.T) {
+	ex, e := newTestExchange(t)
+	settler := blockingSettler{entered: make(chan struct{}, 1), release: make(chan struct{})}
+	ex.Settler = settler
+	if err := ex.SetTradeArchive(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	doRequestAs(e, 1, http.MethodPost, "/order", PlaceOrderRequest{
+		Type:   LimitOrder,
+		Size:   2,
+		Price:  10_000,
+		Market: MarketEth,
+	})
+	// the order is in flight while it settles
+	placed := make(chan int, 1)
+	go func() {
+		rec := doRequestAs(e, 2, http.MethodPost, "/order", PlaceOrderRequest{
+			Type:   MarketOrder,
+			Bid:    true,
+			Size:   1,
+			Market: MarketEth,
+		})
+		placed <- rec.Code
+	}()
+	<-settler.entered
+
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- ex.Shutdown(ctx, e, path)
+	}()
+
+	// new orders are refused while the exchange drains
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		rec := doRequestAs(e, 3, http.MethodPost, "/order", PlaceOrderRequest{
+			Type:   LimitOrder,
+			Size:   1,
+			Price:  9_000,
+			Market: MarketEth,
+			Bid:    true,
+		})
+		if rec.Code == http.StatusServiceUnavailable {
+			var apiErr APIError
+			json.NewDecoder(rec.Body).Decode(&apiErr)
+			assert(t, apiErr.Code, ErrCodeShuttingDown)
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("orders still accepted while draining")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(settler.release)
+	assert(t, <-placed, http.StatusOK)
+	assert(t, <-shutdown, nil)
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err = conn.ReadMessage()
+	closeErr, ok := err.(*websocket.CloseError)
+	if !ok {
+		t.Fatalf("expected a close frame, got %v", err)
+	}
+	assert(t, closeErr.Code, websocket.CloseGoingAway)
+	assert(t, closeErr.Text, "server shutting down")
+
+	// the final snapshot holds the drained order
+	restored, _ := newTestExchange(t)
+	if err := restored.RestoreSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, engineOf(restored, MarketEth).currentView().Book.TotalAskVolume, 1.0)
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	ex, e := newTestExchange(t)
+	settler := blockingSettler{entered: make(chan struct{}, 1), release: make(chan struct{})}
+	ex.Settler = settler
+	defer close(settler.release)
+
+	doRequestAs(e, 1, http.MethodPost, "/order", PlaceOrderRequest{
+		Type:   LimitOrder,
+		Size:   2,
+		Price:  10_000,
+		Market: MarketEth,
+	})
+	go doRequestAs(e, 2, http.MethodPost, "/order", PlaceOrderRequest{
+		Type:   MarketOrder,
+		Bid:    true,
+		Size:   1,
+		Market: MarketEth,
+	})
+	<-settler.entered
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := ex.Shutdown(ctx, e, filepath.Join(t.TempDir(), "snapshot.json"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the drain to time out, got %v", err)
+	}
+}
+
+// TestShutdownStopsEngines checks nothing changes the books after the
+// final snapshot.
+func TestShutdownStopsEngines(t *testing.T) {
+	ex, e := newTestExchange(t)
+
+	doRequestAs(e, 1, http.MethodPost, "/order", PlaceOrderRequest{
+		Type:   LimitOrder,
+		Size:   2,
+		Price:  10_000,
+		Market: MarketEth,
+	})
+	ex.deadMan.arm(1, 20*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ex.Shutdown(ctx, e, filepath.Join(t.TempDir(), "snapshot.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	eng := engineOf(ex, MarketEth)
+	eng.do(func(ob *orderbook.Orderbook) {
+		ob.PlaceLimitOrder(9_000, orderbook.NewOrder(true, 1, 2))
+	})
+	assert(t, len(eng.ob.Orders), 1)
+	assert(t, ex.deadMan.armed(1), false)
+}
+
+func TestShutdownExpired(t *testing.T) {
+	ex, e := newTestExchange(t)
+
+	// no gRPC server and a context that ended before shutdown started
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	for i := 0; i < 20; i++ {
+		if err := ex.Shutdown(ctx, e, path); err != nil && !errors.Is(err, context.Canceled) {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	_, e := newTestExchange(t)
+
+	place := func(userID int64, req PlaceOrderRequest) *httptest.ResponseRecorder {
+		req.Market = MarketEth
+		return doRequestAs(e, userID, http.MethodPost, "/order", req)
+	}
+	place(1, PlaceOrderRequest{Type: LimitOrder, Size: 2, Price: 10_000})
+	place(1, PlaceOrderRequest{Type: LimitOrder, Size: 2, Price: 10_100})
+	place(2, PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: 1, Price: 9_000})
+	assert(t, place(2, PlaceOrderRequest{Type: MarketOrder, Bid: true, Size: 1}).Code, http.StatusOK)
+	assert(t, place(2, PlaceOrderRequest{Type: MarketOrder, Bid: true, Size: 100}).Code, http.StatusUnprocessableEntity)
+	assert(t, doRequestAs(e, 1, http.MethodDelete, "/orders?market=ETH", nil).Code, http.StatusOK)
+	doRequest(e, http.MethodGet, "/nowhere/42", nil)
+
+	rec := doRequest(e, http.MethodGet, "/metrics", nil)
+	assert(t, rec.Code, http.StatusOK)
+	assert(t, rec.Header().Get(echo.HeaderContentType), string(expfmt.FmtText))
+
+	body := rec.Body.String()
+	for _, line := range []string{
+		`exchange_orders_total{market="ETH",outcome="placed",type="LIMIT"} 3`,
+		`exchange_orders_total{market="ETH",outcome="cancelled",type="LIMIT"} 2`,
+		`exchange_orders_total{market="ETH",outcome="placed",type="MARKET"} 1`,
+		`exchange_orders_total{market="ETH",outcome="rejected",type="MARKET"} 1`,
+		`exchange_order_duration_seconds_count{market="ETH",outcome="placed",type="MARKET"} 1`,
+		`exchange_match_duration_seconds_count{market="ETH",type="LIMIT"} 3`,
+		`exchange_match_duration_seconds_count{market="ETH",type="MARKET"} 1`,
+		`exchange_http_request_duration_seconds_count{method="POST",route="/order",status="200"} 4`,
+		`exchange_http_request_duration_seconds_count{method="POST",route="/order",status="422"} 1`,
+		`exchange_http_request_duration_seconds_count{method="GET",route="unmatched",status="404"} 1`,
+		`exchange_book_depth{market="ETH",side="ask"} 0`,
+		`exchange_book_depth{market="ETH",side="bid"} 1`,
+		`exchange_book_levels{market="ETH",side="bid"} 1`,
+		`go_goroutines`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("metrics lack %s", line)
+		}
+	}
+	// the spread needs both sides of the book
+	if strings.Contains(body, `exchange_book_spread{market="ETH"}`) {
+		t.Error("spread of a one sided book")
+	}
+}
+
+// TestSettlementMetrics settles against a fake node that refuses the
+// first transaction for lack of funds.
+func TestSettlementMetrics(t *testing.T) {
+	var sent atomic.Int64
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     json.RawMessage
+			Method string
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+
+		resp := map[string]any{"jsonrpc": "2.0", "id": req.ID}
+		switch req.Method {
+		case "eth_getTransactionCount", "eth_gasPrice":
+			resp["result"] = "0x1"
+		case "eth_sendRawTransaction":
+			if sent.Add(1) == 1 {
+				resp["error"] = map[string]any{"code": -32000, "message": "insufficient funds for gas * price + value"}
+			} else {
+				resp["result"] = common.Hash{}.Hex()
+			}
+		default:
+			resp["error"] = map[string]any{"code": -32601, "message": "method not found"}
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer node.Close()
+
+	client, err := ethclient.Dial(node.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	metrics := newExchangeMetrics()
+	settler := ethSettler{client: client, chainID: big.NewInt(DefaultChainID), metrics: metrics}
+	pk, _ := crypto.HexToECDSA(testPrivateKey)
+
+	if err := settler.Transfer(context.Background(), pk, common.Address{}, big.NewInt(1)); err == nil {
+		t.Fatal("expected the transfer to be refused")
+	}
+	if err := settler.Transfer(context.Background(), pk, common.Address{}, big.NewInt(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	assert(t, testutil.ToFloat64(metrics.settlements.WithLabelValues(settlementInsufficientFunds)), 1.0)
+	assert(t, testutil.ToFloat64(metrics.settlements.WithLabelValues(settlementSent)), 1.0)
+}
+
+func TestStream(t *testing.T) {
+	ex, e := newTestExchange(t)
+	key, secret := testKey(1)
+	now := time.Now().UnixMilli()
+
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	requests := []StreamRequest{
+		{Op: OpSubscribe, Channel: ChannelTrades, Market: MarketEth},
+		{Op: OpSubscribe, Channel: ChannelBook, Market: MarketEth},
+		{Op: OpSubscribe, Channel: ChannelCandles, Market: MarketEth, Interval: Candle1m},
+		{Op: OpSubscribe, Channel: ChannelOrders},
+		{Op: OpAuth, APIKey: key, Timestamp: now, Nonce: "bad", Signature: "bad"},
+		{
+			Op:        OpAuth,
+			APIKey:    key,
+			Timestamp: now,
+			Nonce:     "stream-1",
+			Signature: Sign(secret, now, "stream-1", StreamAuthMethod, StreamAuthPath, nil),
+		},
+		{Op: OpSubscribe, Channel: ChannelOrders},
+		{Op: OpSubscribe, Channel: ChannelFills},
+	}
+	for _, req := range requests {
+		if err := conn.WriteJSON(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// waitFor reads messages until one matches, everything read is returned
+	waitFor := func(match func(msg map[string]any) bool) map[string]any {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			var msg map[string]any
+			if err := conn.ReadJSON(&msg); err != nil {
+				t.Fatal(err)
+			}
+			if match(msg) {
+				return msg
+			}
+		}
+	}
+	ofType := func(typ string) func(map[string]any) bool {
+		return func(msg map[string]any) bool { return msg["Type"] == typ }
+	}
+
+	msg := waitFor(ofType("error"))
+	assert(t, msg["Channel"], ChannelOrders)
+	msg = waitFor(ofType("error"))
+	assert(t, msg["Error"], "invalid signature")
+	waitFor(func(msg map[string]any) bool {
+		return msg["Type"] == "subscribed" && msg["Channel"] == ChannelFills
+	})
+
+	doRequestAs(e, 1, http.MethodPost, "/order", PlaceOrderRequest{
+		UserID: 1,
+		Type:   LimitOrder,
+		Size:   10,
+		Price:  10_000,
+		Market: MarketEth,
+	})
+
+	msg = waitFor(ofType(ChannelBook))
+	assert(t, msg["Data"], map[string]any{
+		"Bids": []any{},
+		"Asks": []any{map[string]any{"Price": 10_000.0, "Size": 10.0}},
+	})
+	msg = waitFor(ofType(ChannelOrders))
+	assert(t, msg["Data"].(map[string]any)["Status"], string(orderbook.StatusNew))
+
+	doRequestAs(e, 2, http.MethodPost, "/order", PlaceOrderRequest{
+		UserID: 2,
+		Type:   MarketOrder,
+		Bid:    true,
+		Size:   4,
+		Market: MarketEth,
+	})
+
+	msg = waitFor(ofType(ChannelTrades))
+	assert(t, msg["Data"].([]any)[0].(map[string]any)["Size"], 4.0)
+	msg = waitFor(ofType(ChannelCandles))
+	assert(t, msg["Data"].(map[string]any)["Interval"], string(Candle1m))
+	assert(t, msg["Data"].(map[string]any)["Volume"], 4.0)
+	msg = waitFor(ofType(ChannelOrders))
+	assert(t, msg["Data"].(map[string]any)["Status"], string(orderbook.StatusPartiallyFilled))
+	msg = waitFor(ofType(ChannelFills))
+	assert(t, msg["Data"].(map[string]any)["Liquidity"], string(LiquidityMaker))
+
+	// hanging up trips an armed dead man's switch, but only once the
+	// last session of the user is gone
+	second, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.WriteJSON(StreamRequest{
+		Op:        OpAuth,
+		APIKey:    key,
+		Timestamp: now,
+		Nonce:     "stream-2",
+		Signature: Sign(secret, now, "stream-2", StreamAuthMethod, StreamAuthPath, nil),
+	})
+	var authed StreamMessage
+	second.SetReadDeadline(time.Now().Add(2 * time.Second))
+	second.ReadJSON(&authed)
+	assert(t, authed.Type, "authenticated")
+
+	sessions := func() int {
+		ex.stream.mu.RLock()
+		defer ex.stream.mu.RUnlock()
+		return len(ex.stream.conns)
+	}
+	ex.deadMan.arm(1, time.Hour)
+	conn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for sessions() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("session not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert(t, ex.deadMan.armed(1), true)
+	assert(t, engineOf(ex, MarketEth).currentView().Book.TotalAskVolume, 6.0)
+
+	second.Close()
+	for engineOf(ex, MarketEth).currentView().Book.TotalAskVolume != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("orders not cancelled after disconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStreamSecondLogin(t *testing.T) {
+	_, e := newTestExchange(t)
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	auth := func(userID int64) StreamRequest {
+		key, secret := testKey(userID)
+		now := time.Now().UnixMilli()
+		nonce := strconv.FormatInt(testNonce.Add(1), 10)
+		return StreamRequest{Op: OpAuth, APIKey: key, Timestamp: now, Nonce: nonce, Signature: Sign(secret, now, nonce, StreamAuthMethod, StreamAuthPath, nil)}
+	}
+	read := func() StreamMessage {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		var msg StreamMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+
+	for _, req := range []StreamRequest{auth(1), {Op: OpSubscribe, Channel: ChannelOrders}, auth(1), auth(2)} {
+		conn.WriteJSON(req)
+	}
+	assert(t, read().Type, "authenticated")
+	assert(t, read().Type, "subscribed")
+	assert(t, read().Type, "authenticated")
+	msg := read()
+	assert(t, msg.Type, "error")
+	assert(t, msg.Error, "session is authenticated as another user")
+
+	// the orders of user 2 never show up, those of user 1 still do
+	for _, userID := range []int64{2, 1} {
+		doRequestAs(e, userID, http.MethodPost, "/order", PlaceOrderRequest{Type: LimitOrder, Size: 1, Price: 10_000, Market: MarketEth})
+	}
+	msg = read()
+	assert(t, msg.Type, ChannelOrders)
+	assert(t, msg.Data.(map[string]any)["UserID"], 1.0)
+}
+
+func TestSlowConsumerDisconnected(t *testing.T) {
+	s := &session{
+		send:   make(chan []byte, 1),
+		closed: make(chan struct{}),
+	}
+
+	s.enqueue([]byte("a"))
+	s.enqueue([]byte("b"))
+
+	select {
+	case <-s.closed:
+	default:
+		t.Fatal("slow consumer not closed")
+	}
+	assert(t, s.closeCode, websocket.ClosePolicyViolation)
+	assert(t, s.closeReason, "slow consumer")
+}
+
+// recordingSettler records the amount of every transfer and fails them
+// with err when set.
+type recordingSettler struct {
+	mu      sync.Mutex
+	amounts []*big.Int
+	err     error
+}
+
+func (s *recordingSettler) Transfer(_ context.Context, _ *ecdsa.PrivateKey, _ common.Address, amount *big.Int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.amounts = append(s.amounts, amount)
+	return s.err
+}
+
+func TestAdminAPI(t *testing.T) {
+	ex, e := newTestExchange(t)
+	settler := &recordingSettler{}
+	ex.Settler = settler
+
+	// user keys do not open admin routes, nor admin keys user ones
+	rec := doRequestAs(e, 1, http.MethodGet, "/admin/status", nil)
+	assert(t, rec.Code, http.StatusUnauthorized)
+	rec = doAdminRequest(e, http.MethodGet, "/fills", nil)
+	assert(t, rec.Code, http.StatusUnauthorized)
+
+	// a created user trades with the API key handed out
+	rec = doAdminRequest(e, http.MethodPost, "/admin/users", CreateUserRequest{Reason: "onboarding"})
+	assert(t, rec.Code, http.StatusOK)
+	var created CreateUserResponse
+	json.NewDecoder(rec.Body).Decode(&created)
+	assert(t, created.ID, int64(testUsers))
+	assert(t, len(created.APIKeys), 1)
+
+	order := PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: 1, Price: 9_000, Market: MarketEth}
+	b, _ := json.Marshal(order)
+	req := httptest.NewRequest(http.MethodPost, "/order", bytes.NewReader(b))
+	signRequestWith(req, created.APIKeys[0].Key, created.APIKeys[0].Secret, b)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert(t, rec.Code, http.StatusOK)
+
+	rec = doAdminRequest(e, http.MethodPost, "/admin/users", CreateUserRequest{ID: 1})
+	assert(t, rec.Code, http.StatusConflict)
+
+	// a halted market neither takes orders nor cancels
+	order.Size = 2
+	rec = doRequestAs(e, 1, http.MethodPost, "/order", order)
+	assert(t, rec.Code, http.StatusOK)
+	var placed PlaceOrderResponse
+	json.NewDecoder(rec.Body).Decode(&placed)
+
+	rec = doAdminRequest(e, http.MethodPost, "/admin/markets/ETH/status", MarketStatusRequest{Status: MarketHalted, Reason: "incident"})
+	assert(t, rec.Code, http.StatusOK)
+	rec = doRequestAs(e, 1, http.MethodPost, "/order", order)
+	assert(t, rec.Code, http.StatusBadRequest)
+	rec = doRequestAs(e, 1, http.MethodDelete, fmt.Sprintf("/order/%d", placed.OrderID), nil)
+	assert(t, rec.Code, http.StatusBadRequest)
+	rec = doAdminRequest(e, http.MethodPost, "/admin/markets/ETH/status", MarketStatusRequest{Status: MarketDelisted})
+	assert(t, rec.Code, http.StatusBadRequest)
+
+	// close only lets orders out but not in
+	rec = doAdminRequest(e, http.MethodPost, "/admin/markets/ETH/status", MarketStatusRequest{Status: MarketCloseOnly})
+	assert(t, rec.Code, http.StatusOK)
+	rec = doRequestAs(e, 1, http.MethodPost, "/order", order)
+	assert(t, rec.Code, http.StatusBadRequest)
+	rec = doRequestAs(e, 1, http.MethodDelete, fmt.Sprintf("/order/%d", placed.OrderID), nil)
+	assert(t, rec.Code, http.StatusOK)
+
+	rec = doAdminRequest(e, http.MethodPost, "/admin/markets/ETH/status", MarketStatusRequest{Status: MarketActive})
+	assert(t, rec.Code, http.StatusOK)
+
+	// force cancels work on any user's order
+	rec = doRequestAs(e, 2, http.MethodPost, "/order", order)
+	json.NewDecoder(rec.Body).Decode(&placed)
+	rec = doAdminRequest(e, http.MethodDelete, fmt.Sprintf("/admin/orders/%d?reason=fat+finger", placed.OrderID), nil)
+	assert(t, rec.Code, http.StatusOK)
+	var status OrderStatusResponse
+	rec = doRequestAs(e, 2, http.MethodGet, fmt.Sprintf("/orders/%d", placed.OrderID), nil)
+	json.NewDecoder(rec.Body).Decode(&status)
+	assert(t, status.Status, orderbook.StatusCancelled)
+	assert(t, status.Reason, orderbook.ReasonCancelledByAdmin)
+
+	// a disabled user is locked out and their orders pulled
+	rec = doRequestAs(e, 2, http.MethodPost, "/order", order)
+	json.NewDecoder(rec.Body).Decode(&placed)
+	rec = doAdminRequest(e, http.MethodPost, "/admin/users/2/disable", AdminRequest{Reason: "compliance"})
+	assert(t, rec.Code, http.StatusOK)
+	var disabled DisableUserResponse
+	json.NewDecoder(rec.Body).Decode(&disabled)
+	assert(t, len(disabled.Cancelled), 1)
+	rec = doRequestAs(e, 2, http.MethodGet, "/fills", nil)
+	assert(t, rec.Code, http.StatusForbidden)
+
+	// balance adjustments are settled and audited, failed ones too
+	rec = doAdminRequest(e, http.MethodPost, "/admin/users/3/balance", AdjustBalanceRequest{Amount: "1000"})
+	assert(t, rec.Code, http.StatusBadRequest)
+	rec = doAdminRequest(e, http.MethodPost, "/admin/users/3/balance", AdjustBalanceRequest{Amount: "-1000", Reason: "refund"})
+	assert(t, rec.Code, http.StatusOK)
+	settler.err = errors.New("insufficient funds for gas * price + value")
+	rec = doAdminRequest(e, http.MethodPost, "/admin/users/3/balance", AdjustBalanceRequest{Amount: "5", Reason: "bonus"})
+	assert(t, rec.Code, http.StatusUnprocessableEntity)
+	assert(t, len(settler.amounts), 2)
+	assert(t, settler.amounts[0].String(), "1000")
+
+	rec = doAdminRequest(e, http.MethodGet, "/admin/audit?limit=3", nil)
+	var audit []AuditEntry
+	json.NewDecoder(rec.Body).Decode(&audit)
+	assert(t, len(audit), 3)
+	assert(t, audit[0].Action, ActionDisableUser)
+	assert(t, audit[0].Admin, testAdminKey)
+	assert(t, audit[0].Reason, "compliance")
+	assert(t, audit[2].Action, ActionAdjustBalance)
+	assert(t, audit[2].Details["Error"] != nil, true)
+
+	rec = doAdminRequest(e, http.MethodGet, "/admin/status", nil)
+	var sys SystemStatus
+	json.NewDecoder(rec.Body).Decode(&sys)
+	assert(t, sys.Users, testUsers+1)
+	assert(t, sys.DisabledUsers, []int64{2})
+	assert(t, sys.Markets[0].Status, MarketActive)
+	assert(t, sys.Markets[0].RestingOrders, 1)
+
+	// created users, disabled ones and the audit trail survive a restart
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	if err := ex.WriteSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	restored, re := newTestExchange(t)
+	if err := restored.RestoreSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, restored.disabledUsers(), []int64{2})
+	// details come back from JSON with other types, the rest must match
+	restoredAudit := restored.auditTrail.all()
+	assert(t, len(restoredAudit), len(ex.auditTrail.all()))
+	assert(t, restoredAudit[0].Action, ActionCreateUser)
+	assert(t, restoredAudit[0].Reason, "onboarding")
+	if _, ok := restored.user(created.ID); !ok {
+		t.Fatalf("user %d was not restored", created.ID)
+	}
+	rec = doRequestAs(re, 2, http.MethodGet, "/fills", nil)
+	assert(t, rec.Code, http.StatusForbidden)
+}
+
+// serveGRPC serves the gRPC API of ex in memory.
+func serveGRPC(t *testing.T, ex *Exchange) *bufconn.Listener {
+	lis := bufconn.Listen(1 << 20)
+	srv := ex.NewGRPCServer()
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	return lis
+}
+
+// dialGRPC connects to the gRPC API served on lis, the calls are signed
+// with the API key of userID when it is not negative.
+func dialGRPC(t *testing.T, lis *bufconn.Listener, userID int64) rpc.ExchangeClient {
+	opts := []grpc.DialOption{
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	}
+	if userID >= 0 {
+		opts = append(opts, grpc.WithUnaryInterceptor(SignRPC(testKey(userID))))
+	}
+	conn, err := grpc.NewClient("passthrough:///bufconn", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return rpc.NewExchangeClient(conn)
+}
+
+// rpcReason returns the status code and the error code of a gRPC error.
+func rpcReason(err error) (codes.Code, ErrorCode) {
+	st := status.Convert(err)
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			return st.Code(), ErrorCode(info.Reason)
+		}
+	}
+
+	return st.Code(), ""
+}
+
+func TestGRPC(t *testing.T) {
+	ex, e := newTestExchange(t)
+	lis := serveGRPC(t, ex)
+	var (
+		maker  = dialGRPC(t, lis, 1)
+		taker  = dialGRPC(t, lis, 2)
+		public = dialGRPC(t, lis, -1)
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	trades, err := public.SubscribeTrades(ctx, &rpc.SubscribeTradesRequest{Market: string(MarketEth)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	book, err := public.SubscribeBook(ctx, &rpc.SubscribeBookRequest{Market: string(MarketEth)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := book.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, snapshot.Snapshot, true)
+	assert(t, len(snapshot.Asks), 0)
+
+	_, err = public.PlaceOrder(ctx, &rpc.PlaceOrderRequest{Market: string(MarketEth), Type: string(LimitOrder), Size: 1, Price: 10_000})
+	code, reason := rpcReason(err)
+	assert(t, code, codes.Unauthenticated)
+	assert(t, reason, ErrCodeUnauthorized)
+
+	placed, err := maker.PlaceOrder(ctx, &rpc.PlaceOrderRequest{
+		Market:        string(MarketEth),
+		Type:          string(LimitOrder),
+		Size:          2,
+		Price:         10_000,
+		ClientOrderId: "grpc-1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, placed.Status, string(orderbook.StatusNew))
+
+	delta, err := book.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, delta.Snapshot, false)
+	assert(t, delta.Seq > snapshot.Seq, true)
+	assert(t, delta.Asks, []*rpc.Level{{Price: 10_000, Size: 2}})
+
+	filled, err := taker.PlaceOrder(ctx, &rpc.PlaceOrderRequest{Market: string(MarketEth), Type: string(MarketOrder), Bid: true, Size: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, filled.Status, string(orderbook.StatusFilled))
+	assert(t, filled.BaseFilled, 1.0)
+	assert(t, filled.QuoteFilled, 10_000.0)
+
+	trade, err := trades.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, trade.Price, 10_000.0)
+	assert(t, trade.Size, 1.0)
+	assert(t, trade.Bid, true)
+
+	// both transports see the same order
+	order, err := maker.GetOrder(ctx, &rpc.GetOrderRequest{ClientOrderId: "grpc-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, order.Id, placed.OrderId)
+	assert(t, order.Status, string(orderbook.StatusPartiallyFilled))
+	assert(t, order.FilledSize, 1.0)
+
+	var status OrderStatusResponse
+	rec := doRequestAs(e, 1, http.MethodGet, fmt.Sprintf("/orders/%d", placed.OrderId), nil)
+	json.NewDecoder(rec.Body).Decode(&status)
+	assert(t, string(status.Status), order.Status)
+	assert(t, status.RemainingSize, order.RemainingSize)
+
+	resting, err := public.GetBook(ctx, &rpc.GetBookRequest{Market: string(MarketEth)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, resting.TotalAskVolume, 1.0)
+	assert(t, len(resting.Asks), 1)
+
+	// errors keep the code of the HTTP API
+	_, err = taker.CancelOrder(ctx, &rpc.CancelOrderRequest{OrderId: placed.OrderId})
+	code, reason = rpcReason(err)
+	assert(t, code, codes.NotFound)
+	assert(t, reason, ErrCodeUnknownOrder)
+
+	_, err = maker.PlaceOrder(ctx, &rpc.PlaceOrderRequest{Market: string(MarketEth), Type: string(LimitOrder), Size: 1, Price: 10_000.001})
+	code, reason = rpcReason(err)
+	assert(t, code, codes.InvalidArgument)
+	assert(t, reason, ErrCodeValidation)
+
+	_, err = taker.PlaceOrder(ctx, &rpc.PlaceOrderRequest{Market: string(MarketEth), Type: string(MarketOrder), Bid: true, Size: 5})
+	code, reason = rpcReason(err)
+	assert(t, code, codes.FailedPrecondition)
+	assert(t, reason, ErrCodeInsufficientLiquidity)
+
+	_, err = public.GetBook(ctx, &rpc.GetBookRequest{Market: "DOGE"})
+	code, reason = rpcReason(err)
+	assert(t, code, codes.NotFound)
+	assert(t, reason, ErrCodeUnknownMarket)
+
+	cancelled, err := maker.CancelOrder(ctx, &rpc.CancelOrderRequest{ClientOrderId: "grpc-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, cancelled.Market, string(MarketEth))
+
+	// shutting down ends the subscriptions
+	if err := ex.Shutdown(ctx, e, filepath.Join(t.TempDir(), "snapshot.json")); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, err = trades.Recv(); err != nil {
+			break
+		}
+	}
+	code, _ = rpcReason(err)
+	assert(t, code, codes.Unavailable)
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+// orderGate counts the order submissions in flight.
+type orderGate struct {
+	mu       sync.Mutex
+	closed   bool
+	inflight sync.WaitGroup
+}
+
+// enter admits a submission, it fails once the gate is closed.
+func (g *orderGate) enter() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.closed {
+		return false
+	}
+	g.inflight.Add(1)
+
+	return true
+}
+
+func (g *orderGate) leave() {
+	g.inflight.Done()
+}
+
+// close refuses new submissions and waits for those in flight.
+func (g *orderGate) close(ctx context.Context) error {
+	g.mu.Lock()
+	g.closed = true
+	g.mu.Unlock()
+
+	return waitContext(ctx, &g.inflight)
+}
+
+// waitContext waits for wg unless ctx ends first.
+func waitContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// acceptOrders refuses orders once the exchange is shutting down.
+func (ex *Exchange) acceptOrders(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !ex.orderGate.enter() {
+			return newAPIError(http.StatusServiceUnavailable, ErrCodeShuttingDown, "the exchange is shutting down")
+		}
+		defer ex.orderGate.leave()
+
+		return next(c)
+	}
+}
+
+// Shutdown drains the orders, stops the servers and engines and writes a
+// final snapshot, even if ctx ends first.
+func (ex *Exchange) Shutdown(ctx context.Context, e *echo.Echo, snapshotPath string) error {
+	ex.closing.Store(true)
+
+	var errs []error
+	if err := ex.orderGate.close(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("draining orders: %w", err))
+	}
+	if err := e.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("shutting down the HTTP server: %w", err))
+	}
+
+	// gRPC streams end with the feeds closed below
+	var grpcStopped chan struct{}
+	if ex.grpcServer != nil {
+		grpcStopped = make(chan struct{})
+		go func() {
+			ex.grpcServer.GracefulStop()
+			close(grpcStopped)
+		}()
+	}
+
+	ex.stream.closeAll(websocket.CloseGoingAway, "server shutting down")
+	if err := waitContext(ctx, &ex.stream.sessions); err != nil {
+		errs = append(errs, fmt.Errorf("closing stream sessions: %w", err))
+	}
+	if grpcStopped != nil {
+		select {
+		case <-grpcStopped:
+		case <-ctx.Done():
+			ex.grpcServer.Stop()
+			errs = append(errs, fmt.Errorf("stopping the gRPC server: %w", ctx.Err()))
+		}
+	}
+
+	// nothing may change the books once they are saved
+	ex.deadMan.stop()
+	ex.markets.stopEngines()
+	if err := ex.fills.close(); err != nil {
+		errs = append(errs, fmt.Errorf("archiving fills: %w", err))
+	}
+
+	if err := ex.WriteSnapshot(snapshotPath); err != nil {
+		errs = append(errs, fmt.Errorf("final snapshot: %w", err))
+	}
+	if err := ex.markets.closeArchives(); err != nil {
+		errs = append(errs, fmt.Errorf("closing trade archives: %w", err))
+	}
+
+	if len(errs) == 0 {
+		slog.Info("shutdown complete")
+	}
+
+	return errors.Join(errs...)
+}
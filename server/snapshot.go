@@ -0,0 +1,206 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Baazaouihamza/crypto-exchange/orderbook"
+)
+
+// ExchangeSnapshot is what gets written to disk: every orderbook plus the
+// user -> order index. There is no journal, whatever happened since the
+// last snapshot is lost on a crash.
+type ExchangeSnapshot struct {
+	CreatedAt int64
+	// Markets keeps the markets listed or delisted at runtime.
+	Markets    []MarketConfig
+	Orderbooks map[Market]*orderbook.Snapshot
+	// Trades holds the recent trades, older ones are in the trade archive.
+	Trades map[Market][]orderbook.Trade
+	// FinishedOrders left the books within the retention.
+	FinishedOrders map[Market][]FinishedOrder
+	// UserOrders maps a user to the IDs of the user's orders.
+	UserOrders map[int64][]int64
+	// SignedOrders are kept for good, they prove what users asked for.
+	SignedOrders []*SignedOrder
+	// ClientOrders are the client order IDs within their retention, so a
+	// retry across a restart is not placed twice.
+	ClientOrders []ClientOrder
+	// Fills holds the recent fills, older ones are in the fill archive.
+	Fills []Fill
+	// Users were created through the admin API, keys included.
+	Users         []UserConfig
+	DisabledUsers []int64
+	Audit         []AuditEntry
+}
+
+func (ex *Exchange) Snapshot() *ExchangeSnapshot {
+	snap := &ExchangeSnapshot{
+		CreatedAt:      time.Now().UnixNano(),
+		Markets:        ex.markets.list(),
+		Orderbooks:     make(map[Market]*orderbook.Snapshot),
+		Trades:         make(map[Market][]orderbook.Trade),
+		FinishedOrders: make(map[Market][]FinishedOrder),
+		UserOrders:     make(map[int64][]int64),
+		SignedOrders:   ex.signedOrders.list(),
+	}
+
+	// every market is held at once so the books are taken at one point
+	// in time
+	engines := ex.markets.engines()
+	for _, eng := range engines {
+		resume := eng.pause()
+		defer resume()
+	}
+	for market, eng := range engines {
+		snap.Orderbooks[market] = eng.ob.Snapshot()
+		snap.Trades[market] = eng.trades.recent()
+		snap.FinishedOrders[market] = eng.finishedOrders()
+	}
+	// taken after the books so it holds every fill of their trades
+	snap.Fills = ex.fills.recent()
+	snap.ClientOrders = ex.clientOrders.list()
+	snap.DisabledUsers = ex.disabledUsers()
+	snap.Audit = ex.auditTrail.all()
+
+	ex.usersMu.RLock()
+	snap.Users = append([]UserConfig{}, ex.createdUsers...)
+	ex.usersMu.RUnlock()
+
+	ex.mu.RLock()
+	for userID, orders := range ex.Orders {
+		for _, order := range orders {
+			snap.UserOrders[userID] = append(snap.UserOrders[userID], order.ID)
+		}
+	}
+	ex.mu.RUnlock()
+
+	return snap
+}
+
+// WriteSnapshot writes the snapshot to a temporary file renamed over path.
+func (ex *Exchange) WriteSnapshot(path string) error {
+	b, err := json.Marshal(ex.Snapshot())
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// RestoreSnapshot loads the snapshot at path, if there is one.
+func (ex *Exchange) RestoreSnapshot(path string) error {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var snap ExchangeSnapshot
+	if err := json.Unmarshal(b, &snap); err != nil {
+		return err
+	}
+
+	for _, cfg := range snap.Markets {
+		if _, ok := ex.markets.get(cfg.Symbol); !ok {
+			if err := ex.markets.add(cfg); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := ex.markets.setStatus(cfg.Symbol, cfg.Status); err != nil {
+			return err
+		}
+	}
+
+	if err := ex.restoreUsers(snap.Users, snap.DisabledUsers); err != nil {
+		return err
+	}
+	ex.auditTrail.restore(snap.Audit)
+	if err := ex.fills.restore(snap.Fills); err != nil {
+		return err
+	}
+
+	ex.clientOrders.restore(snap.ClientOrders)
+
+	for _, signed := range snap.SignedOrders {
+		if err := ex.signedOrders.add(signed); err != nil {
+			return err
+		}
+	}
+
+	restored := make(map[int64]*orderbook.Order)
+	for market, obSnap := range snap.Orderbooks {
+		ob := orderbook.RestoreOrderbook(obSnap)
+		for id, order := range ob.Orders {
+			restored[id] = order
+		}
+		eng, ok := ex.engine(market)
+		if !ok {
+			slog.Warn("snapshot holds an unknown market, skipping it", "market", market)
+			continue
+		}
+		if err := eng.replace(ob, snap.Trades[market], snap.FinishedOrders[market]); err != nil {
+			return err
+		}
+	}
+
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	ex.Orders = make(map[int64][]*orderbook.Order)
+	for userID, ids := range snap.UserOrders {
+		for _, id := range ids {
+			// filled orders are not part of any book anymore, skip them
+			if order, ok := restored[id]; ok {
+				ex.Orders[userID] = append(ex.Orders[userID], order)
+			}
+		}
+	}
+
+	slog.Info("restored snapshot", "path", path, "taken_at", time.Unix(0, snap.CreatedAt))
+
+	return nil
+}
+
+// runSnapshots writes a snapshot every interval until ctx ends.
+func (ex *Exchange) runSnapshots(ctx context.Context, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := ex.WriteSnapshot(path); err != nil {
+			slog.Error("snapshot failed", "path", path, "error", err)
+		}
+	}
+}
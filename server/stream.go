@@ -0,0 +1,570 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	ChannelTrades = "trades"
+	ChannelBook   = "book"
+	ChannelTicker = "ticker"
+	// ChannelCandles needs the Interval of the candles besides the market.
+	ChannelCandles = "candles"
+	// ChannelOrders and ChannelFills are private, they need an
+	// authenticated session and carry the updates of that user only.
+	ChannelOrders = "orders"
+	ChannelFills  = "fills"
+
+	OpSubscribe   = "subscribe"
+	OpUnsubscribe = "unsubscribe"
+	OpAuth        = "auth"
+
+	// StreamAuthMethod and StreamAuthPath take the place of the HTTP
+	// method and path when signing the auth op.
+	StreamAuthMethod = "AUTH"
+	StreamAuthPath   = "/ws"
+
+	// sessionBuffer is how many messages a session may lag behind.
+	sessionBuffer = 256
+
+	pingInterval = 15 * time.Second
+	pongWait     = 2 * pingInterval
+	writeWait    = 5 * time.Second
+)
+
+// StreamRequest is sent by clients over the websocket.
+type StreamRequest struct {
+	Op      string
+	Channel string
+	// Market is required for the public channels.
+	Market Market
+	// Interval is required for the candles channel.
+	Interval CandleInterval `json:",omitempty"`
+	// The auth op binds the session to the user of APIKey. Signature is
+	// Sign(secret, Timestamp, Nonce, "AUTH", "/ws", nil).
+	APIKey    string `json:",omitempty"`
+	Timestamp int64  `json:",omitempty"`
+	Nonce     string `json:",omitempty"`
+	Signature string `json:",omitempty"`
+}
+
+// StreamMessage is every message sent by the server over the websocket.
+type StreamMessage struct {
+	// Type is the channel for data messages, or one of "subscribed",
+	// "unsubscribed", "authenticated", "error" and "book_snapshot".
+	Type    string
+	Channel string `json:",omitempty"`
+	Market  Market `json:",omitempty"`
+	// Seq orders the book snapshots and deltas of a market, deltas up to
+	// the snapshot Seq are stale.
+	Seq   uint64 `json:",omitempty"`
+	Error string `json:",omitempty"`
+	Data  any    `json:",omitempty"`
+}
+
+// BookUpdate holds the book levels that changed, a zero Size removes
+// the level. For a snapshot it holds every level.
+type BookUpdate struct {
+	Bids []Level
+	Asks []Level
+}
+
+func channelKey(channel string, market Market) string {
+	return channel + ":" + string(market)
+}
+
+func candleChannelKey(market Market, interval CandleInterval) string {
+	return channelKey(ChannelCandles, market) + ":" + string(interval)
+}
+
+func userChannelKey(channel string, userID int64) string {
+	return fmt.Sprintf("%s:%d", channel, userID)
+}
+
+// streamHub fans messages out to the sessions and feeds subscribed to a
+// channel.
+type streamHub struct {
+	mu   sync.RWMutex
+	subs map[string]map[*session]struct{}
+	// feeds are the in-process subscribers of every channel.
+	feeds map[string]map[*feed]struct{}
+	// conns holds every open session, sessions counts their handlers.
+	conns    map[*session]struct{}
+	sessions sync.WaitGroup
+	// users holds the authenticated sessions of every user.
+	users map[int64]map[*session]struct{}
+}
+
+func newStreamHub() *streamHub {
+	return &streamHub{
+		subs:  make(map[string]map[*session]struct{}),
+		feeds: make(map[string]map[*feed]struct{}),
+		conns: make(map[*session]struct{}),
+		users: make(map[int64]map[*session]struct{}),
+	}
+}
+
+func (h *streamHub) connect(s *session) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.conns[s] = struct{}{}
+	h.sessions.Add(1)
+}
+
+// disconnect forgets a session, it must be called from its read loop.
+func (h *streamHub) disconnect(s *session) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.conns, s)
+	h.unbind(s)
+	h.sessions.Done()
+}
+
+// logout unbinds a session from its user, from its read loop. It tells
+// whether that was the last session of the user.
+func (h *streamHub) logout(s *session) (last bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.unbind(s)
+}
+
+func (h *streamHub) unbind(s *session) (last bool) {
+	sessions, ok := h.users[s.userID]
+	if !s.authed || !ok {
+		return false
+	}
+	if _, ok := sessions[s]; !ok {
+		return false
+	}
+	delete(sessions, s)
+	if len(sessions) > 0 {
+		return false
+	}
+	delete(h.users, s.userID)
+
+	return true
+}
+
+// login binds a session to its user, from its read loop.
+func (h *streamHub) login(s *session, userID int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s.userID = userID
+	s.authed = true
+	if h.users[userID] == nil {
+		h.users[userID] = make(map[*session]struct{})
+	}
+	h.users[userID][s] = struct{}{}
+}
+
+// closeUser hangs up every session of a user with reason.
+func (h *streamHub) closeUser(userID int64, code int, reason string) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for s := range h.users[userID] {
+		s.close(code, reason)
+	}
+}
+
+// count returns the number of open sessions.
+func (h *streamHub) count() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return len(h.conns)
+}
+
+// closeAll hangs up every session and ends every feed with reason.
+func (h *streamHub) closeAll(code int, reason string) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for s := range h.conns {
+		s.close(code, reason)
+	}
+	for _, feeds := range h.feeds {
+		for f := range feeds {
+			f.close(reason)
+		}
+	}
+}
+
+func (h *streamHub) subscribe(key string, s *session) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.subs[key] == nil {
+		h.subs[key] = make(map[*session]struct{})
+	}
+	h.subs[key][s] = struct{}{}
+}
+
+func (h *streamHub) unsubscribe(key string, s *session) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.subs[key], s)
+	if len(h.subs[key]) == 0 {
+		delete(h.subs, key)
+	}
+}
+
+// hasSubscribers lets publishers skip building messages nobody reads.
+func (h *streamHub) hasSubscribers(key string) bool {
+	if h == nil {
+		return false
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return len(h.subs[key]) > 0 || len(h.feeds[key]) > 0
+}
+
+func (h *streamHub) subscribeFeed(key string, f *feed) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.feeds[key] == nil {
+		h.feeds[key] = make(map[*feed]struct{})
+	}
+	h.feeds[key][f] = struct{}{}
+}
+
+func (h *streamHub) unsubscribeFeed(key string, f *feed) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.feeds[key], f)
+	if len(h.feeds[key]) == 0 {
+		delete(h.feeds, key)
+	}
+}
+
+// publish never blocks: sessions that cannot keep up get disconnected.
+func (h *streamHub) publish(key string, msg StreamMessage) {
+	if h == nil {
+		return
+	}
+
+	h.mu.RLock()
+	sessions := make([]*session, 0, len(h.subs[key]))
+	for s := range h.subs[key] {
+		sessions = append(sessions, s)
+	}
+	feeds := make([]*feed, 0, len(h.feeds[key]))
+	for f := range h.feeds[key] {
+		feeds = append(feeds, f)
+	}
+	h.mu.RUnlock()
+
+	for _, f := range feeds {
+		f.enqueue(msg)
+	}
+	if len(sessions) == 0 {
+		return
+	}
+
+	b, err := json.Marshal(msg)
+	if err != nil {
+		slog.Error("stream marshal failed", "error", err)
+		return
+	}
+	for _, s := range sessions {
+		s.enqueue(b)
+	}
+}
+
+// session is a single websocket connection.
+type session struct {
+	conn *websocket.Conn
+	send chan []byte
+
+	closeOnce   sync.Once
+	closed      chan struct{}
+	closeCode   int
+	closeReason string
+
+	// the fields below are only used by the read loop
+	userID int64
+	authed bool
+	subs   map[string]bool
+}
+
+func (s *session) enqueue(b []byte) {
+	select {
+	case <-s.closed:
+	case s.send <- b:
+	default:
+		s.close(websocket.ClosePolicyViolation, "slow consumer")
+	}
+}
+
+func (s *session) reply(msg StreamMessage) {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		slog.Error("stream marshal failed", "error", err)
+		return
+	}
+	s.enqueue(b)
+}
+
+// close makes the write loop send a close frame with reason and hang up.
+func (s *session) close(code int, reason string) {
+	s.closeOnce.Do(func() {
+		s.closeCode = code
+		s.closeReason = reason
+		close(s.closed)
+	})
+}
+
+func (s *session) writeLoop() {
+	ping := time.NewTicker(pingInterval)
+	defer ping.Stop()
+	defer s.conn.Close()
+
+	for {
+		select {
+		case b := <-s.send:
+			s.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := s.conn.WriteMessage(websocket.TextMessage, b); err != nil {
+				s.close(websocket.CloseAbnormalClosure, "write failed")
+				return
+			}
+		case <-ping.C:
+			if err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				s.close(websocket.CloseAbnormalClosure, "ping failed")
+				return
+			}
+		case <-s.closed:
+			msg := websocket.FormatCloseMessage(s.closeCode, s.closeReason)
+			s.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+			return
+		}
+	}
+}
+
+// feed is an in-process subscriber, like a gRPC stream. Messages are
+// shared and must not be modified.
+type feed struct {
+	msgs chan StreamMessage
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	reason    string
+}
+
+func newFeed() *feed {
+	return &feed{
+		msgs:   make(chan StreamMessage, sessionBuffer),
+		closed: make(chan struct{}),
+	}
+}
+
+// enqueue never blocks, a feed that cannot keep up is closed.
+func (f *feed) enqueue(msg StreamMessage) {
+	select {
+	case <-f.closed:
+	case f.msgs <- msg:
+	default:
+		f.close("slow consumer")
+	}
+}
+
+// close ends the feed with reason.
+func (f *feed) close(reason string) {
+	f.closeOnce.Do(func() {
+		f.reason = reason
+		close(f.closed)
+	})
+}
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// handleStream upgrades the connection to a websocket streaming market
+// data and, once authenticated, private events.
+func (ex *Exchange) handleStream(c echo.Context) error {
+	conn, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		return err
+	}
+
+	s := &session{
+		conn:   conn,
+		send:   make(chan []byte, sessionBuffer),
+		closed: make(chan struct{}),
+		subs:   make(map[string]bool),
+	}
+	ex.stream.connect(s)
+	defer ex.stream.disconnect(s)
+	go s.writeLoop()
+
+	ex.readStream(s)
+
+	for key := range s.subs {
+		ex.stream.unsubscribe(key, s)
+	}
+	// orders are kept at shutdown, they are in the final snapshot. A user
+	// with another session open is still there.
+	if ex.stream.logout(s) && !ex.closing.Load() {
+		// cancel the user's orders if they armed the dead man's switch
+		ex.deadMan.trip(s.userID)
+	}
+
+	return nil
+}
+
+func (ex *Exchange) readStream(s *session) {
+	s.conn.SetReadLimit(4096)
+	s.conn.SetReadDeadline(time.Now().Add(pongWait))
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		var req StreamRequest
+		if err := s.conn.ReadJSON(&req); err != nil {
+			if _, ok := err.(*websocket.CloseError); !ok {
+				s.close(websocket.CloseProtocolError, "invalid message")
+			} else {
+				s.close(websocket.CloseNormalClosure, "")
+			}
+			return
+		}
+
+		select {
+		case <-s.closed:
+			return
+		default:
+		}
+
+		if err := ex.handleStreamRequest(s, req); err != nil {
+			s.reply(StreamMessage{
+				Type:    "error",
+				Channel: req.Channel,
+				Market:  req.Market,
+				Error:   err.Error(),
+			})
+		}
+	}
+}
+
+func (ex *Exchange) handleStreamRequest(s *session, req StreamRequest) error {
+	if req.Op == OpAuth {
+		userID, err := ex.authenticateStream(req)
+		if err != nil {
+			return err
+		}
+		// the private subscriptions belong to the user of the session
+		if s.authed && s.userID != userID {
+			return fmt.Errorf("session is authenticated as another user")
+		}
+		ex.stream.login(s, userID)
+		s.reply(StreamMessage{Type: "authenticated"})
+		return nil
+	}
+
+	var key string
+	switch req.Channel {
+	case ChannelTrades, ChannelBook, ChannelTicker:
+		if _, ok := ex.engine(req.Market); !ok {
+			return fmt.Errorf("market %s not found", req.Market)
+		}
+		key = channelKey(req.Channel, req.Market)
+	case ChannelCandles:
+		if _, ok := ex.engine(req.Market); !ok {
+			return fmt.Errorf("market %s not found", req.Market)
+		}
+		if req.Interval.Duration() == 0 {
+			return fmt.Errorf("interval must be one of %s", validCandleIntervals())
+		}
+		key = candleChannelKey(req.Market, req.Interval)
+	case ChannelOrders, ChannelFills:
+		if !s.authed {
+			return fmt.Errorf("channel %s needs an authenticated session", req.Channel)
+		}
+		key = userChannelKey(req.Channel, s.userID)
+	default:
+		return fmt.Errorf("unknown channel %q", req.Channel)
+	}
+
+	switch req.Op {
+	case OpSubscribe:
+		s.subs[key] = true
+		ex.stream.subscribe(key, s)
+		s.reply(StreamMessage{Type: "subscribed", Channel: req.Channel, Market: req.Market})
+		ex.sendInitialState(s, req)
+	case OpUnsubscribe:
+		delete(s.subs, key)
+		ex.stream.unsubscribe(key, s)
+		s.reply(StreamMessage{Type: "unsubscribed", Channel: req.Channel, Market: req.Market})
+	default:
+		return fmt.Errorf("unknown op %q", req.Op)
+	}
+
+	return nil
+}
+
+// sendInitialState gives new subscribers something to apply updates to.
+func (ex *Exchange) sendInitialState(s *session, req StreamRequest) {
+	eng, ok := ex.engine(req.Market)
+	if !ok {
+		return
+	}
+	view := eng.currentView()
+
+	switch req.Channel {
+	case ChannelBook:
+		s.reply(StreamMessage{
+			Type:    "book_snapshot",
+			Channel: ChannelBook,
+			Market:  req.Market,
+			Seq:     view.Seq,
+			Data:    BookUpdate{Bids: view.BidDepth, Asks: view.AskDepth},
+		})
+	case ChannelTicker:
+		s.reply(StreamMessage{
+			Type:    ChannelTicker,
+			Channel: ChannelTicker,
+			Market:  req.Market,
+			Data:    view.Ticker,
+		})
+	case ChannelCandles:
+		if candle, ok := eng.candles.latest(req.Interval); ok {
+			s.reply(StreamMessage{
+				Type:    ChannelCandles,
+				Channel: ChannelCandles,
+				Market:  req.Market,
+				Data:    candle,
+			})
+		}
+	}
+}
+
+// authenticateStream resolves the user of a signed auth request.
+func (ex *Exchange) authenticateStream(req StreamRequest) (int64, error) {
+	userID, err := ex.auth.verify(req.APIKey, req.Timestamp, req.Nonce, req.Signature, StreamAuthMethod, StreamAuthPath, nil)
+	if err != nil {
+		return 0, err
+	}
+	if ex.userDisabled(userID) {
+		return 0, fmt.Errorf("user %d is disabled", userID)
+	}
+
+	return userID, nil
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"time"
+
+	"github.com/Baazaouihamza/crypto-exchange/orderbook"
+)
+
+const (
+	tickerWindow = 24 * time.Hour
+	// the 24h statistics are kept in one bucket per minute, so the window
+	// slides by whole minutes.
+	tickerBucketSize = time.Minute
+	tickerBuckets    = int(tickerWindow / tickerBucketSize)
+)
+
+type Ticker struct {
+	Market Market
+	// BestBid and BestAsk are nil when that side of the book is empty.
+	BestBid *Level
+	BestAsk *Level
+	// LastPrice, LastSize and LastTradeTime are zero until the first trade.
+	LastPrice     float64
+	LastSize      float64
+	LastTradeTime int64
+	Open          float64
+	High          float64
+	Low           float64
+	Volume        float64
+	QuoteVolume   float64
+	Change        float64
+	ChangePercent float64
+}
+
+type tickerBucket struct {
+	// minute is the unix minute the bucket holds, 0 for an unused bucket.
+	minute      int64
+	open        float64
+	high        float64
+	low         float64
+	volume      float64
+	quoteVolume float64
+}
+
+// tickerStats maintains the 24h statistics of a market from its trades
+// as they happen. It is owned by the engine goroutine.
+type tickerStats struct {
+	buckets [tickerBuckets]tickerBucket
+	last    *orderbook.Trade
+}
+
+func unixMinute(ts int64) int64 {
+	return ts / int64(tickerBucketSize)
+}
+
+func (s *tickerStats) add(trade *orderbook.Trade) {
+	if s.last == nil || trade.TimeStamp >= s.last.TimeStamp {
+		s.last = trade
+	}
+
+	minute := unixMinute(trade.TimeStamp)
+	b := &s.buckets[minute%int64(tickerBuckets)]
+	if b.minute > minute {
+		// older than the window, the bucket got reused since
+		return
+	}
+	if b.minute != minute {
+		*b = tickerBucket{
+			minute: minute,
+			open:   trade.Price,
+			high:   trade.Price,
+			low:    trade.Price,
+		}
+	}
+
+	b.high = max(b.high, trade.Price)
+	b.low = min(b.low, trade.Price)
+	b.volume += trade.Size
+	b.quoteVolume += trade.Size * trade.Price
+}
+
+// ticker computes the statistics of the window ending at now.
+func (s *tickerStats) ticker(market Market, now time.Time) *Ticker {
+	t := &Ticker{Market: market}
+	if s.last == nil {
+		return t
+	}
+
+	t.LastPrice = s.last.Price
+	t.LastSize = s.last.Size
+	t.LastTradeTime = s.last.TimeStamp
+
+	nowMinute := unixMinute(now.UnixNano())
+	oldest := int64(0)
+	for i := range s.buckets {
+		b := &s.buckets[i]
+		if b.minute == 0 || b.minute <= nowMinute-int64(tickerBuckets) || b.minute > nowMinute {
+			continue
+		}
+		if oldest == 0 {
+			t.High, t.Low = b.high, b.low
+		}
+		if oldest == 0 || b.minute < oldest {
+			oldest = b.minute
+			t.Open = b.open
+		}
+		t.High = max(t.High, b.high)
+		t.Low = min(t.Low, b.low)
+		t.Volume += b.volume
+		t.QuoteVolume += b.quoteVolume
+	}
+
+	if t.Open > 0 {
+		t.Change = t.LastPrice - t.Open
+		t.ChangePercent = t.Change / t.Open * 100
+	}
+
+	return t
+}
@@ -0,0 +1,429 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/Baazaouihamza/crypto-exchange/orderbook"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// tradeRingSize is how many recent trades of a market are kept in
+	// memory, older ones go to the archive.
+	tradeRingSize = 1000
+
+	defaultTradesLimit = 500
+	maxTradesLimit     = 1000
+
+	// tradeRecordSize is the size of a trade in the archive: ID,
+	// timestamp, price, size and side, 8 bytes each.
+	tradeRecordSize = 40
+)
+
+// ring holds the most recent items of a tape, oldest first.
+type ring[T any] struct {
+	items []T
+	// start is the index of the oldest item once the ring is full.
+	start int
+}
+
+func newRing[T any](size int) ring[T] {
+	return ring[T]{items: make([]T, 0, size)}
+}
+
+func (r *ring[T]) len() int {
+	return len(r.items)
+}
+
+// at returns the i-th oldest item.
+func (r *ring[T]) at(i int) *T {
+	return &r.items[(r.start+i)%len(r.items)]
+}
+
+// push adds an item, returning the oldest one if it had to make room.
+func (r *ring[T]) push(item T) (T, bool) {
+	if len(r.items) < cap(r.items) {
+		r.items = append(r.items, item)
+		var zero T
+		return zero, false
+	}
+
+	evicted := r.items[r.start]
+	r.items[r.start] = item
+	r.start = (r.start + 1) % len(r.items)
+
+	return evicted, true
+}
+
+// tradeArchive is an append only file of fixed size records, ordered by
+// ID. It is guarded by the lock of its store.
+type tradeArchive struct {
+	f *os.File
+	n int
+}
+
+func openTradeArchive(path string) (*tradeArchive, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	// drop a record torn by a crash mid-write
+	size := info.Size() - info.Size()%tradeRecordSize
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &tradeArchive{f: f, n: int(size / tradeRecordSize)}, nil
+}
+
+func (a *tradeArchive) append(trades []orderbook.Trade) error {
+	b := make([]byte, 0, len(trades)*tradeRecordSize)
+	for _, t := range trades {
+		var bid uint64
+		if t.Bid {
+			bid = 1
+		}
+		b = binary.LittleEndian.AppendUint64(b, uint64(t.ID))
+		b = binary.LittleEndian.AppendUint64(b, uint64(t.TimeStamp))
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(t.Price))
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(t.Size))
+		b = binary.LittleEndian.AppendUint64(b, bid)
+	}
+
+	if _, err := a.f.WriteAt(b, int64(a.n)*tradeRecordSize); err != nil {
+		return err
+	}
+	a.n += len(trades)
+
+	return nil
+}
+
+// read returns the i-th oldest trade of the archive.
+func (a *tradeArchive) read(i int) (orderbook.Trade, error) {
+	b := make([]byte, tradeRecordSize)
+	if _, err := a.f.ReadAt(b, int64(i)*tradeRecordSize); err != nil {
+		return orderbook.Trade{}, err
+	}
+
+	return orderbook.Trade{
+		ID:        int64(binary.LittleEndian.Uint64(b[0:])),
+		TimeStamp: int64(binary.LittleEndian.Uint64(b[8:])),
+		Price:     math.Float64frombits(binary.LittleEndian.Uint64(b[16:])),
+		Size:      math.Float64frombits(binary.LittleEndian.Uint64(b[24:])),
+		Bid:       binary.LittleEndian.Uint64(b[32:]) == 1,
+	}, nil
+}
+
+func (a *tradeArchive) Close() error {
+	return a.f.Close()
+}
+
+// TradesQuery filters the trades of a market. Zero values do not filter.
+type TradesQuery struct {
+	// Since and Until bound the trade timestamps, in unix nanoseconds,
+	// Until is exclusive.
+	Since int64
+	Until int64
+	// FromID returns the trades starting with the trade of that ID.
+	FromID int64
+	Limit  int
+}
+
+// tradeStore keeps the trades of a market: the recent ones in a ring, the
+// older ones in the archive.
+type tradeStore struct {
+	mu     sync.RWMutex
+	lastID int64
+	ring   ring[orderbook.Trade]
+	// archive is nil when trades leaving the ring are dropped.
+	archive *tradeArchive
+}
+
+func newTradeStore(size int) *tradeStore {
+	return &tradeStore{ring: newRing[orderbook.Trade](size)}
+}
+
+// add stores the trades made by the engine. Trades it already holds,
+// like those of a book restored after they were archived, are skipped.
+func (s *tradeStore) add(trades []*orderbook.Trade) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	evicted := []orderbook.Trade{}
+	for _, trade := range trades {
+		if trade.ID <= s.lastID {
+			continue
+		}
+		s.lastID = trade.ID
+		if old, ok := s.ring.push(*trade); ok {
+			evicted = append(evicted, old)
+		}
+	}
+	if s.archive == nil || len(evicted) == 0 {
+		return nil
+	}
+
+	return s.archive.append(evicted)
+}
+
+// setArchive moves the trades leaving the ring to a, from now on.
+func (s *tradeStore) setArchive(a *tradeArchive) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.archive = a
+	archived, err := s.archivedID()
+	if err != nil {
+		return err
+	}
+	s.lastID = max(s.lastID, archived)
+
+	return nil
+}
+
+// archivedID is the ID of the last archived trade.
+func (s *tradeStore) archivedID() (int64, error) {
+	if s.archive == nil || s.archive.n == 0 {
+		return 0, nil
+	}
+	last, err := s.archive.read(s.archive.n - 1)
+	if err != nil {
+		return 0, err
+	}
+
+	return last.ID, nil
+}
+
+// closeArchive closes the archive, trades leaving the ring are dropped
+// from now on.
+func (s *tradeStore) closeArchive() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.archive == nil {
+		return nil
+	}
+	err := s.archive.Close()
+	s.archive = nil
+
+	return err
+}
+
+func (s *tradeStore) last() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.lastID
+}
+
+// recent returns the trades of the ring, oldest first.
+func (s *tradeStore) recent() []orderbook.Trade {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	trades := make([]orderbook.Trade, s.ring.len())
+	for i := range trades {
+		trades[i] = *s.ring.at(i)
+	}
+
+	return trades
+}
+
+// restore refills the ring from a snapshot. Trades that reached the
+// archive after the snapshot was taken are not added twice.
+func (s *tradeStore) restore(trades []orderbook.Trade) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	archived, err := s.archivedID()
+	if err != nil {
+		return err
+	}
+	s.lastID = archived
+	s.ring = newRing[orderbook.Trade](cap(s.ring.items))
+	for _, trade := range trades {
+		if trade.ID <= archived {
+			continue
+		}
+		s.ring.push(trade)
+		s.lastID = max(s.lastID, trade.ID)
+	}
+
+	return nil
+}
+
+// len is the number of trades held, archived ones included.
+func (s *tradeStore) len() int {
+	if s.archive == nil {
+		return s.ring.len()
+	}
+
+	return s.archive.n + s.ring.len()
+}
+
+// at returns the i-th oldest trade, archived ones included.
+func (s *tradeStore) at(i int) (orderbook.Trade, error) {
+	archived := s.len() - s.ring.len()
+	if i >= archived {
+		return *s.ring.at(i - archived), nil
+	}
+
+	return s.archive.read(i)
+}
+
+// search returns the index of the first trade for which f is true, f
+// must be false for the trades before it and true for those after.
+func (s *tradeStore) search(f func(orderbook.Trade) bool) (int, error) {
+	var err error
+	i := sort.Search(s.len(), func(i int) bool {
+		trade, readErr := s.at(i)
+		if readErr != nil {
+			err = readErr
+			return true
+		}
+		return f(trade)
+	})
+
+	return i, err
+}
+
+// query returns the trades matching q in ID order. Without FromID and
+// Since the latest trades are returned.
+func (s *tradeStore) query(q TradesQuery) ([]orderbook.Trade, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	start, end := 0, s.len()
+	if q.Until != 0 {
+		i, err := s.search(func(t orderbook.Trade) bool { return t.TimeStamp >= q.Until })
+		if err != nil {
+			return nil, err
+		}
+		end = i
+	}
+	if q.FromID != 0 {
+		i, err := s.search(func(t orderbook.Trade) bool { return t.ID >= q.FromID })
+		if err != nil {
+			return nil, err
+		}
+		start = max(start, i)
+	}
+	if q.Since != 0 {
+		i, err := s.search(func(t orderbook.Trade) bool { return t.TimeStamp >= q.Since })
+		if err != nil {
+			return nil, err
+		}
+		start = max(start, i)
+	}
+	if q.FromID == 0 && q.Since == 0 {
+		start = max(start, end-q.Limit)
+	}
+	end = min(end, start+q.Limit)
+
+	trades := make([]orderbook.Trade, 0, max(0, end-start))
+	for i := start; i < end; i++ {
+		trade, err := s.at(i)
+		if err != nil {
+			return nil, err
+		}
+		trades = append(trades, trade)
+	}
+
+	return trades, nil
+}
+
+// scan calls fn with every trade made at or after since, oldest first.
+func (s *tradeStore) scan(since int64, fn func(*orderbook.Trade)) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	start, err := s.search(func(t orderbook.Trade) bool { return t.TimeStamp >= since })
+	if err != nil {
+		return err
+	}
+	for i := start; i < s.len(); i++ {
+		trade, err := s.at(i)
+		if err != nil {
+			return err
+		}
+		fn(&trade)
+	}
+
+	return nil
+}
+
+// setTradeArchive archives the trades of the engine's market to a. The
+// book must never hand out an ID the archive already holds.
+func (e *engine) setTradeArchive(a *tradeArchive) error {
+	var err error
+	e.do(func(ob *orderbook.Orderbook) {
+		if err = e.trades.setArchive(a); err != nil {
+			return
+		}
+		ob.BumpTradeSeq(e.trades.last())
+		err = e.backfillCandles()
+	})
+
+	return err
+}
+
+// SetTradeArchive keeps older trades of every market in dir. It must be
+// called before RestoreSnapshot.
+func (ex *Exchange) SetTradeArchive(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	return ex.markets.setArchiveDir(dir)
+}
+
+func tradeArchivePath(dir string, market Market) string {
+	return filepath.Join(dir, fmt.Sprintf("%s.trades", market))
+}
+
+// handleGetTrades returns the trades of a market in ID order. The query
+// takes since and until in unix milliseconds, fromId and limit.
+func (ex *Exchange) handleGetTrades(c echo.Context) error {
+	market := Market(c.Param("market"))
+	eng, ok := ex.engine(market)
+	if !ok {
+		return newAPIError(http.StatusNotFound, ErrCodeUnknownMarket, "market %s not found", market)
+	}
+
+	q := TradesQuery{}
+	for name, dst := range map[string]*int64{"since": &q.Since, "until": &q.Until, "fromId": &q.FromID} {
+		if err := queryInt64(c, name, dst); err != nil {
+			return err
+		}
+	}
+	// the query is in milliseconds, trades are stamped in nanoseconds
+	q.Since *= 1e6
+	q.Until *= 1e6
+
+	limit, err := queryLimit(c, defaultTradesLimit, maxTradesLimit)
+	if err != nil {
+		return err
+	}
+	q.Limit = limit
+
+	trades, err := eng.trades.query(q)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, trades)
+}
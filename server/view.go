@@ -0,0 +1,72 @@
+package server
+
+import "github.com/Baazaouihamza/crypto-exchange/orderbook"
+
+type Level struct {
+	Price float64
+	Size  float64
+}
+
+// BookView is an immutable picture of a market, published by the engine
+// after every batch.
+type BookView struct {
+	Market Market
+	Seq    uint64
+	// BestBid and BestAsk are nil when that side of the book is empty.
+	BestBid  *Level
+	BestAsk  *Level
+	BidDepth []Level
+	AskDepth []Level
+	Book     *OrderBookData
+	Ticker   *Ticker
+}
+
+func newBookView(market Market, ob *orderbook.Orderbook) *BookView {
+	view := &BookView{
+		Market: market,
+		Book: &OrderBookData{
+			TotalBidVolume: ob.BidTotalVolume(),
+			TotalAskVolume: ob.AskTotalVolume(),
+			Asks:           []*Order{},
+			Bids:           []*Order{},
+		},
+	}
+
+	view.AskDepth, view.Book.Asks = viewSide(ob.Asks())
+	view.BidDepth, view.Book.Bids = viewSide(ob.Bids())
+
+	if len(view.AskDepth) > 0 {
+		view.BestAsk = &view.AskDepth[0]
+	}
+	if len(view.BidDepth) > 0 {
+		view.BestBid = &view.BidDepth[0]
+	}
+
+	return view
+}
+
+func viewSide(limits []*orderbook.Limit) ([]Level, []*Order) {
+	var (
+		depth  = make([]Level, 0, len(limits))
+		orders = []*Order{}
+	)
+
+	for _, limit := range limits {
+		depth = append(depth, Level{
+			Price: limit.Price,
+			Size:  limit.TotalVolume,
+		})
+		for _, order := range limit.Orders {
+			orders = append(orders, &Order{
+				UserID:    order.UserID,
+				ID:        order.ID,
+				Price:     limit.Price,
+				Size:      order.Size,
+				Bid:       order.Bid,
+				Timestamp: order.Timestamp,
+			})
+		}
+	}
+
+	return depth, orders
+}